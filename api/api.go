@@ -19,19 +19,36 @@ package api
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
+	"sync"
 
+	"github.com/moloch--/leakdb/pkg/indexfile"
 	"github.com/moloch--/leakdb/pkg/searcher"
 )
 
 const (
 	// BadRequest - HTTP Bad Request
 	BadRequest = 400
+
+	// DefaultPageSize - Results per page if the query does not set page_size
+	DefaultPageSize = 1000
+	// MaxPageSize - Largest page_size a query may request
+	MaxPageSize = 10000
+
+	// DefaultMaxPrefixResults - Most results of a prefix query if the
+	// server does not set MaxPrefixResults
+	DefaultMaxPrefixResults = 1000
+	// DefaultMaxFilteredResults - Most index results a query reads to filter
+	// by the fields the index does not cover, if the server does not set
+	// MaxFilteredResults
+	DefaultMaxFilteredResults = 10000
+	// MinPrefixLength - Shortest literal prefix of a prefix query, shorter
+	// prefixes would scan most of the index
+	MinPrefixLength = 3
 )
 
 var (
@@ -41,10 +58,14 @@ var (
 
 // QuerySet - A LeakDB query
 type QuerySet struct {
-	Email  string `json:"email"`
-	Domain string `json:"domain"`
-	User   string `json:"user"`
-	Page   int    `json:"page"`
+	Email             string `json:"email"`
+	Domain            string `json:"domain"`
+	IncludeSubdomains bool   `json:"include_subdomains"`
+	Prefix            bool   `json:"prefix"`
+	User              string `json:"user"`
+	Password          string `json:"password"`
+	Page              int    `json:"page"`
+	PageSize          int    `json:"page_size"`
 }
 
 // Credential - A result credential
@@ -93,27 +114,189 @@ func (cred *Credential) IsHash() bool {
 
 // ResultSet - Result of a query
 type ResultSet struct {
-	Count   int          `json:"count"`
-	Page    int          `json:"page"`
-	Pages   int          `json:"pages"`
-	Results []Credential `json:"results"`
+	Count     int          `json:"count"`
+	Page      int          `json:"page"`
+	Pages     int          `json:"pages"`
+	Results   []Credential `json:"results"`
+	Truncated bool         `json:"truncated,omitempty"`
+}
+
+// IndexStats - Statistics of an index, only the entry count is known for
+// indexes without a stats sidecar. The most common digest is not included
+// since it can reveal the most common value, e.g. of a password index.
+type IndexStats struct {
+	Entries         int   `json:"entries"`
+	DistinctDigests int64 `json:"distinct_digests,omitempty"`
+	LargestRun      int64 `json:"largest_run,omitempty"`
+	Duplicates      int64 `json:"duplicates,omitempty"`
+}
+
+// StatsSet - Statistics of each configured index by key, ordered indexes
+// are listed as "prefix:<field>"
+type StatsSet struct {
+	Indexes map[string]*IndexStats `json:"indexes"`
 }
 
 // Server - A server object
 type Server struct {
-	JSONFile    string
+	JSONFile    string // JSON file, or the dataset manifest of sharded indexes
 	EmailIndex  string
 	UserIndex   string
 	DomainIndex string
+	UseMmap     bool
+
+	// Password queries reveal every account using a password, so they must
+	// be explicitly enabled even if a password index is provided
+	PasswordIndex      string
+	AllowPasswordQuery bool
+
+	// Indexes - Additional indexes by key, such as composite indexes
+	// e.g. {"email+password": "email-password.idx"}
+	Indexes map[string]string
+
+	// PrefixIndexes - Ordered indexes by field, used by prefix queries
+	// e.g. {"user": "user-ordered.idx"}
+	PrefixIndexes map[string]string
+	// MaxPrefixResults - Most results a prefix query returns, 0 uses
+	// DefaultMaxPrefixResults
+	MaxPrefixResults int
+	// MaxFilteredResults - Most index results a query reads when the index
+	// does not cover every queried field, 0 uses DefaultMaxFilteredResults
+	MaxFilteredResults int
+
+	// FenceInterval - In-memory fence interval of indexes without a fence
+	// sidecar, 0 disables the in-memory fence
+	FenceInterval int
 
 	TLSCertificate string
 	TLSKey         string
+
+	indexes      map[string]*searcher.Index
+	indexesMutex sync.Mutex
+}
+
+// Open - Open every configured index, indexes that are not opened here
+// are opened by the first query that uses them
+func (s *Server) Open() error {
+	for key := range s.Indexes {
+		if _, err := indexfile.CanonicalKey(key); err != nil {
+			return err
+		}
+	}
+	for key, path := range s.indexPaths() {
+		if path == "" {
+			continue
+		}
+		if _, err := s.getIndex(key); err != nil {
+			return err
+		}
+	}
+	for field := range s.PrefixIndexes {
+		if _, err := s.getPrefixIndex(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close - Close all open indexes
+func (s *Server) Close() error {
+	s.indexesMutex.Lock()
+	defer s.indexesMutex.Unlock()
+	var err error
+	for key, index := range s.indexes {
+		if closeErr := index.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.indexes, key)
+	}
+	return err
+}
+
+// indexPaths - Paths of all indexes by canonical key
+func (s *Server) indexPaths() map[string]string {
+	paths := map[string]string{
+		"email":    s.EmailIndex,
+		"user":     s.UserIndex,
+		"domain":   s.DomainIndex,
+		"password": s.PasswordIndex,
+	}
+	for key, path := range s.Indexes {
+		if key, err := indexfile.CanonicalKey(key); err == nil && path != "" {
+			paths[key] = path
+		}
+	}
+	return paths
+}
+
+// getIndex - Get the open index of key, opening it if needed
+func (s *Server) getIndex(key string) (*searcher.Index, error) {
+	s.indexesMutex.Lock()
+	defer s.indexesMutex.Unlock()
+	if index, ok := s.indexes[key]; ok {
+		return index, nil
+	}
+	path := s.indexPaths()[key]
+	if path == "" {
+		return nil, fmt.Errorf("No %s index file", key)
+	}
+	return s.openIndex(key, path, key)
+}
+
+// getPrefixIndex - Get the open ordered index of field, opening it if needed
+func (s *Server) getPrefixIndex(field string) (*searcher.Index, error) {
+	s.indexesMutex.Lock()
+	defer s.indexesMutex.Unlock()
+	name := "prefix:" + field
+	if index, ok := s.indexes[name]; ok {
+		return index, nil
+	}
+	path := s.PrefixIndexes[field]
+	if path == "" {
+		return nil, fmt.Errorf("No %s prefix index file", field)
+	}
+	index, err := s.openIndex(name, path, field)
+	if err != nil {
+		return nil, err
+	}
+	if !index.Header.IsOrdered() {
+		index.Close()
+		delete(s.indexes, name)
+		return nil, fmt.Errorf("%s is not an ordered index", path)
+	}
+	return index, nil
+}
+
+// openIndex - Open an index and cache it by name, the caller must hold
+// indexesMutex
+func (s *Server) openIndex(name string, path string, key string) (*searcher.Index, error) {
+	index, err := searcher.Open(s.JSONFile, path, key, &searcher.Options{
+		Mmap:          s.UseMmap,
+		FenceInterval: s.FenceInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.indexes == nil {
+		s.indexes = map[string]*searcher.Index{}
+	}
+	s.indexes[name] = index
+	return index, nil
+}
+
+func (s *Server) find(key string, value string) (*searcher.Cursor, error) {
+	index, err := s.getIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	return index.Cursor(value)
 }
 
 // StartTLS - Start TLS server
 func (s *Server) StartTLS(host string, port uint16) {
 	bind := fmt.Sprintf("%s:%d", host, port)
 	http.HandleFunc("/", s.SearchHandler)
+	http.HandleFunc("/stats", s.StatsHandler)
 	err := http.ListenAndServeTLS(bind, s.TLSCertificate, s.TLSKey, nil)
 	if err != nil {
 		log.Fatal("ListenAndServeTLS: ", err)
@@ -124,6 +307,7 @@ func (s *Server) StartTLS(host string, port uint16) {
 func (s *Server) Start(host string, port uint16) {
 	bind := fmt.Sprintf("%s:%d", host, port)
 	http.HandleFunc("/", s.SearchHandler)
+	http.HandleFunc("/stats", s.StatsHandler)
 	err := http.ListenAndServe(bind, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
@@ -147,32 +331,25 @@ func (s *Server) SearchHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	resultSet := &ResultSet{}
-	var results []*searcher.Credential
-	if query.Email != "" {
-		results, err = s.emailSearch(query)
-	} else if query.User != "" {
-		results, err = s.userSearch(query)
-	} else if query.Domain != "" {
-		results, err = s.domainSearch(query)
+	fields := query.fields()
+	if len(fields) == 0 {
+		http.Error(resp, "Invalid query: does not contain valid key", http.StatusBadRequest)
+		return
+	}
+	if _, ok := fields["password"]; ok && !s.AllowPasswordQuery {
+		http.Error(resp, "Password queries are not enabled", http.StatusForbidden)
+		return
+	}
+	var resultSet *ResultSet
+	if query.Prefix {
+		resultSet, err = s.prefixSearch(query, fields)
 	} else {
-		err = errors.New("Invalid query: does not contain valid key")
+		resultSet, err = s.search(query, fields)
 	}
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	resultSet.Page = 0
-	resultSet.Pages = 1
-	resultSet.Count = len(results)
-	resultSet.Results = []Credential{}
-	for _, result := range results {
-		resultSet.Results = append(resultSet.Results, Credential{
-			Email:    result.Email,
-			Password: result.Password,
-		})
-	}
 	data, err := json.Marshal(resultSet)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to serialized result set %s", err)
@@ -182,23 +359,66 @@ func (s *Server) SearchHandler(resp http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (s *Server) userSearch(query *QuerySet) ([]*searcher.Credential, error) {
-	if s.UserIndex == "" {
-		return nil, errors.New("No user index file")
+// StatsHandler - Statistics of the configured indexes, read from the index
+// headers and the sorter's stats sidecars so nothing is scanned
+func (s *Server) StatsHandler(resp http.ResponseWriter, req *http.Request) {
+	statsSet := &StatsSet{Indexes: map[string]*IndexStats{}}
+	for key, path := range s.indexPaths() {
+		if path == "" || s.hidesStats(key) {
+			continue
+		}
+		index, err := s.getIndex(key)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statsSet.Indexes[key] = indexStats(index)
+	}
+	for field := range s.PrefixIndexes {
+		if s.hidesStats(field) {
+			continue
+		}
+		index, err := s.getPrefixIndex(field)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statsSet.Indexes["prefix:"+field] = indexStats(index)
+	}
+	data, err := json.Marshal(statsSet)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to serialized stats %s", err)
+		http.Error(resp, msg, http.StatusInternalServerError)
+	} else {
+		resp.Write(data)
 	}
-	return searcher.Start(query.User, s.JSONFile, s.UserIndex)
 }
 
-func (s *Server) emailSearch(query *QuerySet) ([]*searcher.Credential, error) {
-	if s.EmailIndex == "" {
-		return nil, errors.New("No email index file")
+// hidesStats - Stats of indexes keyed by a password, including composite
+// keys, are hidden unless password queries are enabled. Invalid keys are
+// hidden too.
+func (s *Server) hidesStats(key string) bool {
+	if s.AllowPasswordQuery {
+		return false
 	}
-	return searcher.Start(query.Email, s.JSONFile, s.EmailIndex)
+	fields, err := indexfile.ParseKey(key)
+	if err != nil {
+		return true
+	}
+	for _, field := range fields {
+		if field == "password" {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *Server) domainSearch(query *QuerySet) ([]*searcher.Credential, error) {
-	if s.DomainIndex == "" {
-		return nil, errors.New("No domain index file")
+func indexStats(index *searcher.Index) *IndexStats {
+	stats := &IndexStats{Entries: index.NumberOfEntries}
+	if index.Stats != nil {
+		stats.DistinctDigests = index.Stats.DistinctDigests
+		stats.LargestRun = index.Stats.LargestRun
+		stats.Duplicates = index.Stats.Duplicates
 	}
-	return searcher.Start(query.Domain, s.JSONFile, s.DomainIndex)
+	return stats
 }
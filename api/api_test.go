@@ -20,15 +20,28 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/searcher"
+	"github.com/moloch--/leakdb/pkg/sorter"
 )
 
 const (
-	expected = `{"count":1,"page":0,"pages":1,"results":[{"email":"acirlosmg@nsw.gov.au","password":"avXtGXM"}]}`
+	expected = `{"count":1,"page":0,"pages":0,"results":[{"email":"acirlosmg@nsw.gov.au","password":"avXtGXM"}]}`
 )
 
+// minInt - Negating the smallest int overflows back to itself
+const minInt = -int(^uint(0)>>1) - 1
+
 func TestSearchHandler(t *testing.T) {
 	server := &Server{
 		JSONFile:    "../test/large-bloomed.json",
@@ -95,3 +108,440 @@ func TestSearchHandler(t *testing.T) {
 			result.Count, 13)
 	}
 }
+
+func TestServerOpen(t *testing.T) {
+	server := &Server{
+		JSONFile:   "../test/large-bloomed.json",
+		EmailIndex: "../test/large-email-sorted.idx",
+		UseMmap:    true,
+	}
+	err := server.Open()
+	if err != nil {
+		t.Errorf("Failed to open server indexes %s", err)
+		return
+	}
+	defer server.Close()
+	cursor, err := server.find("email", "acirlosmg@nsw.gov.au")
+	if err != nil || cursor.Count() != 1 {
+		t.Errorf("Email search returned %v (%v)", cursor, err)
+		return
+	}
+	_, err = server.find("user", "acirlosmg")
+	if err == nil {
+		t.Errorf("Expected error searching without a user index")
+		return
+	}
+}
+
+func TestSearchHandlerPages(t *testing.T) {
+	server := &Server{
+		JSONFile:    "../test/large-bloomed.json",
+		DomainIndex: "../test/large-domain-sorted.idx",
+	}
+	defer server.Close()
+	handler := http.HandlerFunc(server.SearchHandler)
+	query := func(page int) *ResultSet {
+		body, _ := json.Marshal(&QuerySet{Domain: "nsw.gov.au", Page: page, PageSize: 5})
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+		handler.ServeHTTP(rr, req)
+		result := &ResultSet{}
+		json.Unmarshal(rr.Body.Bytes(), result)
+		return result
+	}
+
+	emails := map[string]bool{}
+	for page, size := range []int{5, 5, 3} {
+		result := query(page)
+		if result.Count != 13 || result.Page != page || result.Pages != 2 || len(result.Results) != size {
+			t.Errorf("Page %d: unexpected result count=%d page=%d pages=%d results=%d",
+				page, result.Count, result.Page, result.Pages, len(result.Results))
+			return
+		}
+		for _, cred := range result.Results {
+			emails[cred.Email] = true
+		}
+	}
+	if len(emails) != 13 {
+		t.Errorf("Pages returned %d unique emails, want 13", len(emails))
+		return
+	}
+	if result := query(9); result.Page != 2 || len(result.Results) != 3 {
+		t.Errorf("Expected page 9 to be clamped to the last page, got page %d", result.Page)
+		return
+	}
+	for _, page := range []int{-1, minInt} {
+		if result := query(page); result.Page != 0 || len(result.Results) != 5 {
+			t.Errorf("Expected page %d to be clamped to the first page, got page %d", page, result.Page)
+			return
+		}
+	}
+}
+
+// buildIndex - Index and sort the large JSON file by key
+func buildIndex(t *testing.T, tempDir string, key string) string {
+	unsorted := filepath.Join(tempDir, key+".idx")
+	index, err := indexer.GetIndexer("../test/large-bloomed.json", unsorted, key, 8, 2, tempDir, false)
+	if err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	if err = index.Start(); err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	sorted := filepath.Join(tempDir, key+"-sorted.idx")
+	sort, err := sorter.GetSorter(unsorted, sorted, 2, 1, tempDir, false)
+	if err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	if err = sort.Start(); err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	return sorted
+}
+
+func query(handler http.Handler, query *QuerySet) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(query)
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(body))
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestSearchHandlerPassword(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := &Server{
+		JSONFile:      "../test/large-bloomed.json",
+		PasswordIndex: buildIndex(t, tempDir, "password"),
+	}
+	defer server.Close()
+	handler := http.HandlerFunc(server.SearchHandler)
+
+	rr := query(handler, &QuerySet{Password: "avXtGXM"})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected password query to be forbidden, got %d", rr.Code)
+		return
+	}
+
+	server.AllowPasswordQuery = true
+	rr = query(handler, &QuerySet{Password: "avXtGXM"})
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+		return
+	}
+}
+
+func TestSearchHandlerComposite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := &Server{
+		JSONFile:           "../test/large-bloomed.json",
+		EmailIndex:         "../test/large-email-sorted.idx",
+		DomainIndex:        "../test/large-domain-sorted.idx",
+		Indexes:            map[string]string{"password+email": buildIndex(t, tempDir, "email+password")},
+		AllowPasswordQuery: true,
+	}
+	defer server.Close()
+	handler := http.HandlerFunc(server.SearchHandler)
+
+	key, _, err := server.selectIndex((&QuerySet{Email: "a", Domain: "b", Password: "c"}).fields())
+	if err != nil || key != "email+password" {
+		t.Errorf("Expected the composite index to be selected, got '%s' (%v)", key, err)
+		return
+	}
+	key, _, _ = server.selectIndex((&QuerySet{Email: "a", Domain: "b"}).fields())
+	if key != "email" {
+		t.Errorf("Expected the email index to be selected, got '%s'", key)
+		return
+	}
+	if _, _, err = server.selectIndex((&QuerySet{User: "a"}).fields()); err == nil {
+		t.Errorf("Expected an error selecting an index for user")
+		return
+	}
+
+	pair := &QuerySet{Email: "acirlosmg@nsw.gov.au", Password: "avXtGXM"}
+	if body := query(handler, pair).Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+		return
+	}
+	pair.Password = "wrong"
+	result := &ResultSet{}
+	json.Unmarshal(query(handler, pair).Body.Bytes(), result)
+	if result.Count != 0 {
+		t.Errorf("Expected no results for the wrong password, got %d", result.Count)
+		return
+	}
+
+	// Domain and email have no composite index, results of the email index
+	// are filtered by domain
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, &QuerySet{Email: "acirlosmg@nsw.gov.au", Domain: "nsw.gov.au"}).Body.Bytes(), result)
+	if result.Count != 1 {
+		t.Errorf("Expected 1 filtered result, got %d", result.Count)
+		return
+	}
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, &QuerySet{Email: "acirlosmg@nsw.gov.au", Domain: "example.com"}).Body.Bytes(), result)
+	if result.Count != 0 {
+		t.Errorf("Expected 0 filtered results, got %d", result.Count)
+		return
+	}
+
+	// A page past the end returns the last page
+	domainPassword := &QuerySet{Domain: "nsw.gov.au", Password: "avXtGXM", Page: 3}
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, domainPassword).Body.Bytes(), result)
+	if result.Count != 1 || result.Page != 0 || len(result.Results) != 1 || result.Truncated {
+		t.Errorf("Expected the last filtered page, got %v", result)
+		return
+	}
+
+	// The domain has 13 results, only the first MaxFilteredResults are read
+	server.MaxFilteredResults = 5
+	domainPassword.Page = 0
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, domainPassword).Body.Bytes(), result)
+	if !result.Truncated || 1 < result.Count {
+		t.Errorf("Expected a truncated filtered result set, got %v", result)
+		return
+	}
+}
+
+func TestSearchHandlerSubdomains(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := &Server{
+		JSONFile:    "../test/large-bloomed.json",
+		EmailIndex:  "../test/large-email-sorted.idx",
+		DomainIndex: "../test/large-domain-sorted.idx",
+	}
+	handler := http.HandlerFunc(server.SearchHandler)
+	if rr := query(handler, &QuerySet{Domain: "nsw.gov.au", IncludeSubdomains: true}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request without a domain suffix index, got %d", rr.Code)
+		return
+	}
+	server.Close()
+
+	server.Indexes = map[string]string{
+		indexfile.DomainSuffixKey: buildIndex(t, tempDir, indexfile.DomainSuffixKey),
+	}
+	defer server.Close()
+	handler = http.HandlerFunc(server.SearchHandler)
+
+	for _, test := range []struct {
+		query *QuerySet
+		count int
+	}{
+		{&QuerySet{Domain: "nsw.gov.au"}, 13},
+		{&QuerySet{Domain: "nsw.gov.au", IncludeSubdomains: true}, 13},
+		{&QuerySet{Domain: "gov.au", IncludeSubdomains: true}, 0},
+		{&QuerySet{Domain: "nsw.gov.au", Email: "acirlosmg@nsw.gov.au", IncludeSubdomains: true}, 1},
+	} {
+		rr := query(handler, test.query)
+		result := &ResultSet{}
+		json.Unmarshal(rr.Body.Bytes(), result)
+		if rr.Code != http.StatusOK || result.Count != test.count {
+			t.Errorf("Expected %d results for %v, got %d (%d)", test.count, test.query, result.Count, rr.Code)
+			return
+		}
+	}
+}
+
+func TestSearchHandlerPrefix(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	unsorted := filepath.Join(tempDir, "user-ordered.idx")
+	index, err := indexer.GetOrderedIndexer("../test/large-bloomed.json", unsorted, "user", indexfile.DefaultPrefixSize, 2, tempDir, false)
+	if err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	if err = index.Start(); err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	sorted := filepath.Join(tempDir, "user-ordered-sorted.idx")
+	sort, err := sorter.GetSorter(unsorted, sorted, 2, 1, tempDir, false)
+	if err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	if err = sort.Start(); err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+
+	data, _ := ioutil.ReadFile("../test/large-bloomed.json")
+	expected := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		cred := &searcher.Credential{}
+		json.Unmarshal(line, cred)
+		if strings.HasPrefix(strings.ToLower(cred.User), "mar") {
+			expected++
+		}
+	}
+
+	server := &Server{
+		JSONFile:      "../test/large-bloomed.json",
+		EmailIndex:    "../test/large-email-sorted.idx",
+		PrefixIndexes: map[string]string{"user": sorted},
+	}
+	if err = server.Open(); err != nil {
+		t.Errorf("Open failed: %s", err)
+		return
+	}
+	defer server.Close()
+	handler := http.HandlerFunc(server.SearchHandler)
+
+	result := &ResultSet{}
+	rr := query(handler, &QuerySet{User: "Mar*", Prefix: true, PageSize: 2})
+	json.Unmarshal(rr.Body.Bytes(), result)
+	if rr.Code != http.StatusOK || result.Count != expected || result.Truncated || len(result.Results) != 2 {
+		t.Errorf("Expected %d results, got %d (%d, %v)", expected, result.Count, rr.Code, result.Truncated)
+		return
+	}
+
+	server.MaxPrefixResults = 5
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, &QuerySet{User: "mar", Prefix: true, Page: 3, PageSize: 2}).Body.Bytes(), result)
+	if result.Count != 5 || !result.Truncated || result.Page != 2 || len(result.Results) != 1 {
+		t.Errorf("Expected a truncated last page, got %v", result)
+		return
+	}
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, &QuerySet{User: "mar", Prefix: true, Page: minInt, PageSize: 2}).Body.Bytes(), result)
+	if result.Page != 0 || len(result.Results) != 2 {
+		t.Errorf("Expected page %d to be clamped to the first page, got %v", minInt, result)
+		return
+	}
+
+	result = &ResultSet{}
+	json.Unmarshal(query(handler, &QuerySet{User: "pspoor", Email: "pspoor2@fotki.com", Prefix: true}).Body.Bytes(), result)
+	if result.Count != 1 || result.Results[0].Email != "pspoor2@fotki.com" {
+		t.Errorf("Expected the email to filter the prefix results, got %v", result)
+		return
+	}
+
+	for _, bad := range []*QuerySet{
+		{User: "m*", Prefix: true},
+		{Email: "pspoor", Prefix: true},
+	} {
+		if rr := query(handler, bad); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected bad request for %v, got %d", bad, rr.Code)
+			return
+		}
+	}
+}
+
+func TestSearchHandlerSharded(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifestPath := filepath.Join(tempDir, "dataset.json")
+	manifest := indexfile.NewManifest(manifestPath)
+	shards := []string{}
+	for _, target := range []string{"../test/small-bloomed.json", "../test/large-bloomed.json"} {
+		shard, err := manifest.Add(target)
+		if err != nil {
+			t.Fatalf("Manifest error: %s", err)
+		}
+		unsorted := filepath.Join(tempDir, fmt.Sprintf("%d.idx", shard.ID))
+		index, err := indexer.GetIndexer(target, unsorted, "email", 8, 2, tempDir, false)
+		if err != nil {
+			t.Fatalf("Index error: %s", err)
+		}
+		index.SetShard(shard)
+		if err = index.Start(); err != nil {
+			t.Fatalf("Index error: %s", err)
+		}
+		sorted := filepath.Join(tempDir, fmt.Sprintf("%d-sorted.idx", shard.ID))
+		sort, _ := sorter.GetSorter(unsorted, sorted, 2, 1, tempDir, false)
+		if err = sort.Start(); err != nil {
+			t.Fatalf("Sort error: %s", err)
+		}
+		shards = append(shards, sorted)
+	}
+	manifest.WriteFile(manifestPath)
+	merged := filepath.Join(tempDir, "merged.idx")
+	if err = sorter.Merge(shards, merged); err != nil {
+		t.Fatalf("Merge error: %s", err)
+	}
+
+	server := &Server{
+		JSONFile:   manifestPath,
+		EmailIndex: merged,
+	}
+	if err = server.Open(); err != nil {
+		t.Errorf("Open failed: %s", err)
+		return
+	}
+	defer server.Close()
+	handler := http.HandlerFunc(server.SearchHandler)
+	if body := query(handler, &QuerySet{Email: "acirlosmg@nsw.gov.au"}).Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	password := buildIndex(t, tempDir, "password")
+	server := &Server{
+		JSONFile:      "../test/large-bloomed.json",
+		EmailIndex:    "../test/large-email-sorted.idx",
+		DomainIndex:   buildIndex(t, tempDir, "domain"),
+		PasswordIndex: password,
+		Indexes:       map[string]string{"password+email": buildIndex(t, tempDir, "email+password")},
+		PrefixIndexes: map[string]string{"password": password},
+	}
+	defer server.Close()
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/stats", nil)
+	http.HandlerFunc(server.StatsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Stats handler returned %d: %s", rr.Code, rr.Body.String())
+		return
+	}
+	statsSet := &StatsSet{}
+	json.Unmarshal(rr.Body.Bytes(), statsSet)
+	email, domain := statsSet.Indexes["email"], statsSet.Indexes["domain"]
+	if email == nil || email.Entries != 8000 || email.DistinctDigests != 0 {
+		t.Errorf("Unexpected email index stats %+v", email)
+		return
+	}
+	if domain == nil || domain.Entries != 8000 || domain.DistinctDigests < 1 || domain.LargestRun < 13 {
+		t.Errorf("Unexpected domain index stats %+v", domain)
+		return
+	}
+	for _, key := range []string{"password", "email+password", "prefix:password"} {
+		if _, ok := statsSet.Indexes[key]; ok {
+			t.Errorf("%s index stats are returned when password queries are not enabled", key)
+			return
+		}
+	}
+}
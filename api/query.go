@@ -0,0 +1,290 @@
+package api
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/searcher"
+)
+
+var (
+	// Relative number of distinct values of each field, used to pick the
+	// index that matches the fewest entries
+	fieldSelectivity = map[string]int{
+		"email":    4,
+		"user":     3,
+		"password": 2,
+		"domain":   1,
+
+		indexfile.DomainSuffixKey: 1,
+	}
+)
+
+// fields - Non-blank fields of the query, a domain that includes its
+// subdomains is queried against the domain suffix index
+func (q *QuerySet) fields() map[string]string {
+	fields := map[string]string{}
+	for field, value := range map[string]string{
+		"email":    q.Email,
+		"user":     q.User,
+		"domain":   q.Domain,
+		"password": q.Password,
+	} {
+		if value != "" {
+			fields[field] = value
+		}
+	}
+	if q.IncludeSubdomains && q.Domain != "" {
+		delete(fields, "domain")
+		fields[indexfile.DomainSuffixKey] = q.Domain
+	}
+	return fields
+}
+
+// selectIndex - The most selective index whose fields are all in the
+// query, indexes with more fields are always more selective
+func (s *Server) selectIndex(fields map[string]string) (string, []string, error) {
+	keys := []string{}
+	for key, path := range s.indexPaths() {
+		if path != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys) // Break ties consistently
+
+	bestKey, bestFields, bestScore := "", []string{}, -1
+	for _, key := range keys {
+		keyFields, err := indexfile.ParseKey(key)
+		if err != nil {
+			continue
+		}
+		score := 0
+		for _, field := range keyFields {
+			if _, ok := fields[field]; !ok {
+				score = -1
+				break
+			}
+			score += 100 + fieldSelectivity[field]
+		}
+		if bestScore < score {
+			bestKey, bestFields, bestScore = key, keyFields, score
+		}
+	}
+	if bestScore < 0 {
+		queried := []string{}
+		for field := range fields {
+			queried = append(queried, field)
+		}
+		sort.Strings(queried)
+		return "", nil, fmt.Errorf("No index file for %s", strings.Join(queried, ", "))
+	}
+	return bestKey, bestFields, nil
+}
+
+// search - Search the most selective index, fields the index does not
+// cover are checked against each result. Only the first MaxFilteredResults
+// results of the index are read, the result set is marked as truncated if
+// there are more.
+func (s *Server) search(query *QuerySet, fields map[string]string) (*ResultSet, error) {
+	key, keyFields, err := s.selectIndex(fields)
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, field := range keyFields {
+		values = append(values, fields[field])
+		delete(fields, field)
+	}
+	cursor, err := s.find(key, indexfile.JoinValues(values))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return getResultSet(cursor, query)
+	}
+
+	limit := s.MaxFilteredResults
+	if limit < 1 {
+		limit = DefaultMaxFilteredResults
+	}
+	return getFilteredResultSet(cursor, query, fields, limit)
+}
+
+// selectPrefixIndex - The most selective queried field with an ordered index
+func (s *Server) selectPrefixIndex(fields map[string]string) (string, error) {
+	bestField := ""
+	for field := range fields {
+		if s.PrefixIndexes[field] == "" {
+			continue
+		}
+		if bestField == "" || fieldSelectivity[bestField] < fieldSelectivity[field] {
+			bestField = field
+		}
+	}
+	if bestField == "" {
+		return "", errors.New("No prefix index file for the queried fields")
+	}
+	return bestField, nil
+}
+
+// prefixSearch - Search an ordered index for values that start with the
+// queried value or match its wildcards, the other fields are checked
+// against each result. Only the first MaxPrefixResults results of the
+// index are read, the result set is marked as truncated if there are more.
+func (s *Server) prefixSearch(query *QuerySet, fields map[string]string) (*ResultSet, error) {
+	field, err := s.selectPrefixIndex(fields)
+	if err != nil {
+		return nil, err
+	}
+	pattern := fields[field]
+	delete(fields, field)
+	if len(searcher.LiteralPrefix(pattern)) < MinPrefixLength {
+		return nil, fmt.Errorf("Prefix queries must start with at least %d characters", MinPrefixLength)
+	}
+	index, err := s.getPrefixIndex(field)
+	if err != nil {
+		return nil, err
+	}
+	limit := s.MaxPrefixResults
+	if limit < 1 {
+		limit = DefaultMaxPrefixResults
+	}
+
+	cursor, err := index.PrefixCursor(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return getFilteredResultSet(cursor, query, fields, limit)
+}
+
+// pageSize - Page size of the query within the server's limits
+func pageSize(query *QuerySet) int {
+	if query.PageSize < 1 {
+		return DefaultPageSize
+	}
+	if MaxPageSize < query.PageSize {
+		return MaxPageSize
+	}
+	return query.PageSize
+}
+
+// lastPage - Zero-indexed last page of count results
+func lastPage(count int, pageSize int) int {
+	if count == 0 {
+		return 0
+	}
+	return (count - 1) / pageSize
+}
+
+// getResultSet - Read one page of results, like the lambda Pages is the
+// zero-indexed last page and the page is clamped to the range of pages
+func getResultSet(cursor *searcher.Cursor, query *QuerySet) (*ResultSet, error) {
+	size := pageSize(query)
+	count := cursor.Count()
+	last := lastPage(count, size)
+	page := query.Page
+	if page < 0 {
+		page = 0 // 'page' is user controlled
+	}
+	if last < page {
+		page = last
+	}
+
+	resultSet := &ResultSet{
+		Count:   count,
+		Page:    page,
+		Pages:   last,
+		Results: []Credential{},
+	}
+	results, err := cursor.Page(page, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		resultSet.Results = append(resultSet.Results, Credential{
+			Email:    result.Email,
+			Password: result.Password,
+		})
+	}
+	return resultSet, nil
+}
+
+// getFilteredResultSet - Read the results from the cursor to count the
+// ones that match the remaining fields, keeping only the requested page.
+// Like the lambda a page past the end returns the last page, which is kept
+// while reading so the cursor is only read once. Reading stops after limit
+// results of the cursor and the result set is marked as truncated.
+func getFilteredResultSet(cursor *searcher.Cursor, query *QuerySet, fields map[string]string, limit int) (*ResultSet, error) {
+	size := pageSize(query)
+	page := query.Page
+	if page < 0 {
+		page = 0 // 'page' is user controlled
+	}
+	resultSet := &ResultSet{Results: []Credential{}}
+	lastResults := []Credential{} // Results of the last page read so far
+	for read := 0; ; read++ {
+		result, err := cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if limit <= read {
+			resultSet.Truncated = true
+			break
+		}
+		if !matchesFields(result, fields) {
+			continue
+		}
+		cred := Credential{
+			Email:    result.Email,
+			Password: result.Password,
+		}
+		if resultSet.Count%size == 0 {
+			lastResults = lastResults[:0]
+		}
+		lastResults = append(lastResults, cred)
+		if resultSet.Count/size == page {
+			resultSet.Results = append(resultSet.Results, cred)
+		}
+		resultSet.Count++
+	}
+	resultSet.Pages = lastPage(resultSet.Count, size)
+	resultSet.Page = page
+	if resultSet.Pages < page {
+		resultSet.Page = resultSet.Pages
+		resultSet.Results = lastResults
+	}
+	return resultSet, nil
+}
+
+func matchesFields(cred *searcher.Credential, fields map[string]string) bool {
+	for field, value := range fields {
+		if !cred.Matches(field, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -3,7 +3,6 @@ module github.com/moloch--/leakdb
 go 1.14
 
 require (
-	github.com/emirpasic/gods v1.12.0
 	github.com/spf13/cobra v1.0.0
 	github.com/willf/bitset v1.1.10 // indirect
 	github.com/willf/bloom v2.0.3+incompatible
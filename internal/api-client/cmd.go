@@ -47,7 +47,7 @@ type OutputConfig struct {
 var rootCmd = &cobra.Command{
 	Use:   "leakdb",
 	Short: "LeakDB cli client",
-	Long:  `Query LeakDB for leaked credentials based on email, user, or domain.`,
+	Long:  `Query LeakDB for leaked credentials based on email, user, domain, or password.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Printf("Must specify a query, see --help\n")
 	},
@@ -58,6 +58,10 @@ func init() {
 
 	// Pagination
 	rootCmd.PersistentFlags().IntP("page", "p", 0, "Page number")
+	rootCmd.PersistentFlags().IntP("page-size", "P", 0, "Results per page (0 = server default)")
+
+	// Prefix queries
+	rootCmd.PersistentFlags().BoolP("prefix", "x", false, "Query is a prefix or wildcard pattern such as jdoe*, requires a prefix index")
 
 	// Output options
 	rootCmd.PersistentFlags().StringP("save", "s", "", "Save results to file")
@@ -72,17 +76,24 @@ func init() {
 	rootCmd.PersistentFlags().IntP("timeout", "T", 30, "HTTPS request/connection timeout")
 
 	rootCmd.AddCommand(emailCmd)
+	domainCmd.Flags().BoolP("include-subdomains", "S", false, "Include subdomains of the domain (requires a domain-suffix index)")
 	rootCmd.AddCommand(domainCmd)
 	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(passwordCmd)
 }
 
-func parsePaginationFlags(cmd *cobra.Command) (int, error) {
+func parsePaginationFlags(cmd *cobra.Command) (int, int, error) {
 	page, err := cmd.Flags().GetInt("page")
 	if err != nil {
 		fmt.Printf("Failed to parse --page flag: %s\n", err)
-		return 0, err
+		return 0, 0, err
+	}
+	pageSize, err := cmd.Flags().GetInt("page-size")
+	if err != nil {
+		fmt.Printf("Failed to parse --page-size flag: %s\n", err)
+		return 0, 0, err
 	}
-	return page, nil
+	return page, pageSize, nil
 }
 
 func parseHTTPFlags(cmd *cobra.Command) (leakdb.ClientHTTPConfig, error) {
@@ -143,11 +154,19 @@ func parseOutputFlags(cmd *cobra.Command) (string, *OutputConfig, error) {
 }
 
 func genericQueryCommand(cmd *cobra.Command, querySet *api.QuerySet) {
-	page, err := parsePaginationFlags(cmd)
+	page, pageSize, err := parsePaginationFlags(cmd)
 	if err != nil {
 		return
 	}
 	querySet.Page = page
+	querySet.PageSize = pageSize
+
+	prefix, err := cmd.Flags().GetBool("prefix")
+	if err != nil {
+		fmt.Printf("Failed to parse --prefix flag: %s\n", err)
+		return
+	}
+	querySet.Prefix = prefix
 
 	httpConfig, err := parseHTTPFlags(cmd)
 	if err != nil {
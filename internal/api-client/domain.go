@@ -18,6 +18,8 @@ package apiclient
 */
 
 import (
+	"fmt"
+
 	"github.com/moloch--/leakdb/api"
 	"github.com/spf13/cobra"
 )
@@ -27,8 +29,14 @@ var domainCmd = &cobra.Command{
 	Short: "Query domain",
 	Long:  `Query LeakDB for all passwords associated with a domain`,
 	Run: func(cmd *cobra.Command, args []string) {
+		includeSubdomains, err := cmd.Flags().GetBool("include-subdomains")
+		if err != nil {
+			fmt.Printf("Failed to parse --include-subdomains flag: %s\n", err)
+			return
+		}
 		genericQueryCommand(cmd, &api.QuerySet{
-			Domain: args[0],
+			Domain:            args[0],
+			IncludeSubdomains: includeSubdomains,
 		})
 	},
 }
@@ -0,0 +1,34 @@
+package apiclient
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"github.com/moloch--/leakdb/api"
+	"github.com/spf13/cobra"
+)
+
+var passwordCmd = &cobra.Command{
+	Use:   "password",
+	Short: "Query password",
+	Long:  `Query LeakDB for all accounts that used a password`,
+	Run: func(cmd *cobra.Command, args []string) {
+		genericQueryCommand(cmd, &api.QuerySet{
+			Password: args[0],
+		})
+	},
+}
@@ -21,14 +21,24 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/moloch--/leakdb/api"
 	"github.com/spf13/cobra"
 )
 
 const (
-	jsonFlagStr        = "json"
-	userIndexFlagStr   = "index-user"
-	emailIndexFlagStr  = "index-email"
-	domainIndexFlagStr = "index-domain"
+	jsonFlagStr          = "json"
+	manifestFlagStr      = "manifest"
+	userIndexFlagStr     = "index-user"
+	emailIndexFlagStr    = "index-email"
+	domainIndexFlagStr   = "index-domain"
+	passwordIndexFlagStr = "index-password"
+	allowPasswordFlagStr = "allow-password-query"
+	indexFlagStr         = "index"
+	mmapFlagStr          = "mmap"
+	fenceFlagStr         = "fence-interval"
+	prefixIndexFlagStr   = "prefix-index"
+	maxPrefixFlagStr     = "max-prefix-results"
+	maxFilteredFlagStr   = "max-filtered-results"
 
 	tlsFlagStr  = "enable-tls"
 	certFlagStr = "cert"
@@ -67,9 +77,18 @@ func init() {
 	rootCmd.PersistentFlags().Uint16P(portFlagStr, "p", 8888, "Bind port")
 
 	rootCmd.PersistentFlags().StringP(jsonFlagStr, "J", "", "JSON data set file")
+	rootCmd.PersistentFlags().StringP(manifestFlagStr, "M", "", "Dataset manifest of sharded indexes, used in place of --"+jsonFlagStr)
 	rootCmd.PersistentFlags().StringP(userIndexFlagStr, "U", "", "User index file")
 	rootCmd.PersistentFlags().StringP(emailIndexFlagStr, "E", "", "Email index file")
 	rootCmd.PersistentFlags().StringP(domainIndexFlagStr, "D", "", "Domain index file")
+	rootCmd.PersistentFlags().StringP(passwordIndexFlagStr, "P", "", "Password index file")
+	rootCmd.PersistentFlags().StringSliceP(indexFlagStr, "I", []string{}, "Additional index as key=file, e.g. email+password=email-password.idx or domain-suffix=domain-suffix.idx")
+	rootCmd.PersistentFlags().StringSliceP(prefixIndexFlagStr, "X", []string{}, "Ordered index for prefix queries as field=file, e.g. user=user-ordered.idx")
+	rootCmd.PersistentFlags().Int(maxPrefixFlagStr, api.DefaultMaxPrefixResults, "Most results returned by a prefix query")
+	rootCmd.PersistentFlags().Int(maxFilteredFlagStr, api.DefaultMaxFilteredResults, "Most index results read by a query with fields the index does not cover")
+	rootCmd.PersistentFlags().BoolP(allowPasswordFlagStr, "A", false, "Allow queries by password, requires a password index")
+	rootCmd.PersistentFlags().BoolP(mmapFlagStr, "m", false, "Memory-map the JSON and index files")
+	rootCmd.PersistentFlags().IntP(fenceFlagStr, "f", 0, "Keep every Nth digest in memory for indexes without a fence file (0 = disabled)")
 
 	rootCmd.PersistentFlags().BoolP(tlsFlagStr, "s", false, "Enable TLS")
 	rootCmd.PersistentFlags().StringP(certFlagStr, "c", "", "TLS certificate")
@@ -20,6 +20,7 @@ package apiserver
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/moloch--/leakdb/api"
 	"github.com/spf13/cobra"
@@ -77,6 +78,14 @@ func getServer(cmd *cobra.Command, args []string) *api.Server {
 		fmt.Printf("Failed to parse --%s flag: %s\n", jsonFlagStr, err)
 		return nil
 	}
+	manifest, err := cmd.Flags().GetString(manifestFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", manifestFlagStr, err)
+		return nil
+	}
+	if manifest != "" {
+		jsonFile = manifest
+	}
 	if !fileExists(jsonFile) {
 		fmt.Printf("File does not exist %s\n", jsonFile)
 		return nil
@@ -112,12 +121,100 @@ func getServer(cmd *cobra.Command, args []string) *api.Server {
 		return nil
 	}
 
-	return &api.Server{
+	passwordIndex, err := cmd.Flags().GetString(passwordIndexFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", passwordIndexFlagStr, err)
+		return nil
+	}
+	if passwordIndex != "" && !fileExists(passwordIndex) {
+		fmt.Printf("File does not exist %s", passwordIndex)
+		return nil
+	}
+	allowPassword, err := cmd.Flags().GetBool(allowPasswordFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", allowPasswordFlagStr, err)
+		return nil
+	}
+	if allowPassword && passwordIndex == "" {
+		fmt.Printf("--%s requires --%s\n", allowPasswordFlagStr, passwordIndexFlagStr)
+		return nil
+	}
+
+	indexes, err := parseIndexFlags(cmd, indexFlagStr)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return nil
+	}
+	prefixIndexes, err := parseIndexFlags(cmd, prefixIndexFlagStr)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return nil
+	}
+	maxPrefixResults, err := cmd.Flags().GetInt(maxPrefixFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", maxPrefixFlagStr, err)
+		return nil
+	}
+	maxFilteredResults, err := cmd.Flags().GetInt(maxFilteredFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", maxFilteredFlagStr, err)
+		return nil
+	}
+
+	useMmap, err := cmd.Flags().GetBool(mmapFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", mmapFlagStr, err)
+		return nil
+	}
+
+	fenceInterval, err := cmd.Flags().GetInt(fenceFlagStr)
+	if err != nil {
+		fmt.Printf("Failed to parse --%s flag: %s\n", fenceFlagStr, err)
+		return nil
+	}
+
+	server := &api.Server{
 		JSONFile:    jsonFile,
 		EmailIndex:  emailIndex,
 		UserIndex:   userIndex,
 		DomainIndex: domainIndex,
+		UseMmap:     useMmap,
+
+		Indexes:            indexes,
+		PrefixIndexes:      prefixIndexes,
+		MaxPrefixResults:   maxPrefixResults,
+		MaxFilteredResults: maxFilteredResults,
+		PasswordIndex:      passwordIndex,
+		AllowPasswordQuery: allowPassword,
+		FenceInterval:      fenceInterval,
+	}
+	err = server.Open()
+	if err != nil {
+		fmt.Printf("Failed to open index: %s\n", err)
+		server.Close()
+		return nil
 	}
+	return server
+}
+
+// parseIndexFlags - Parse key=file index flags
+func parseIndexFlags(cmd *cobra.Command, flag string) (map[string]string, error) {
+	indexFlags, err := cmd.Flags().GetStringSlice(flag)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", flag, err)
+	}
+	indexes := map[string]string{}
+	for _, indexFlag := range indexFlags {
+		parts := strings.SplitN(indexFlag, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid --%s '%s', must be key=file", flag, indexFlag)
+		}
+		if !fileExists(parts[1]) {
+			return nil, fmt.Errorf("File does not exist %s", parts[1])
+		}
+		indexes[parts[0]] = parts[1]
+	}
+	return indexes, nil
 }
 
 func getTLSConfig(cmd *cobra.Command, args []string) (string, string, error) {
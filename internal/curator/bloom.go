@@ -20,6 +20,7 @@ package curator
 import (
 	"fmt"
 	"os"
+	"text/tabwriter"
 	"time"
 
 	"github.com/moloch--/leakdb/pkg/bloomer"
@@ -36,6 +37,11 @@ var bloomCmd = &cobra.Command{
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", jsonFlagStr, err)
 			return
 		}
+		options, err := parseTargetFlags(cmd)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
 		output, err := cmd.Flags().GetString(outputFlagStr)
 		if err != nil {
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", outputFlagStr, err)
@@ -71,6 +77,16 @@ var bloomCmd = &cobra.Command{
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", filterSaveFlagStr, err)
 			return
 		}
+		filterType, err := cmd.Flags().GetString(filterTypeFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", filterTypeFlagStr, err)
+			return
+		}
+		filterRemove, err := cmd.Flags().GetString(filterRemoveFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", filterRemoveFlagStr, err)
+			return
+		}
 
 		if _, err = os.Stat(target); os.IsNotExist(err) {
 			fmt.Printf(Warn+"Target error: %s", err)
@@ -78,15 +94,25 @@ var bloomCmd = &cobra.Command{
 		}
 
 		fmt.Printf(Info + "Bloom Filter:\n")
+		fmt.Printf("\tType = %s\n", filterType)
 		fmt.Printf("\tSize = %dGb (%d bytes)\n", filterSize, (filterSize * gb))
 		fmt.Printf("\tHashes = %d\n", filterHashes)
 		fmt.Println()
 		fmt.Printf(Info+"Target: %v\n", target)
 		fmt.Printf(Info+"Output: %s\n", output)
 
-		bloom, err := bloomer.GetBloomer(target, output, outputAppend, filterSave, filterLoad, workers, filterSize, filterHashes)
+		bloom, err := bloomer.GetBloomer(target, options, output, outputAppend, filterSave, filterLoad, filterType, workers, filterSize, filterHashes)
 		if err != nil {
-			fmt.Printf(Warn+"Bloom error %s", err)
+			fmt.Printf(Warn+"Bloom error %s\n", err)
+			return
+		}
+		if filterRemove != "" {
+			removed, err := bloom.Remove(filterRemove)
+			if err != nil {
+				fmt.Printf(Warn+"Failed to remove entries from filter: %s\n", err)
+				return
+			}
+			fmt.Printf(Info+"Removed %d entries from filter\n", removed)
 		}
 		done := make(chan bool)
 		go bloomProgress(bloom, done)
@@ -94,9 +120,26 @@ var bloomCmd = &cobra.Command{
 		err = bloom.Start()
 		done <- true
 		<-done
+		displayBloomReport(bloom)
 		if err != nil {
-			fmt.Printf(Warn+"Bloom error %s", err)
+			fmt.Printf(Warn+"Bloom error %s\n", err)
 		}
 		fmt.Printf("Completed in %s\n", time.Now().Sub(started))
 	},
 }
+
+func displayBloomReport(bloom *bloomer.Bloom) {
+	table := new(tabwriter.Writer)
+	table.Init(os.Stdout, 1, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Target\tLines\tUniques\tDuplicates\tError\n")
+	fmt.Fprintf(table, "======\t=====\t=======\t==========\t=====\n")
+	for _, report := range bloom.Report {
+		errMsg := ""
+		if report.Err != nil {
+			errMsg = report.Err.Error()
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%s\n",
+			report.Target, report.Lines, report.Uniques, report.Duplicates, errMsg)
+	}
+	table.Flush()
+}
@@ -22,6 +22,9 @@ import (
 	"os"
 	"runtime"
 
+	"github.com/moloch--/leakdb/pkg/bloomer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/searcher"
 	"github.com/spf13/cobra"
 )
 
@@ -48,6 +51,11 @@ const (
 	recursiveFlagStr  = "recursive"
 	skipPrefixFlagStr = "skip-prefix"
 	skipSuffixFlagStr = "skip-suffix"
+	includeFlagStr    = "include"
+	excludeFlagStr    = "exclude"
+	minSizeFlagStr    = "min-size"
+	maxSizeFlagStr    = "max-size"
+	symlinksFlagStr   = "symlinks"
 
 	// Filter flags
 	workersFlagStr      = "workers"
@@ -55,23 +63,38 @@ const (
 	filterHashesFlagStr = "filter-hashes"
 	filterLoadFlagStr   = "filter-load"
 	filterSaveFlagStr   = "filter-save"
+	filterTypeFlagStr   = "filter-type"
+	filterRemoveFlagStr = "filter-remove"
 
 	// Index flags
-	keyFlagStr       = "key"
-	noCleanupFlagStr = "no-cleanup"
+	keyFlagStr              = "key"
+	noCleanupFlagStr        = "no-cleanup"
+	digestBitsFlagStr       = "digest-bits"
+	publicSuffixListFlagStr = "public-suffix-list"
+	orderedFlagStr          = "ordered"
+	prefixSizeFlagStr       = "prefix-size"
+	manifestFlagStr         = "manifest"
 
 	tempDirFlagStr = "temp"
 
 	// Sort flags
 	maxMemoryFlagStr     = "max-memory"
-	checkFlagStr         = "check"
 	maxGoRoutinesFlagStr = "max-goroutines"
+	dedupeFlagStr        = "dedupe"
 
 	// Search flags
-	valueFlagStr   = "value"
-	verboseFlagStr = "verbose"
+	valueFlagStr      = "value"
+	valuesFileFlagStr = "values-file"
+	verboseFlagStr    = "verbose"
+	prefixFlagStr     = "prefix"
+	countFlagStr      = "count"
 
-	defaultMaxMemory = 1024
+	// Verify flags
+	sampleFlagStr = "sample"
+	mmapFlagStr   = "mmap"
+
+	defaultMaxMemory  = 1024
+	defaultDigestBits = 64
 
 	// ANSI Colors
 	normal    = "\033[0m"
@@ -119,9 +142,13 @@ func init() {
 	rootCmd.AddCommand(versionCmd)
 
 	// Main
-	rootCmd.Flags().StringSliceP(keysFlagStr, "k", []string{"user", "email"}, "Comma separated list of key(s): email, user, domain")
+	rootCmd.Flags().StringSliceP(keysFlagStr, "k", []string{"user", "email"}, "Comma separated list of key(s): email, user, domain, domain-suffix, password, or composites such as email+password")
 	rootCmd.Flags().StringP(tempDirFlagStr, "T", "", "directory for temp files (default: cwd)")
 	rootCmd.Flags().StringP(jsonFlagStr, "j", "", "input file/directory of normalized json file(s)")
+	rootCmd.Flags().BoolP(recursiveFlagStr, "r", false, "recursively scan input directory")
+	rootCmd.Flags().StringP(skipPrefixFlagStr, "p", "", "skip files with prefix")
+	rootCmd.Flags().String(skipSuffixFlagStr, "", "skip files with suffix")
+	addTargetFlags(rootCmd)
 	rootCmd.Flags().StringP(outputFlagStr, "o", "", "output directory")
 	rootCmd.Flags().UintP(bloomWorkersFlagStr, "W", uint(1), "max number of bloom filter workers")
 	rootCmd.Flags().UintP(indexWorkersFlagStr, "w", uint(runtime.NumCPU()), "max number of index workers")
@@ -130,7 +157,12 @@ func init() {
 	rootCmd.Flags().UintP(filterHashesFlagStr, "f", 14, "number of bloom filter hash functions")
 	rootCmd.Flags().StringP(filterLoadFlagStr, "L", "", "load existing bloom filter from saved file")
 	rootCmd.Flags().StringP(filterSaveFlagStr, "S", "", "save bloom filter to file when complete")
-	rootCmd.Flags().UintP(maxMemoryFlagStr, "m", defaultMaxMemory, "max memory in MBs, this is not exact! See detailed --help")
+	rootCmd.Flags().StringP(filterTypeFlagStr, "t", bloomer.FilterBloom, "filter type: bloom, or counting (supports --filter-remove)")
+	rootCmd.Flags().StringP(filterRemoveFlagStr, "R", "", "remove lines in file/directory from the loaded filter")
+	rootCmd.Flags().UintP(maxMemoryFlagStr, "m", defaultMaxMemory, "max memory in MBs of the sort's tape, sort, and merge buffers")
+	rootCmd.Flags().BoolP(dedupeFlagStr, "D", false, "drop identical index entries while sorting")
+	rootCmd.Flags().UintP(digestBitsFlagStr, "d", defaultDigestBits, "index digest size in bits: 48, 64, or 96")
+	rootCmd.Flags().String(publicSuffixListFlagStr, "", "public suffix list file for domain-suffix indexes (default: built-in list)")
 
 	// Normalize
 	normalizeCmd.Flags().StringP(targetFlagStr, "t", "", "target directory of files")
@@ -139,10 +171,15 @@ func init() {
 	normalizeCmd.Flags().BoolP(recursiveFlagStr, "r", false, "recursively scan directory")
 	normalizeCmd.Flags().StringP(skipPrefixFlagStr, "p", "", "skip files with prefix")
 	normalizeCmd.Flags().StringP(skipSuffixFlagStr, "s", "", "skip files with suffix")
+	addTargetFlags(normalizeCmd)
 	rootCmd.AddCommand(normalizeCmd)
 
 	// Bloom
 	bloomCmd.Flags().StringP(jsonFlagStr, "j", "", "input directory of normalized json file(s)")
+	bloomCmd.Flags().BoolP(recursiveFlagStr, "r", false, "recursively scan input directory")
+	bloomCmd.Flags().StringP(skipPrefixFlagStr, "p", "", "skip files with prefix")
+	bloomCmd.Flags().String(skipSuffixFlagStr, "", "skip files with suffix")
+	addTargetFlags(bloomCmd)
 	bloomCmd.Flags().StringP(outputFlagStr, "o", "", "output json file")
 	bloomCmd.Flags().BoolP(outputAppendFlagStr, "a", false, "append output file")
 	bloomCmd.Flags().UintP(workersFlagStr, "w", uint(1), "number of worker threads")
@@ -150,30 +187,59 @@ func init() {
 	bloomCmd.Flags().UintP(filterHashesFlagStr, "f", 14, "number of bloom filter hash functions")
 	bloomCmd.Flags().StringP(filterLoadFlagStr, "L", "", "load existing bloom filter from saved file")
 	bloomCmd.Flags().StringP(filterSaveFlagStr, "S", "", "save bloom filter to file when complete")
+	bloomCmd.Flags().StringP(filterTypeFlagStr, "t", bloomer.FilterBloom, "filter type: bloom, or counting (supports --filter-remove)")
+	bloomCmd.Flags().StringP(filterRemoveFlagStr, "R", "", "remove lines in file/directory from the loaded filter")
 	rootCmd.AddCommand(bloomCmd)
 
 	// Indexer
 	indexCmd.Flags().StringP(jsonFlagStr, "j", "", "json input file")
 	indexCmd.Flags().StringP(outputFlagStr, "o", "leakdb.idx", "output index file")
 	indexCmd.Flags().UintP(workersFlagStr, "w", uint(runtime.NumCPU()), "number of worker threads")
-	indexCmd.Flags().StringP(keyFlagStr, "k", "email", "index key can be: email, user, or domain")
+	indexCmd.Flags().StringP(keyFlagStr, "k", "email", "index key can be: email, user, domain, domain-suffix, password, or a composite such as email+password")
 	indexCmd.Flags().BoolP(noCleanupFlagStr, "N", false, "skip cleanup of temp file(s)")
 	indexCmd.Flags().StringP(tempDirFlagStr, "T", "", "directory for temp files (default: cwd)")
+	indexCmd.Flags().UintP(digestBitsFlagStr, "d", defaultDigestBits, "digest size in bits: 48, 64, or 96")
+	indexCmd.Flags().String(publicSuffixListFlagStr, "", "public suffix list file for domain-suffix indexes (default: built-in list)")
+	indexCmd.Flags().BoolP(orderedFlagStr, "O", false, "create an ordered index of a single field for prefix searches")
+	indexCmd.Flags().UintP(prefixSizeFlagStr, "P", indexfile.DefaultPrefixSize, "prefix size of ordered indexes in bytes")
+	indexCmd.Flags().StringP(manifestFlagStr, "M", "", "add the json file to a dataset manifest and create a sharded index")
 	rootCmd.AddCommand(indexCmd)
 
 	// Sorter
 	sortCmd.Flags().StringP(indexFlagStr, "i", "", "index file to sort")
 	sortCmd.Flags().StringP(outputFlagStr, "o", "", "output index file")
 	sortCmd.Flags().UintP(workersFlagStr, "w", uint(runtime.NumCPU()), "number of worker threads")
-	sortCmd.Flags().UintP(maxMemoryFlagStr, "m", defaultMaxMemory, "max memory in MBs, this is not exact! See detailed --help")
+	sortCmd.Flags().UintP(maxMemoryFlagStr, "m", defaultMaxMemory, "max memory in MBs of the sort's tape, sort, and merge buffers")
 	sortCmd.Flags().StringP(tempDirFlagStr, "T", "", "directory for temp files (default: cwd)")
 	sortCmd.Flags().BoolP(noCleanupFlagStr, "N", false, "skip cleanup temp file(s)")
+	sortCmd.Flags().BoolP(dedupeFlagStr, "D", false, "drop identical entries (same digest and offset)")
 	rootCmd.AddCommand(sortCmd)
 
+	// Merge
+	mergeCmd.Flags().StringSliceP(indexFlagStr, "i", []string{}, "sorted index files to merge")
+	mergeCmd.Flags().StringP(outputFlagStr, "o", "merged.idx", "output index file")
+	mergeCmd.Flags().StringP(manifestFlagStr, "M", "", "dataset manifest, indexes that are not sharded are rebased onto their shard")
+	mergeCmd.Flags().StringSliceP(jsonFlagStr, "j", []string{}, "json files of indexes that are not sharded to add to the manifest")
+	mergeCmd.Flags().BoolP(dedupeFlagStr, "D", false, "drop identical entries (same digest and offset)")
+	rootCmd.AddCommand(mergeCmd)
+
+	// Verify
+	verifyCmd.Flags().StringP(indexFlagStr, "i", "", "sorted index file to verify")
+	verifyCmd.Flags().StringP(jsonFlagStr, "j", "", "original json file, or the dataset manifest of a sharded index")
+	verifyCmd.Flags().StringP(keyFlagStr, "k", "", "index key, required to check the digests of indexes without a header")
+	verifyCmd.Flags().IntP(sampleFlagStr, "s", searcher.DefaultVerifySample, "number of digests to re-hash, 0 re-hashes every entry")
+	verifyCmd.Flags().BoolP(mmapFlagStr, "m", false, "memory-map the index and json file(s)")
+	rootCmd.AddCommand(verifyCmd)
+
 	// Search
 	searchCmd.Flags().StringP(indexFlagStr, "i", "", "index file to search")
-	searchCmd.Flags().StringP(jsonFlagStr, "j", "", "original json file")
+	searchCmd.Flags().StringP(jsonFlagStr, "j", "", "original json file, or the dataset manifest of a sharded index")
 	searchCmd.Flags().StringP(valueFlagStr, "v", "", "value to search for")
+	searchCmd.Flags().StringP(valuesFileFlagStr, "f", "", "file of values to search for, one per line")
+	searchCmd.Flags().StringP(keyFlagStr, "k", "", "index key, required to verify results of indexes without a header")
+	searchCmd.Flags().BoolP(verboseFlagStr, "V", false, "display debug metrics")
+	searchCmd.Flags().BoolP(prefixFlagStr, "p", false, "value is a prefix or wildcard pattern such as jdoe*, requires an ordered index")
+	searchCmd.Flags().BoolP(countFlagStr, "c", false, "only count the entries matching value, without reading the json file")
 	rootCmd.AddCommand(searchCmd)
 }
 
@@ -23,6 +23,8 @@ import (
 	"time"
 
 	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/publicsuffix"
 	"github.com/spf13/cobra"
 )
 
@@ -51,8 +53,9 @@ var indexCmd = &cobra.Command{
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", keyFlagStr, err)
 			return
 		}
-		if key != "email" && key != "user" && key != "domain" {
-			fmt.Printf(Warn+"Error --%s must be one of: email, user, or domain\n", keyFlagStr)
+		key, err = indexfile.CanonicalKey(key)
+		if err != nil {
+			fmt.Printf(Warn+"Error --%s %s\n", keyFlagStr, err)
 			return
 		}
 		if key == "domain" {
@@ -60,6 +63,15 @@ var indexCmd = &cobra.Command{
 			fmt.Println(Warn + "Warning: Due to the high number of collisions, creating domain indexes can take a long time.")
 			fmt.Println()
 		}
+		digestBits, err := cmd.Flags().GetUint(digestBitsFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", digestBitsFlagStr, err)
+			return
+		}
+		if !validDigestBits(digestBits) {
+			fmt.Printf(Warn+"Error --%s must be one of: 48, 64, or 96\n", digestBitsFlagStr)
+			return
+		}
 		noCleanup, err := cmd.Flags().GetBool(noCleanupFlagStr)
 		if err != nil {
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", noCleanupFlagStr, err)
@@ -70,6 +82,26 @@ var indexCmd = &cobra.Command{
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", tempDirFlagStr, err)
 			return
 		}
+		ordered, err := cmd.Flags().GetBool(orderedFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", orderedFlagStr, err)
+			return
+		}
+		prefixSize, err := cmd.Flags().GetUint(prefixSizeFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", prefixSizeFlagStr, err)
+			return
+		}
+		manifestPath, err := cmd.Flags().GetString(manifestFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", manifestFlagStr, err)
+			return
+		}
+		publicSuffixList, err := cmd.Flags().GetString(publicSuffixListFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", publicSuffixListFlagStr, err)
+			return
+		}
 		if tempDir == "" {
 			cwd, _ := os.Getwd()
 			tempDir, err = getTempDir(cwd)
@@ -82,9 +114,30 @@ var indexCmd = &cobra.Command{
 			defer os.RemoveAll(tempDir)
 		}
 
-		index, err := indexer.GetIndexer(target, output, key, workers, tempDir, noCleanup)
+		var index *indexer.Indexer
+		if ordered {
+			index, err = indexer.GetOrderedIndexer(target, output, key, int(prefixSize), workers, tempDir, noCleanup)
+		} else {
+			index, err = indexer.GetIndexer(target, output, key, int(digestBits/8), workers, tempDir, noCleanup)
+		}
 		if err != nil {
 			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		var manifest *indexfile.Manifest
+		if manifestPath != "" {
+			manifest, err = addShard(index, target, manifestPath)
+			if err != nil {
+				fmt.Printf(Warn+"%s\n", err)
+				return
+			}
+		}
+		if publicSuffixList != "" {
+			index.Suffixes, err = publicsuffix.Load(publicSuffixList)
+			if err != nil {
+				fmt.Printf(Warn+"%s\n", err)
+				return
+			}
 		}
 		done := make(chan bool)
 		go indexProgress(index, done)
@@ -94,7 +147,55 @@ var indexCmd = &cobra.Command{
 		<-done
 		if err != nil {
 			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		if manifest != nil {
+			// Only record the shard once it has an index
+			err = manifest.WriteFile(manifestPath)
+			if err != nil {
+				fmt.Printf(Warn+"%s\n", err)
+				return
+			}
 		}
 		fmt.Printf("Completed in %s\n", time.Now().Sub(started))
+		printMalformed(index)
 	},
 }
+
+// addShard - Add target to the dataset manifest, creating the manifest if
+// it does not exist, and make index a sharded index of target. The manifest
+// is not written, that is left until the index has been created.
+func addShard(index *indexer.Indexer, target string, manifestPath string) (*indexfile.Manifest, error) {
+	manifest, err := loadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := manifest.Add(target)
+	if err != nil {
+		return nil, err
+	}
+	err = index.SetShard(shard)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Indexing shard %d of %s\n", shard.ID, manifestPath)
+	return manifest, nil
+}
+
+// validDigestBits - Check the digest size is one the indexer supports
+func validDigestBits(digestBits uint) bool {
+	switch digestBits {
+	case 48, 64, 96:
+		return true
+	}
+	return false
+}
+
+// loadManifest - Read the manifest at manifestPath, or create an empty
+// manifest if it does not exist yet
+func loadManifest(manifestPath string) (*indexfile.Manifest, error) {
+	if _, err := os.Stat(manifestPath); err != nil {
+		return indexfile.NewManifest(manifestPath), nil
+	}
+	return indexfile.ReadManifest(manifestPath)
+}
@@ -27,11 +27,15 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/moloch--/leakdb/pkg/bloomer"
 	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/publicsuffix"
 	"github.com/moloch--/leakdb/pkg/sorter"
+	"github.com/moloch--/leakdb/pkg/targets"
 	"github.com/spf13/cobra"
 )
 
@@ -42,15 +46,20 @@ type BloomConfig struct {
 	Workers      uint   `json:"workers"`
 	FilterLoad   string `json:"filter_load"`
 	FilterSave   string `json:"filter_save"`
+	FilterType   string `json:"filter_type"`
+	FilterRemove string `json:"filter_remove"`
 	Output       string `json:"output"`
 	Append       bool   `json:"append"`
 }
 
 // IndexConfig - Index generation configuration
 type IndexConfig struct {
-	Workers   uint     `json:"workers"`
-	Keys      []string `json:"keys"`
-	NoCleanup bool     `json:"no_cleanup"`
+	Workers    uint     `json:"workers"`
+	Keys       []string `json:"keys"`
+	DigestBits uint     `json:"digest_bits"`
+	NoCleanup  bool     `json:"no_cleanup"`
+
+	PublicSuffixList string `json:"public_suffix_list"`
 }
 
 // SortConfig - Sort configuration
@@ -58,6 +67,7 @@ type SortConfig struct {
 	Workers   uint `json:"workers"`
 	MaxMemory uint `json:"max_memory"`
 	NoCleanup bool `json:"no_cleanup"`
+	Dedupe    bool `json:"dedupe"`
 }
 
 // AutoConfig - A complete config for the auto command
@@ -66,9 +76,10 @@ type AutoConfig struct {
 	Index *IndexConfig `json:"index"`
 	Sort  *SortConfig  `json:"sort"`
 
-	Input     string `json:"input_dir"`
-	OutputDir string `json:"output_dir"`
-	TempDir   string `json:"temp_dir"`
+	Input     string           `json:"input_dir"`
+	Targets   *targets.Options `json:"targets"`
+	OutputDir string           `json:"output_dir"`
+	TempDir   string           `json:"temp_dir"`
 }
 
 func autoParseFlags(cmd *cobra.Command, args []string) {
@@ -120,8 +131,9 @@ func autoParseFlags(cmd *cobra.Command, args []string) {
 	}
 	autoConf.Index.Keys = []string{}
 	for _, key := range keys {
-		if key != "email" && key != "user" && key != "domain" {
-			fmt.Printf(Warn+"Invalid index key '%s'\n", key)
+		key, err = indexfile.CanonicalKey(key)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
 			return
 		}
 		if key == "domain" {
@@ -135,6 +147,20 @@ func autoParseFlags(cmd *cobra.Command, args []string) {
 		fmt.Printf(Warn+"No valid index keys, specify at least one key with --%s\n", keysFlagStr)
 		return
 	}
+	autoConf.Index.DigestBits, err = cmd.Flags().GetUint(digestBitsFlagStr)
+	if err != nil {
+		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", digestBitsFlagStr, err)
+		return
+	}
+	if !validDigestBits(autoConf.Index.DigestBits) {
+		fmt.Printf(Warn+"Error --%s must be one of: 48, 64, or 96\n", digestBitsFlagStr)
+		return
+	}
+	autoConf.Index.PublicSuffixList, err = cmd.Flags().GetString(publicSuffixListFlagStr)
+	if err != nil {
+		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", publicSuffixListFlagStr, err)
+		return
+	}
 
 	// Bloom Filter Options
 	autoConf.Bloom.FilterSize, err = cmd.Flags().GetUint(filterSizeFlagStr)
@@ -157,6 +183,16 @@ func autoParseFlags(cmd *cobra.Command, args []string) {
 		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", filterSaveFlagStr, err)
 		return
 	}
+	autoConf.Bloom.FilterType, err = cmd.Flags().GetString(filterTypeFlagStr)
+	if err != nil {
+		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", filterTypeFlagStr, err)
+		return
+	}
+	autoConf.Bloom.FilterRemove, err = cmd.Flags().GetString(filterRemoveFlagStr)
+	if err != nil {
+		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", filterRemoveFlagStr, err)
+		return
+	}
 
 	// Memory/goroutines
 	autoConf.Sort.MaxMemory, err = cmd.Flags().GetUint(maxMemoryFlagStr)
@@ -167,6 +203,11 @@ func autoParseFlags(cmd *cobra.Command, args []string) {
 	if autoConf.Sort.MaxMemory < 1 {
 		autoConf.Sort.MaxMemory = 1
 	}
+	autoConf.Sort.Dedupe, err = cmd.Flags().GetBool(dedupeFlagStr)
+	if err != nil {
+		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", dedupeFlagStr, err)
+		return
+	}
 
 	// Target input/output
 	autoConf.Input, err = cmd.Flags().GetString(jsonFlagStr) // Dir or file of normalized json
@@ -174,6 +215,11 @@ func autoParseFlags(cmd *cobra.Command, args []string) {
 		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", jsonFlagStr, err)
 		return
 	}
+	autoConf.Targets, err = parseTargetFlags(cmd)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
 	autoConf.OutputDir, err = cmd.Flags().GetString(outputFlagStr) // Output dir of indexes
 	if err != nil {
 		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", outputFlagStr, err)
@@ -217,6 +263,7 @@ func autoParseFlags(cmd *cobra.Command, args []string) {
 func defaultConf(generate string) error {
 	conf := &AutoConfig{
 		Input:     "",
+		Targets:   &targets.Options{Symlinks: targets.SymlinkFiles},
 		OutputDir: "",
 		TempDir:   "",
 		Bloom: &BloomConfig{
@@ -225,12 +272,15 @@ func defaultConf(generate string) error {
 			Workers:      1,
 			FilterLoad:   "",
 			FilterSave:   "",
+			FilterType:   bloomer.FilterBloom,
+			FilterRemove: "",
 			Output:       "bloomed.json",
 		},
 		Index: &IndexConfig{
-			Workers:   2,
-			Keys:      []string{"email", "user", "domain"},
-			NoCleanup: false,
+			Workers:    2,
+			Keys:       []string{"email", "user", "domain"},
+			DigestBits: defaultDigestBits,
+			NoCleanup:  false,
 		},
 		Sort: &SortConfig{
 			Workers:   uint(runtime.NumCPU()),
@@ -254,6 +304,13 @@ func auto(conf *AutoConfig) error {
 		return fmt.Errorf("Input error %s %s", conf.Input, err)
 	}
 
+	for index, key := range conf.Index.Keys {
+		conf.Index.Keys[index], err = indexfile.CanonicalKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
 	// *** Bloom ***
 	bloomed, err := bloomStage(conf)
 	if err != nil {
@@ -284,11 +341,17 @@ func bloomStage(conf *AutoConfig) (string, error) {
 	if output == "" {
 		output = filepath.Join(conf.OutputDir, "bloomed.json")
 	}
-	bloom, err := bloomer.GetBloomer(conf.Input, output, conf.Bloom.Append, conf.Bloom.FilterSave,
-		conf.Bloom.FilterLoad, conf.Bloom.Workers, conf.Bloom.FilterSize, conf.Bloom.FilterHashes)
+	bloom, err := bloomer.GetBloomer(conf.Input, conf.Targets, output, conf.Bloom.Append, conf.Bloom.FilterSave,
+		conf.Bloom.FilterLoad, conf.Bloom.FilterType, conf.Bloom.Workers, conf.Bloom.FilterSize, conf.Bloom.FilterHashes)
 	if err != nil {
 		return "", err
 	}
+	if conf.Bloom.FilterRemove != "" {
+		_, err = bloom.Remove(conf.Bloom.FilterRemove)
+		if err != nil {
+			return "", err
+		}
+	}
 
 	// Progress animation
 	done := make(chan bool)
@@ -296,10 +359,18 @@ func bloomStage(conf *AutoConfig) (string, error) {
 	err = bloom.Start()
 	done <- true
 	<-done
-	if err != nil {
-		return "", err
+	if _, ok := err.(*bloomer.TargetsError); err != nil && !ok {
+		return "", err // The output or filter is incomplete
 	}
 	fmt.Printf("\u001b[u done!  (%s)\n", time.Now().Sub(stageStarted))
+
+	// Unreadable targets are skipped, the output is still valid for the rest
+	if len(bloom.Errors) != 0 {
+		fmt.Printf(Warn+"%d errors occurred:\n", len(bloom.Errors))
+		for index, err := range bloom.Errors {
+			fmt.Printf("\t%d) %s\n", index, err)
+		}
+	}
 	return output, nil
 }
 
@@ -333,32 +404,58 @@ func bloomProgress(bloom *bloomer.Bloom, done chan bool) {
 
 func indexStage(bloomOutput string, conf *AutoConfig) ([]string, error) {
 	stageStarted := time.Now()
-	indexes := []string{}
 	indexTmpDir := filepath.Join(conf.TempDir, "indexer")
-	for _, key := range conf.Index.Keys {
-		fmt.Printf("\r\u001b[2K\rComputing %s index ...\u001b[s", key)
-		output := path.Join(conf.TempDir, fmt.Sprintf("%s.idx", key))
-		indexes = append(indexes, output)
-		index, err := indexer.GetIndexer(bloomOutput, output, key, conf.Index.Workers, indexTmpDir, conf.Index.NoCleanup)
-		if err != nil {
-			return nil, err
-		}
-
-		done := make(chan bool)
-		go indexProgress(index, done)
-		err = index.Start()
-		done <- true
-		<-done
+	suffixes := publicsuffix.Default()
+	if conf.Index.PublicSuffixList != "" {
+		var err error
+		suffixes, err = publicsuffix.Load(conf.Index.PublicSuffixList)
 		if err != nil {
 			return nil, err
 		}
+	}
+	// The index of each key is created in one pass over the bloomed json
+	outputs := []string{}
+	for _, key := range conf.Index.Keys {
+		outputs = append(outputs, path.Join(conf.TempDir, fmt.Sprintf("%s.idx", key)))
+	}
+	fmt.Printf("\r\u001b[2K\rComputing %s index(es) ...\u001b[s", strings.Join(conf.Index.Keys, ", "))
+	index, err := indexer.GetMultiIndexer(bloomOutput, outputs, conf.Index.Keys, int(conf.Index.DigestBits/8), conf.Index.Workers, indexTmpDir, conf.Index.NoCleanup)
+	if err != nil {
+		return nil, err
+	}
+	index.Suffixes = suffixes
 
-		fmt.Printf("\u001b[u done!  (%s)\n", time.Now().Sub(stageStarted))
+	done := make(chan bool)
+	go indexProgress(index, done)
+	err = index.Start()
+	done <- true
+	<-done
+	if err != nil {
+		return nil, err
 	}
+	fmt.Printf("\u001b[u done!  (%s)\n", time.Now().Sub(stageStarted))
+	printMalformed(index)
+
 	if !conf.Index.NoCleanup {
 		os.RemoveAll(indexTmpDir)
 	}
-	return indexes, nil
+	return outputs, nil
+}
+
+// printMalformed - Display the malformed lines skipped by an indexer
+func printMalformed(index *indexer.Indexer) {
+	count, offsets := index.Malformed()
+	if count == 0 {
+		return
+	}
+	locations := []string{}
+	for _, offset := range offsets {
+		locations = append(locations, fmt.Sprintf("%d", offset))
+	}
+	if len(offsets) < count {
+		locations = append(locations, "...")
+	}
+	fmt.Printf(Warn+"Skipped %d malformed line(s) at offset(s) %s\n", count, strings.Join(locations, ", "))
 }
 
 func indexProgress(index *indexer.Indexer, done chan bool) {
@@ -380,27 +477,98 @@ func indexProgress(index *indexer.Indexer, done chan bool) {
 	}
 }
 
+// sortStage - Sort the indexes concurrently, the memory budget and workers
+// are divided between the sorts
 func sortStage(indexes []string, conf *AutoConfig) error {
+	sortStarted := time.Now()
 	sortTmpDir := filepath.Join(conf.TempDir, "sorter")
+	workers := int(conf.Sort.Workers) / len(indexes)
+	if workers < 1 {
+		workers = 1
+	}
+	names := []string{}
+	sorts := []*sorter.Sorter{}
 	for _, index := range indexes {
-		sortStarted := time.Now()
-		fmt.Printf("\r\u001b[2K\rSorting %s ...\u001b[s", path.Base(index))
+		names = append(names, path.Base(index))
 		output := path.Join(conf.OutputDir, path.Base(index))
-		sort, err := sorter.GetSorter(index, output, int(conf.Sort.Workers), int(conf.Sort.MaxMemory), sortTmpDir, conf.Sort.NoCleanup)
+		tempDir := filepath.Join(sortTmpDir, path.Base(index)) // Each sort removes its own tapes
+		sort, err := sorter.GetSorter(index, output, workers, int(conf.Sort.MaxMemory), tempDir, conf.Sort.NoCleanup)
 		if err != nil {
 			return err
 		}
-		done := make(chan bool)
-		go sortProgress(sort, done)
-		sort.Start()
-		done <- true
-		<-done
-		fmt.Printf("\u001b[u done!  (%s)\n", time.Now().Sub(sortStarted))
+		sort.MaxMemory = int(conf.Sort.MaxMemory) * sorter.Mb / len(indexes)
+		sort.Dedupe = conf.Sort.Dedupe
+		sorts = append(sorts, sort)
 	}
+
+	fmt.Printf("\r\u001b[2K\rSorting %s ...\u001b[s", strings.Join(names, ", "))
+	done := make(chan bool)
+	go sortProgress(sorts, done)
+	errs := make(chan error, len(sorts))
+	for _, sort := range sorts {
+		go func(sort *sorter.Sorter) {
+			errs <- sort.Start()
+		}(sort)
+	}
+	var err error
+	for range sorts {
+		if sortErr := <-errs; sortErr != nil && err == nil {
+			err = sortErr
+		}
+	}
+	done <- true
+	<-done
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\u001b[u done!  (%s)\n", time.Now().Sub(sortStarted))
+	for _, sort := range sorts {
+		fmt.Printf(Info+"%s\n", path.Base(sort.OutputPath))
+		printStats(sort.Stats)
+	}
+	printMemory(totalMemory(sorts))
 	return nil
 }
 
-func sortProgress(sort *sorter.Sorter, done chan bool) {
+// printStats - Display the stats of a sorted index
+func printStats(stats *indexfile.Stats) {
+	if stats == nil {
+		return
+	}
+	fmt.Printf(Info+"%d entries, %d distinct digests, largest run %d (%s)\n",
+		stats.Entries, stats.DistinctDigests, stats.LargestRun, stats.LargestRunDigest)
+	if 0 < stats.Duplicates {
+		fmt.Printf(Info+"Removed %d duplicate entries\n", stats.Duplicates)
+	}
+}
+
+func printMemory(memory sorter.Memory) {
+	fmt.Printf(Info+"Peak memory %0.1fMb of %0.1fMb budget (heap %0.1fMb)\n",
+		float64(memory.Peak)/float64(mb), float64(memory.Budget)/float64(mb), float64(memory.PeakHeap)/float64(mb))
+}
+
+// totalMemory - Memory of concurrent sorts, the peak is the sum of the
+// peaks of each sort so it is an upper bound
+func totalMemory(sorts []*sorter.Sorter) sorter.Memory {
+	total := sorter.Memory{}
+	for _, sort := range sorts {
+		memory := sort.Memory()
+		total.Budget += memory.Budget
+		total.InUse += memory.InUse
+		total.Peak += memory.Peak
+		if total.PeakHeap < memory.PeakHeap {
+			total.PeakHeap = memory.PeakHeap // One process, the heap is shared
+		}
+	}
+	return total
+}
+
+func gbOf(size int64) float64 {
+	return float64(size) / float64(gb)
+}
+
+// sortProgress - Display the progress of one or more concurrent sorts
+func sortProgress(sorts []*sorter.Sorter, done chan bool) {
 	spin := 0
 	frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
 	stdout := bufio.NewWriter(os.Stdout)
@@ -409,17 +577,21 @@ func sortProgress(sort *sorter.Sorter, done chan bool) {
 	elapsed := time.Now().Sub(started)
 	maxHeap := float64(0)
 	fmt.Println()
-	fmt.Println()
+	for range sorts {
+		fmt.Println()
+	}
 	for {
 		select {
 		case <-done:
 			fmt.Printf("\u001b[2K\r")
-			fmt.Printf("\u001b[1A\r")
-			fmt.Printf("\u001b[2K\r")
+			for range sorts {
+				fmt.Printf("\u001b[1A\r")
+				fmt.Printf("\u001b[2K\r")
+			}
 			done <- true
 			return
 		case <-time.After(250 * time.Millisecond):
-			fmt.Printf("\u001b[1A") // Move up one
+			fmt.Printf("\u001b[%dA", len(sorts)) // Move up to the first line
 			runtime.ReadMemStats(stats)
 			if spin%10 == 0 {
 				// Calculating time is kind of expensive, so update once per ~second
@@ -429,17 +601,20 @@ func sortProgress(sort *sorter.Sorter, done chan bool) {
 			if maxHeap < heapAllocGb {
 				maxHeap = heapAllocGb
 			}
-			fmt.Printf("\u001b[2K\rGo routines: %d - Heap: %0.3fGb (Max: %0.3fGb) - Time: %v\n",
-				runtime.NumGoroutine(), heapAllocGb, maxHeap, elapsed)
-			status := sort.Status
-			if status == sorter.StatusMerging {
-				status = fmt.Sprintf("%s (%.1f%%)", status, sort.MergePercent)
-				fmt.Printf("\u001b[2K\r %s %s ... ", frames[spin%10], status)
-			} else if status == sorter.StatusSorting {
-				status = fmt.Sprintf("%s, completed %d of %d tape(s)", status, sort.TapesCompleted(), sort.NumberOfTapes)
-				fmt.Printf("\u001b[2K\r %s %s ... ", frames[spin%10], status)
-			} else {
-				fmt.Printf("\u001b[2K\r %s %s ... ", frames[spin%10], status)
+			memory := totalMemory(sorts)
+			fmt.Printf("\u001b[2K\rGo routines: %d - Heap: %0.3fGb (Max: %0.3fGb) - Buffers: %0.3fGb of %0.3fGb (Max: %0.3fGb) - Time: %v",
+				runtime.NumGoroutine(), heapAllocGb, maxHeap, gbOf(memory.InUse), gbOf(memory.Budget), gbOf(memory.Peak), elapsed)
+			for _, sort := range sorts {
+				status := sort.Status
+				if status == sorter.StatusMerging {
+					status = fmt.Sprintf("%s (%.1f%%, %.1f MB/s)", status, sort.MergePercent, sort.MergeThroughput())
+				} else if status == sorter.StatusSorting {
+					status = fmt.Sprintf("%s, completed %d of %d tape(s)", status, sort.TapesCompleted(), sort.NumberOfTapes)
+				}
+				if 1 < len(sorts) {
+					status = fmt.Sprintf("%s: %s", path.Base(sort.OutputPath), status)
+				}
+				fmt.Printf("\n\u001b[2K\r %s %s ... ", frames[spin%10], status)
 			}
 			spin++
 			stdout.Flush()
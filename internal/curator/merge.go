@@ -0,0 +1,121 @@
+package curator
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/sorter"
+	"github.com/spf13/cobra"
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge",
+	Short: "Merge sorted index files",
+	Long: `Merge sorted indexes of the same key into one sorted index without re-sorting.
+
+The indexes must be sharded indexes of a dataset (see index --manifest). Indexes
+that are not sharded are rebased onto their shard of the --manifest, add their
+json files to the manifest with --json if they are not already in it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		inputs, err := cmd.Flags().GetStringSlice(indexFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", indexFlagStr, err)
+			return
+		}
+		if len(inputs) == 0 {
+			fmt.Printf(Warn+"Missing --%s flag\n", indexFlagStr)
+			return
+		}
+		output, err := cmd.Flags().GetString(outputFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", outputFlagStr, err)
+			return
+		}
+		manifestPath, err := cmd.Flags().GetString(manifestFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", manifestFlagStr, err)
+			return
+		}
+		targets, err := cmd.Flags().GetStringSlice(jsonFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", jsonFlagStr, err)
+			return
+		}
+		dedupe, err := cmd.Flags().GetBool(dedupeFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", dedupeFlagStr, err)
+			return
+		}
+
+		options := &sorter.MergeOptions{Dedupe: dedupe}
+		if manifestPath != "" {
+			options.Manifest, err = addShards(manifestPath, targets)
+			if err != nil {
+				fmt.Printf(Warn+"%s\n", err)
+				return
+			}
+		} else if 0 < len(targets) {
+			fmt.Printf(Warn+"The --%s flag requires --%s\n", jsonFlagStr, manifestFlagStr)
+			return
+		}
+
+		started := time.Now()
+		err = sorter.MergeWith(inputs, output, options)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		if options.Manifest != nil && 0 < len(targets) {
+			err = options.Manifest.WriteFile(manifestPath)
+			if err != nil {
+				fmt.Printf(Warn+"%s\n", err)
+				return
+			}
+		}
+		fmt.Printf("Merged %d index(es) in %s\n", len(inputs), time.Now().Sub(started))
+		id, err := indexfile.ReadIndexID(output)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		stats, err := indexfile.ReadStatsFile(indexfile.StatsPath(output), id)
+		if err == nil {
+			printStats(stats)
+		}
+	},
+}
+
+// addShards - Add json files to the manifest loaded from manifestPath, the
+// caller writes it back once the merged index exists
+func addShards(manifestPath string, targets []string) (*indexfile.Manifest, error) {
+	manifest, err := loadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		shard, err := manifest.Add(target)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("%s is shard %d of %s\n", target, shard.ID, manifestPath)
+	}
+	return manifest, nil
+}
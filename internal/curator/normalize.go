@@ -40,19 +40,9 @@ var normalizeCmd = &cobra.Command{
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", outputFlagStr, err)
 			return
 		}
-		skipPrefix, err := cmd.Flags().GetString(skipPrefixFlagStr)
+		options, err := parseTargetFlags(cmd)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", skipPrefixFlagStr, err)
-			return
-		}
-		skipSuffix, err := cmd.Flags().GetString(skipSuffixFlagStr)
-		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", skipSuffixFlagStr, err)
-			return
-		}
-		recursive, err := cmd.Flags().GetBool(recursiveFlagStr)
-		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", recursiveFlagStr, err)
+			fmt.Printf(Warn+"%s\n", err)
 			return
 		}
 
@@ -68,7 +58,7 @@ var normalizeCmd = &cobra.Command{
 			return
 		}
 
-		normalize, err := normalizer.GetNormalizer(format, target, output, recursive, skipPrefix, skipSuffix)
+		normalize, err := normalizer.GetNormalizer(format, target, options, output)
 		if err != nil {
 			fmt.Printf(Warn+"%s\n", err)
 			return
@@ -18,10 +18,15 @@ package curator
 */
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/moloch--/leakdb/pkg/indexfile"
 	"github.com/moloch--/leakdb/pkg/searcher"
 	"github.com/spf13/cobra"
 )
@@ -46,16 +51,77 @@ var searchCmd = &cobra.Command{
 			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", valueFlagStr, err)
 			return
 		}
-		if value == "" {
-			fmt.Printf(Warn+"Must specify --%s\n", valueFlagStr)
+		valuesFile, err := cmd.Flags().GetString(valuesFileFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", valuesFileFlagStr, err)
+			return
+		}
+		if value == "" && valuesFile == "" {
+			fmt.Printf(Warn+"Must specify --%s or --%s\n", valueFlagStr, valuesFileFlagStr)
 			return
 		}
 
-		credentials, err := searcher.Start(value, target, index)
+		key, err := cmd.Flags().GetString(keyFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", keyFlagStr, err)
+			return
+		}
+		verbose, err := cmd.Flags().GetBool(verboseFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", verboseFlagStr, err)
+			return
+		}
+		prefix, err := cmd.Flags().GetBool(prefixFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", prefixFlagStr, err)
+			return
+		}
+		count, err := cmd.Flags().GetBool(countFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", countFlagStr, err)
+			return
+		}
+		if prefix {
+			if value == "" {
+				fmt.Printf(Warn+"--%s requires --%s\n", prefixFlagStr, valueFlagStr)
+				return
+			}
+			prefixSearch(value, key, target, index)
+			return
+		}
+
+		if count {
+			if value == "" {
+				fmt.Printf(Warn+"--%s requires --%s\n", countFlagStr, valueFlagStr)
+				return
+			}
+			countSearch(value, key, target, index)
+			return
+		}
+		if valuesFile != "" {
+			batchSearch(valuesFile, key, target, index, verbose)
+			return
+		}
+
+		value, err = compositeValue(key, value)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		idx, err := searcher.Open(target, index, key, nil)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		defer idx.Close()
+		credentials, err := idx.Find(value)
 		if err != nil {
 			fmt.Printf(Warn+"%s\n", err)
 			return
 		}
+		if verbose {
+			fmt.Printf(Debug+"Discarded %d false digest match(es)\n", idx.FalseMatches())
+		}
 		fmt.Printf("Found %d results ...\n", len(credentials))
 		if 0 < len(credentials) {
 			// displayCredentials(credentials)
@@ -66,6 +132,146 @@ var searchCmd = &cobra.Command{
 	},
 }
 
+// batchSearch - Search for every value in valuesFile with a single pass
+func batchSearch(valuesFile string, key string, target string, index string, verbose bool) {
+	values, err := readValues(valuesFile)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	queries := map[string]string{}
+	for index, value := range values {
+		values[index], err = compositeValue(key, value)
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		queries[values[index]] = value
+	}
+	idx, err := searcher.Open(target, index, key, nil)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	defer idx.Close()
+	started := time.Now()
+	results, err := idx.FindAll(values)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	if verbose {
+		fmt.Printf(Debug+"Searched %d value(s) in %s\n", len(results), time.Now().Sub(started))
+		fmt.Printf(Debug+"Discarded %d false digest match(es)\n", idx.FalseMatches())
+	}
+	total := len(results)
+	found := 0
+	for _, value := range values {
+		credentials, ok := results[value]
+		if !ok || len(credentials) == 0 {
+			continue
+		}
+		delete(results, value) // Only display duplicate values once
+		found++
+		fmt.Printf("Found %d results for %s ...\n", len(credentials), queries[value])
+		for _, cred := range credentials {
+			fmt.Printf("%v\n", cred)
+		}
+	}
+	fmt.Printf("Found results for %d of %d value(s)\n", found, total)
+}
+
+// countSearch - Count the entries matching value, large runs are counted
+// from the runs sidecar without reading the index
+func countSearch(value string, key string, target string, index string) {
+	value, err := compositeValue(key, value)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	idx, err := searcher.Open(target, index, key, nil)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	defer idx.Close()
+	count, err := idx.Count(value)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	fmt.Printf("Found %d matching entries\n", count)
+}
+
+// prefixSearch - Search an ordered index for values matching a prefix or
+// wildcard pattern
+func prefixSearch(pattern string, key string, target string, index string) {
+	idx, err := searcher.Open(target, index, key, nil)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	defer idx.Close()
+	cursor, err := idx.PrefixCursor(pattern)
+	if err != nil {
+		fmt.Printf(Warn+"%s\n", err)
+		return
+	}
+	found := 0
+	for {
+		cred, err := cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
+		fmt.Printf("%v\n", cred)
+		found++
+	}
+	fmt.Printf("Found %d results ...\n", found)
+}
+
+// compositeValue - Values of composite keys are given as the fields of the
+// key in canonical order separated by ':', e.g. "user@example.com:password".
+// The last field may contain ':' so passwords do not need to be escaped.
+func compositeValue(key string, value string) (string, error) {
+	if key == "" {
+		return value, nil
+	}
+	fields, err := indexfile.ParseKey(key)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) == 1 {
+		return value, nil
+	}
+	values := strings.SplitN(value, ":", len(fields))
+	if len(values) != len(fields) {
+		return "", fmt.Errorf("Value of a '%s' key must be %s", key, strings.Join(fields, ":"))
+	}
+	return indexfile.JoinValues(values), nil
+}
+
+// readValues - Non-blank lines of a file
+func readValues(valuesFile string) ([]string, error) {
+	file, err := os.Open(valuesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value := strings.TrimSpace(scanner.Text())
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values, scanner.Err()
+}
+
 func displayCredentials(credentials []*searcher.Credential) {
 	table := new(tabwriter.Writer)
 	table.Init(os.Stdout, 1, 4, 2, ' ', 0)
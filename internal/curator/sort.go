@@ -34,7 +34,13 @@ const (
 var sortCmd = &cobra.Command{
 	Use:   "sort",
 	Short: "Sort an index file",
-	Long:  ``,
+	Long: `Sort an index file with an external merge sort.
+
+The index is split into tapes that are sorted in memory and merged. --max-memory
+is the budget of the sort's buffers: a buffer per worker, plus one, holds a tape
+and each worker has a scratch buffer of the same size, so tapes are about
+max-memory / (2 * workers + 1). Merging uses a read buffer per tape and a write
+buffer of at least 4Kb each. The peak memory is shown once the sort completes.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		index, err := cmd.Flags().GetString(indexFlagStr)
 		if err != nil {
@@ -88,18 +94,31 @@ var sortCmd = &cobra.Command{
 			defer os.RemoveAll(tempDir)
 		}
 
+		dedupe, err := cmd.Flags().GetBool(dedupeFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", dedupeFlagStr, err)
+			return
+		}
+
 		sort, err := sorter.GetSorter(index, output, int(workers), int(maxMemory), tempDir, noCleanup)
 		if err != nil {
 			fmt.Printf(Warn+"%s\n", err)
 			return
 		}
+		sort.Dedupe = dedupe
 
 		done := make(chan bool)
-		go sortProgress(sort, done)
+		go sortProgress([]*sorter.Sorter{sort}, done)
 		started := time.Now()
-		sort.Start()
+		err = sort.Start()
 		done <- true
 		<-done
+		if err != nil {
+			fmt.Printf(Warn+"%s\n", err)
+			return
+		}
 		fmt.Printf("Completed in %s\n", time.Now().Sub(started))
+		printStats(sort.Stats)
+		printMemory(sort.Memory())
 	},
 }
@@ -0,0 +1,74 @@
+package curator
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"fmt"
+
+	"github.com/moloch--/leakdb/pkg/targets"
+	"github.com/spf13/cobra"
+)
+
+// addTargetFlags - Register the target selection flags shared by commands
+// that read a directory of files, --recursive and --skip-* are registered by
+// each command since the shorthands differ
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice(includeFlagStr, []string{}, "only include files matching glob(s)")
+	cmd.Flags().StringSlice(excludeFlagStr, []string{}, "exclude files matching glob(s)")
+	cmd.Flags().Int64(minSizeFlagStr, 0, "skip files smaller than size in bytes")
+	cmd.Flags().Int64(maxSizeFlagStr, 0, "skip files larger than size in bytes (default: no limit)")
+	cmd.Flags().String(symlinksFlagStr, targets.SymlinkFiles, "symlink policy: skip, files, or follow")
+}
+
+func parseTargetFlags(cmd *cobra.Command) (*targets.Options, error) {
+	var err error
+	options := &targets.Options{}
+	options.Recursive, err = cmd.Flags().GetBool(recursiveFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", recursiveFlagStr, err)
+	}
+	options.SkipPrefix, err = cmd.Flags().GetString(skipPrefixFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", skipPrefixFlagStr, err)
+	}
+	options.SkipSuffix, err = cmd.Flags().GetString(skipSuffixFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", skipSuffixFlagStr, err)
+	}
+	options.Include, err = cmd.Flags().GetStringSlice(includeFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", includeFlagStr, err)
+	}
+	options.Exclude, err = cmd.Flags().GetStringSlice(excludeFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", excludeFlagStr, err)
+	}
+	options.MinSize, err = cmd.Flags().GetInt64(minSizeFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", minSizeFlagStr, err)
+	}
+	options.MaxSize, err = cmd.Flags().GetInt64(maxSizeFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", maxSizeFlagStr, err)
+	}
+	options.Symlinks, err = cmd.Flags().GetString(symlinksFlagStr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse --%s flag: %s", symlinksFlagStr, err)
+	}
+	return options, nil
+}
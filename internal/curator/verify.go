@@ -0,0 +1,83 @@
+package curator
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/moloch--/leakdb/pkg/searcher"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify a sorted index file",
+	Long: `Verify a sorted index against its json file, or the dataset manifest of a sharded index.
+
+Checks that the index is a whole number of entries, that entries are sorted, that
+every offset is the start of a line, and that a sample of digests match the
+re-hashed key of their line. The report is written to stdout as JSON and the exit
+status is non-zero if any check fails.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		index, err := cmd.Flags().GetString(indexFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", indexFlagStr, err)
+			os.Exit(2)
+		}
+		target, err := cmd.Flags().GetString(jsonFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", jsonFlagStr, err)
+			os.Exit(2)
+		}
+		if index == "" || target == "" {
+			fmt.Printf(Warn+"Missing --%s or --%s flag\n", indexFlagStr, jsonFlagStr)
+			os.Exit(2)
+		}
+		key, err := cmd.Flags().GetString(keyFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", keyFlagStr, err)
+			os.Exit(2)
+		}
+		sample, err := cmd.Flags().GetInt(sampleFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", sampleFlagStr, err)
+			os.Exit(2)
+		}
+		mmap, err := cmd.Flags().GetBool(mmapFlagStr)
+		if err != nil {
+			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", mmapFlagStr, err)
+			os.Exit(2)
+		}
+
+		report := searcher.Verify(target, index, key, &searcher.VerifyOptions{
+			Sample: sample,
+			Mmap:   mmap,
+		})
+		err = report.WriteJSON(os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, Warn+"%s\n", err)
+			os.Exit(2)
+		}
+		if !report.OK {
+			fmt.Fprintf(os.Stderr, Warn+"Verification failed: %s\n", strings.Join(report.Failed(), ", "))
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,99 @@
+package testutil
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Helpers shared by the tests of several packages, nothing here is used
+	outside of tests.
+*/
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/moloch--/leakdb/pkg/filesystem"
+)
+
+var (
+	// ErrNoSpace - Write failure injected by Faulty
+	ErrNoSpace = errors.New("No space left on device (injected)")
+)
+
+// Faulty - A file system that fails writes to the files Match selects once
+// Limit bytes have been written to them in total, e.g. to simulate a full
+// disk. Everything else is passed through to FS.
+type Faulty struct {
+	FS    filesystem.FS
+	Match func(name string) bool
+	Limit int64
+
+	mutex   sync.Mutex
+	written int64
+}
+
+// Create - Create a file, writes fail once the limit is reached
+func (f *Faulty) Create(name string) (filesystem.File, error) {
+	file, err := f.FS.Create(name)
+	if err != nil || !f.Match(name) {
+		return file, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+// Open - Open a file
+func (f *Faulty) Open(name string) (filesystem.File, error) {
+	return f.FS.Open(name)
+}
+
+// Remove - Remove a file
+func (f *Faulty) Remove(name string) error {
+	return f.FS.Remove(name)
+}
+
+// RemoveAll - Remove a path and any children
+func (f *Faulty) RemoveAll(path string) error {
+	return f.FS.RemoveAll(path)
+}
+
+// MkdirAll - Create a directory and any parents
+func (f *Faulty) MkdirAll(path string, perm os.FileMode) error {
+	return f.FS.MkdirAll(path, perm)
+}
+
+type faultyFile struct {
+	filesystem.File
+	fs *Faulty
+}
+
+func (f *faultyFile) Write(buf []byte) (int, error) {
+	f.fs.mutex.Lock()
+	allowed := f.fs.Limit - f.fs.written
+	if allowed < 0 {
+		allowed = 0
+	}
+	if int64(len(buf)) < allowed {
+		allowed = int64(len(buf))
+	}
+	f.fs.written += allowed
+	f.fs.mutex.Unlock()
+
+	n, err := f.File.Write(buf[:allowed])
+	if err == nil && n < len(buf) {
+		err = ErrNoSpace
+	}
+	return n, err
+}
@@ -21,13 +21,12 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
-	"github.com/willf/bloom"
+	"github.com/moloch--/leakdb/pkg/targets"
 )
 
 const (
@@ -40,13 +39,32 @@ const (
 
 // Bloom - Tracks a single bloom job
 type Bloom struct {
-	outputFile  *os.File
-	workers     []*Worker
-	bloomFilter *bloom.BloomFilter
-	targets     []string
-	queue       chan string
-	save        string
-	wg          *sync.WaitGroup
+	output       string
+	appendOutput bool
+	workers      []*Worker
+	bloomFilter  Filter
+	targets      []string
+	queue        chan *Line
+	save         string
+	wg           *sync.WaitGroup
+
+	Report []*TargetReport
+	Errors []error
+}
+
+// Line - A single line and the report of the target it was read from
+type Line struct {
+	Raw    string
+	Report *TargetReport
+}
+
+// TargetReport - Per-target line counts, counters are updated atomically
+type TargetReport struct {
+	Target     string
+	Lines      int64
+	Uniques    int64
+	Duplicates int64
+	Err        error
 }
 
 // Progress - Returns items bloomed and number of duplicates
@@ -60,27 +78,46 @@ func (b *Bloom) Progress() (int, int) {
 	return count, duplicates
 }
 
-// Start - Start the bloom filter workers
+// Start - Create the output and start the bloom filter workers
 func (b *Bloom) Start() error {
 
-	defer b.outputFile.Close()
+	outputFile, err := openOutput(b.output, b.appendOutput)
+	if err != nil {
+		return err
+	}
+	for _, worker := range b.workers {
+		worker.Output = outputFile
+	}
 
-	lines := make(chan string, lineBufferSize)
-	go lineQueue(b.targets, lines)
+	b.Report = newReports(b.targets)
+	lines := make(chan *Line, lineBufferSize)
+	go lineQueue(b.Report, lines)
 
 	for _, worker := range b.workers {
 		worker.start()
 	}
 
 	for line := range lines {
-		line = strings.TrimSpace(line)
-		if 0 < len(line) {
-			b.queue <- line
-		}
+		b.queue <- line
 	}
 	for _, worker := range b.workers {
 		worker.Quit <- true
 	}
+	b.wg.Wait()
+	for _, report := range b.Report {
+		if report.Err != nil {
+			b.Errors = append(b.Errors, report.Err)
+		}
+	}
+	err = outputFile.Close()
+	for _, worker := range b.workers {
+		if worker.Err != nil {
+			return worker.Err
+		}
+	}
+	if err != nil {
+		return err
+	}
 
 	// Optionally save bloom filter
 	if 0 < len(b.save) {
@@ -88,44 +125,54 @@ func (b *Bloom) Start() error {
 		if err != nil {
 			return err
 		}
-		defer saveFile.Close()
-		b.bloomFilter.WriteTo(saveFile)
+		_, err = b.bloomFilter.WriteTo(saveFile)
+		if err != nil {
+			saveFile.Close()
+			return err
+		}
+		err = saveFile.Close()
+		if err != nil {
+			return err
+		}
 	}
-
-	b.wg.Wait()
-	return nil
+	return reportErrors(b.Report)
 }
 
 // Worker - Worker thread
 type Worker struct {
 	ID              int
-	Queue           <-chan string
+	Queue           <-chan *Line
 	Quit            chan bool
-	Bloom           *bloom.BloomFilter
+	Bloom           Filter
 	BloomMutex      *sync.RWMutex
 	Wg              *sync.WaitGroup
 	OutputMutex     *sync.Mutex
 	Output          *os.File
 	Count           int
 	CountDuplicates int
+	Err             error // The first output write error, if any
 }
 
 func (w *Worker) start() {
+	w.Wg.Add(1)
 	go func() {
-		w.Wg.Add(1)
 		for {
 			select {
 			case line := <-w.Queue:
 				w.Count++
 				w.BloomMutex.Lock()
-				exists := w.Bloom.TestAndAddString(line)
+				exists := w.Bloom.TestAndAdd([]byte(line.Raw))
 				w.BloomMutex.Unlock()
 				if !exists {
 					w.OutputMutex.Lock()
-					w.Output.WriteString(fmt.Sprintf("%s\n", line))
+					if w.Err == nil {
+						_, w.Err = w.Output.WriteString(line.Raw + "\n")
+					}
 					w.OutputMutex.Unlock()
+					atomic.AddInt64(&line.Report.Uniques, 1)
 				} else {
 					w.CountDuplicates++
+					atomic.AddInt64(&line.Report.Duplicates, 1)
 				}
 			case <-w.Quit:
 				w.Wg.Done()
@@ -135,13 +182,37 @@ func (w *Worker) start() {
 	}()
 }
 
+// Remove - Delete every line in target from the filter, this must be done
+// before Start and requires a filter type that supports deletes
+func (b *Bloom) Remove(target string) (int, error) {
+	files, err := targets.Find(target, nil)
+	if err != nil {
+		return 0, err
+	}
+	reports := newReports(files)
+	lines := make(chan *Line, lineBufferSize)
+	go lineQueue(reports, lines)
+	count := 0
+	for line := range lines {
+		err = b.bloomFilter.Delete([]byte(line.Raw))
+		if err != nil {
+			for range lines {
+				// Drain the queue so lineQueue can exit
+			}
+			return count, err
+		}
+		count++
+	}
+	return count, reportErrors(reports)
+}
+
 // GetBloomer - Start the bloomer
-func GetBloomer(target string, output string, appendOutput bool, saveFilter, loadFilter string, maxWorkers, filterSize, filterHashes uint) (*Bloom, error) {
+func GetBloomer(target string, options *targets.Options, output string, appendOutput bool, saveFilter, loadFilter, filterType string, maxWorkers, filterSize, filterHashes uint) (*Bloom, error) {
 	if maxWorkers < 1 {
 		maxWorkers = 1
 	}
 
-	targets, err := getTargets(target)
+	files, err := targets.Find(target, options)
 	if err != nil {
 		return nil, err
 	}
@@ -150,28 +221,24 @@ func GetBloomer(target string, output string, appendOutput bool, saveFilter, loa
 		return nil, fmt.Errorf("Output location %s already exists", output)
 	}
 
-	mode := os.O_CREATE | os.O_RDWR
-	if appendOutput {
-		mode |= os.O_APPEND
-	}
-
-	outputFile, err := os.OpenFile(output, mode, 0600)
+	// Create filter and optionally load content from previously saved file
+	bloomFilter, err := NewFilter(filterType, filterSize, filterHashes)
 	if err != nil {
 		return nil, err
 	}
-
-	// Create filter and optionally load content from previously saved file
-	bloomFilter := bloom.New(uint(filterSize*gb), filterHashes)
 	if _, err := os.Stat(loadFilter); !os.IsNotExist(err) {
 		loadFile, err := os.Open(loadFilter)
 		if err != nil {
 			return nil, err
 		}
 		defer loadFile.Close()
-		bloomFilter.ReadFrom(loadFile)
+		_, err = bloomFilter.ReadFrom(loadFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load filter %s (%s)", loadFilter, err)
+		}
 	}
 
-	queue := make(chan string)
+	queue := make(chan *Line)
 	quit := make(chan bool)
 	outputMutex := sync.Mutex{}
 	bloomMutex := sync.RWMutex{}
@@ -186,73 +253,106 @@ func GetBloomer(target string, output string, appendOutput bool, saveFilter, loa
 			Bloom:       bloomFilter,
 			BloomMutex:  &bloomMutex,
 			OutputMutex: &outputMutex,
-			Output:      outputFile,
 			Wg:          wg,
 		}
 		workers = append(workers, worker)
 	}
 
 	return &Bloom{
-		targets:     targets,
-		bloomFilter: bloomFilter,
-		outputFile:  outputFile,
-		workers:     workers,
-		queue:       queue,
-		wg:          wg,
+		targets:      files,
+		bloomFilter:  bloomFilter,
+		output:       output,
+		appendOutput: appendOutput,
+		workers:      workers,
+		queue:        queue,
+		save:         saveFilter,
+		wg:           wg,
+		Report:       []*TargetReport{},
+		Errors:       []error{},
 	}, nil
 }
 
-// getTargets - Get targets from target directory
-func getTargets(target string) ([]string, error) {
-	targetStat, err := os.Stat(target)
-	if err != nil {
-		return []string{}, err
+// openOutput - The output is only created by Start, so an invalid filter or
+// a failed Remove does not leave an empty output behind
+func openOutput(output string, appendOutput bool) (*os.File, error) {
+	mode := os.O_CREATE | os.O_RDWR
+	if appendOutput {
+		mode |= os.O_APPEND
+	} else {
+		mode |= os.O_EXCL
 	}
-	switch mode := targetStat.Mode(); {
-	case mode.IsDir():
-		files, err := ioutil.ReadDir(target)
-		if err != nil {
-			return []string{}, nil
-		}
-		targets := []string{}
-		for _, file := range files {
-			if err != nil || file.IsDir() {
-				continue
-			}
-			targetPath := filepath.Join(target, file.Name())
-			targets = append(targets, targetPath)
+	file, err := os.OpenFile(output, mode, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("Output location %s already exists", output)
+	}
+	return file, err
+}
+
+func newReports(targets []string) []*TargetReport {
+	reports := []*TargetReport{}
+	for _, target := range targets {
+		reports = append(reports, &TargetReport{Target: target})
+	}
+	return reports
+}
+
+// TargetsError - Some targets could not be read, they are skipped and the
+// output and filter are complete for every other target
+type TargetsError struct {
+	Failed int
+	Total  int
+	msgs   []string
+}
+
+func (e *TargetsError) Error() string {
+	return fmt.Sprintf("%d of %d target(s) failed: %s", e.Failed, e.Total, strings.Join(e.msgs, "; "))
+}
+
+// reportErrors - Aggregate the errors of all targets into a single error
+func reportErrors(reports []*TargetReport) error {
+	msgs := []string{}
+	for _, report := range reports {
+		if report.Err != nil {
+			msgs = append(msgs, report.Err.Error())
 		}
-		return targets, nil
-	case mode.IsRegular():
-		return []string{target}, nil
 	}
-	return []string{}, nil
+	if len(msgs) == 0 {
+		return nil
+	}
+	return &TargetsError{Failed: len(msgs), Total: len(reports), msgs: msgs}
 }
 
-func lineQueue(targets []string, lines chan<- string) error {
+// lineQueue - Queue the non-blank lines of every target, a target that
+// cannot be read is recorded in its report and we move on to the next one
+func lineQueue(reports []*TargetReport, lines chan<- *Line) {
 	defer close(lines)
-	for _, target := range targets {
-		if _, err := os.Stat(target); os.IsNotExist(err) {
-			return err
+	for _, report := range reports {
+		report.Err = queueTarget(report, lines)
+	}
+}
+
+func queueTarget(report *TargetReport, lines chan<- *Line) error {
+	file, err := os.Open(report.Target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s:%d %s", report.Target, report.Lines+1, err)
 		}
-		file, err := os.Open(target)
-		if err != nil {
-			return err
+		if 0 < len(line) {
+			report.Lines++
 		}
-		defer file.Close()
-
-		reader := bufio.NewReader(file)
-		for {
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				lines <- line
-				break
-			}
-			if err != nil {
-				return err
-			}
-			lines <- line
+		line = strings.TrimSpace(line)
+		if 0 < len(line) {
+			lines <- &Line{Raw: line, Report: report}
+		}
+		if err == io.EOF {
+			return nil
 		}
 	}
-	return nil
 }
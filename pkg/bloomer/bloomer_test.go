@@ -2,9 +2,14 @@ package bloomer
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/willf/bloom"
 )
 
 func TestBloomerSmall(t *testing.T) {
@@ -16,7 +21,7 @@ func TestBloomerSmall(t *testing.T) {
 	defer os.Remove(output.Name())
 
 	// Bloom file
-	bloom, err := GetBloomer("../../test/small.json", output.Name(), true, "", "", 1, 1, 4)
+	bloom, err := GetBloomer("../../test/small.json", nil, output.Name(), true, "", "", FilterBloom, 1, 1, 4)
 	if err != nil {
 		t.Errorf("GetBloomer failed: %s", err)
 	}
@@ -56,7 +61,7 @@ func TestBloomerLarge(t *testing.T) {
 	defer os.Remove(output.Name())
 
 	// Bloom file
-	bloom, err := GetBloomer("../../test/large.json", output.Name(), true, "", "", 1, 1, 4)
+	bloom, err := GetBloomer("../../test/large.json", nil, output.Name(), true, "", "", FilterBloom, 1, 1, 4)
 	if err != nil {
 		t.Errorf("GetBloomer failed: %s", err)
 	}
@@ -85,3 +90,243 @@ func TestBloomerLarge(t *testing.T) {
 		return
 	}
 }
+
+func TestCountingFilterDelete(t *testing.T) {
+	filter, err := NewFilter(FilterCounting, 1, 4)
+	if err != nil {
+		t.Errorf("NewFilter failed: %s", err)
+		return
+	}
+	line := []byte(`{"email":"kbeeho0@51.la","user":"kbeeho0","domain":"51.la","password":"Q96oJ4J"}`)
+	if filter.TestAndAdd(line) {
+		t.Error("Empty filter reported line as a duplicate")
+		return
+	}
+	if !filter.TestAndAdd(line) {
+		t.Error("Filter did not report line as a duplicate")
+		return
+	}
+	filter.Delete(line)
+	if filter.TestAndAdd(line) {
+		t.Error("Filter reported deleted line as a duplicate")
+		return
+	}
+
+	bloomFilter, _ := NewFilter(FilterBloom, 1, 4)
+	if err := bloomFilter.Delete(line); err != ErrDeleteNotSupported {
+		t.Errorf("Expected %s, got %v", ErrDeleteNotSupported, err)
+		return
+	}
+}
+
+func TestBloomerRemove(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	filterPath := filepath.Join(tempDir, "filter.bin")
+
+	// First pass saves a filter containing every line of small.json
+	bloom, err := GetBloomer("../../test/small.json", nil, filepath.Join(tempDir, "first.json"), false, filterPath, "", FilterCounting, 1, 1, 4)
+	if err != nil {
+		t.Errorf("GetBloomer failed: %s", err)
+		return
+	}
+	if err = bloom.Start(); err != nil {
+		t.Errorf("Bloom failed: %s", err)
+		return
+	}
+
+	// Second pass removes the bloomed lines, so they are all treated as new
+	output := filepath.Join(tempDir, "second.json")
+	bloom, err = GetBloomer("../../test/small.json", nil, output, false, "", filterPath, FilterCounting, 1, 1, 4)
+	if err != nil {
+		t.Errorf("GetBloomer failed: %s", err)
+		return
+	}
+	removed, err := bloom.Remove(filepath.Join(tempDir, "first.json"))
+	if err != nil {
+		t.Errorf("Remove failed: %s", err)
+		return
+	}
+	if removed != 50 {
+		t.Errorf("Expected to remove 50 lines (%d)", removed)
+		return
+	}
+	if err = bloom.Start(); err != nil {
+		t.Errorf("Bloom failed: %s", err)
+		return
+	}
+	count, duplicates := bloom.Progress()
+	if count-duplicates != 50 {
+		t.Errorf("Bloomer did not return 50 uniques as expected (%d)", count-duplicates)
+		return
+	}
+}
+
+func TestBloomerNoOutputOnError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	output := filepath.Join(tempDir, "output.json")
+
+	_, err = GetBloomer("../../test/small.json", nil, output, false, "", "", "cuckoo", 1, 1, 4)
+	if err == nil {
+		t.Error("Expected an invalid filter type error")
+		return
+	}
+	if _, err = os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Invalid filter type created the output (%v)", err)
+		return
+	}
+
+	bloom, err := GetBloomer("../../test/small.json", nil, output, false, "", "", FilterBloom, 1, 1, 4)
+	if err != nil {
+		t.Errorf("GetBloomer failed: %s", err)
+		return
+	}
+	if _, err = bloom.Remove("../../test/small.json"); err != ErrDeleteNotSupported {
+		t.Errorf("Expected %v, got %v", ErrDeleteNotSupported, err)
+		return
+	}
+	if _, err = os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Failed remove created the output (%v)", err)
+		return
+	}
+}
+
+func TestBloomerMissingTarget(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	data, err := ioutil.ReadFile("../../test/small.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, name := range []string{"a.json", "b.json", "c.json"} {
+		ioutil.WriteFile(filepath.Join(tempDir, name), data, 0600)
+	}
+
+	output := filepath.Join(tempDir, "output.json")
+	bloom, err := GetBloomer(tempDir, nil, output, false, "", "", FilterBloom, 1, 1, 4)
+	if err != nil {
+		t.Errorf("GetBloomer failed: %s", err)
+		return
+	}
+	os.Remove(filepath.Join(tempDir, "b.json"))
+	err = bloom.Start()
+	if _, ok := err.(*TargetsError); !ok {
+		t.Errorf("Expected a target error for missing target, got %v", err)
+		return
+	}
+	if len(bloom.Errors) != 1 || len(bloom.Report) != 3 {
+		t.Errorf("Unexpected errors (%d) or reports (%d)", len(bloom.Errors), len(bloom.Report))
+		return
+	}
+
+	// The target after the missing file must still be processed
+	first, last := bloom.Report[0], bloom.Report[2]
+	if first.Uniques != 50 || last.Lines != first.Lines || last.Duplicates != first.Lines {
+		t.Errorf("Unexpected reports %v %v", first, last)
+		return
+	}
+}
+
+func TestBloomerSaveError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The filter cannot be saved over a directory, that must not be hidden
+	// by the error of a missing target
+	output := filepath.Join(tempDir, "output.json")
+	bloom, err := GetBloomer("../../test/small.json", nil, output, false, tempDir, "", FilterBloom, 1, 1, 4)
+	if err != nil {
+		t.Errorf("GetBloomer failed: %s", err)
+		return
+	}
+	bloom.targets = append(bloom.targets, filepath.Join(tempDir, "missing.json"))
+	err = bloom.Start()
+	if _, ok := err.(*TargetsError); err == nil || ok {
+		t.Errorf("Expected the save error, got %v", err)
+		return
+	}
+
+	// Output write errors are returned
+	if _, err = os.Stat("/dev/full"); err != nil {
+		return
+	}
+	bloom, err = GetBloomer("../../test/small.json", nil, "/dev/full", true, "", "", FilterBloom, 1, 1, 4)
+	if err != nil {
+		t.Errorf("GetBloomer failed: %s", err)
+		return
+	}
+	if err = bloom.Start(); err == nil {
+		t.Error("Expected an output write error")
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	line := []byte(`{"email":"kbeeho0@51.la","user":"kbeeho0","domain":"51.la","password":"Q96oJ4J"}`)
+	newFilter := func(filterType string) Filter {
+		if filterType == FilterCounting {
+			return newCountingFilter(1024, 4)
+		}
+		return &standardFilter{bloom.New(1024, 4)}
+	}
+	saved := map[string][]byte{}
+	for _, filterType := range FilterTypes {
+		filter := newFilter(filterType)
+		filter.TestAndAdd(line)
+		buf := &bytes.Buffer{}
+		if _, err := filter.WriteTo(buf); err != nil {
+			t.Errorf("%s: write error %s", filterType, err)
+			return
+		}
+		saved[filterType] = buf.Bytes()
+
+		loaded := newFilter(filterType)
+		if _, err := loaded.ReadFrom(bytes.NewReader(saved[filterType])); err != nil {
+			t.Errorf("%s: read error %s", filterType, err)
+			return
+		}
+		if !loaded.TestAndAdd(line) {
+			t.Errorf("%s: loaded filter does not contain the line", filterType)
+			return
+		}
+	}
+
+	// A file of one type must not be loaded as the other
+	counting := newFilter(FilterCounting)
+	if _, err := counting.ReadFrom(bytes.NewReader(saved[FilterBloom])); err != ErrFilterType {
+		t.Errorf("Expected %v loading a bloom filter as counting, got %v", ErrFilterType, err)
+		return
+	}
+	standard := newFilter(FilterBloom)
+	if _, err := standard.ReadFrom(bytes.NewReader(saved[FilterCounting])); err != ErrFilterType {
+		t.Errorf("Expected %v loading a counting filter as bloom, got %v", ErrFilterType, err)
+		return
+	}
+
+	// A corrupt size is rejected or fails at the end of the file
+	for _, m := range []uint64{0, 1 << 62, 1 << 35} {
+		corrupt := append([]byte{}, saved[FilterCounting][:countingHeaderSize+16]...)
+		binary.BigEndian.PutUint64(corrupt[8:], m)
+		if _, err := counting.ReadFrom(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("Expected an error loading a counting filter with m=%d", m)
+			return
+		}
+	}
+}
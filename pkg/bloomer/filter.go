@@ -0,0 +1,254 @@
+package bloomer
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/willf/bloom"
+)
+
+const (
+	// FilterBloom - A standard bloom filter, smallest but cannot delete entries
+	FilterBloom = "bloom"
+	// FilterCounting - A counting bloom filter with 4-bit counters, supports Delete
+	FilterCounting = "counting"
+
+	counterBits = 4
+	counterMax  = 1<<counterBits - 1
+
+	// Counting filter files start with a magic and version so they are not
+	// mistaken for standard filter files, which have no header
+	countingMagic      = "LKCF"
+	countingVersion    = 1
+	countingHeaderSize = 8 + 16
+
+	// Bounds of a counting filter read from a file, 2^36 counters is a
+	// 256Gb memory budget
+	maxCountingCounters = 1 << 36
+	maxCountingHashes   = 1 << 8
+	countersChunkSize   = 64 * mb
+)
+
+var (
+	// ErrDeleteNotSupported - The filter implementation cannot remove entries
+	ErrDeleteNotSupported = errors.New("Filter does not support deleting entries")
+	// ErrFilterType - The filter file was saved by another filter type
+	ErrFilterType = errors.New("Filter file is not of the selected filter type")
+
+	// FilterTypes - Valid filter implementations
+	FilterTypes = []string{FilterBloom, FilterCounting}
+)
+
+// Filter - A probabilistic set used to detect duplicate lines
+type Filter interface {
+	// TestAndAdd - Returns true if data was (probably) already in the
+	// filter, data is added to the filter either way
+	TestAndAdd(data []byte) bool
+	// Delete - Remove data from the filter
+	Delete(data []byte) error
+	WriteTo(stream io.Writer) (int64, error)
+	ReadFrom(stream io.Reader) (int64, error)
+}
+
+// NewFilter - Create a filter of filterType, size is the memory budget in
+// gigabits so that all filter types occupy the same amount of memory
+func NewFilter(filterType string, size uint, hashes uint) (Filter, error) {
+	switch filterType {
+	case "", FilterBloom:
+		return &standardFilter{bloom.New(size*gb, hashes)}, nil
+	case FilterCounting:
+		return newCountingFilter(uint64(size*gb/counterBits), hashes), nil
+	}
+	return nil, fmt.Errorf("Invalid filter type '%s'", filterType)
+}
+
+// standardFilter - Wraps willf/bloom, which already implements everything
+// except Delete
+type standardFilter struct {
+	*bloom.BloomFilter
+}
+
+func (f *standardFilter) Delete(data []byte) error {
+	return ErrDeleteNotSupported
+}
+
+// ReadFrom - Standard filter files have no header, so only reject files
+// that start with the header of a counting filter
+func (f *standardFilter) ReadFrom(stream io.Reader) (int64, error) {
+	magic := make([]byte, len(countingMagic))
+	read, err := io.ReadFull(stream, magic)
+	if err != nil {
+		return int64(read), err
+	}
+	if string(magic) == countingMagic {
+		return int64(read), ErrFilterType
+	}
+	return f.BloomFilter.ReadFrom(io.MultiReader(bytes.NewReader(magic), stream))
+}
+
+// countingFilter - A bloom filter where each bit is replaced with a 4-bit
+// saturating counter, two counters are packed into each byte. A counter that
+// reaches counterMax is never decremented since we no longer know its value.
+type countingFilter struct {
+	m        uint64
+	k        uint
+	counters []byte
+}
+
+func newCountingFilter(m uint64, k uint) *countingFilter {
+	if m < 1 {
+		m = 1
+	}
+	if k < 1 {
+		k = 1
+	}
+	return &countingFilter{
+		m:        m,
+		k:        k,
+		counters: make([]byte, (m+1)/2),
+	}
+}
+
+func (f *countingFilter) get(location uint64) byte {
+	if location%2 == 0 {
+		return f.counters[location/2] & 0x0f
+	}
+	return f.counters[location/2] >> 4
+}
+
+func (f *countingFilter) set(location uint64, value byte) {
+	if location%2 == 0 {
+		f.counters[location/2] = (f.counters[location/2] & 0xf0) | value
+	} else {
+		f.counters[location/2] = (f.counters[location/2] & 0x0f) | (value << 4)
+	}
+}
+
+func (f *countingFilter) locations(data []byte) []uint64 {
+	locations := bloom.Locations(data, f.k)
+	for index := range locations {
+		locations[index] %= f.m
+	}
+	return locations
+}
+
+// TestAndAdd - Only increments the counters of data that is not already
+// present, so that a single Delete removes a line no matter how many
+// times it was seen
+func (f *countingFilter) TestAndAdd(data []byte) bool {
+	locations := f.locations(data)
+	present := true
+	for _, location := range locations {
+		if f.get(location) == 0 {
+			present = false
+			break
+		}
+	}
+	if present {
+		return true
+	}
+	for _, location := range locations {
+		value := f.get(location)
+		if value < counterMax {
+			f.set(location, value+1)
+		}
+	}
+	return false
+}
+
+// Delete - Decrement the counters of data. Like any counting bloom filter
+// this cannot tell data that was added from a false positive, deleting a
+// false positive decrements counters of other entries which may then be
+// reported as new (false negatives). Only delete data that was added.
+func (f *countingFilter) Delete(data []byte) error {
+	locations := f.locations(data)
+	for _, location := range locations {
+		if f.get(location) == 0 {
+			return nil // Was never added, decrementing would corrupt other entries
+		}
+	}
+	for _, location := range locations {
+		value := f.get(location)
+		if value < counterMax {
+			f.set(location, value-1)
+		}
+	}
+	return nil
+}
+
+// WriteTo - [magic 4][version 1][counter bits 1][reserved 2]
+// [uint64 m][uint64 k][counters ...] big endian like willf/bloom
+func (f *countingFilter) WriteTo(stream io.Writer) (int64, error) {
+	header := make([]byte, countingHeaderSize)
+	copy(header, countingMagic)
+	header[4] = countingVersion
+	header[5] = counterBits
+	binary.BigEndian.PutUint64(header[8:], f.m)
+	binary.BigEndian.PutUint64(header[16:], uint64(f.k))
+	written, err := stream.Write(header)
+	if err != nil {
+		return int64(written), err
+	}
+	counters, err := stream.Write(f.counters)
+	return int64(written + counters), err
+}
+
+// ReadFrom - Read a filter written by WriteTo, the header is validated and
+// the counters are read in chunks so a corrupt m fails at the end of the
+// file rather than allocating m counters up front
+func (f *countingFilter) ReadFrom(stream io.Reader) (int64, error) {
+	header := make([]byte, countingHeaderSize)
+	read, err := io.ReadFull(stream, header)
+	if err != nil {
+		return int64(read), err
+	}
+	if string(header[:len(countingMagic)]) != countingMagic {
+		return int64(read), ErrFilterType
+	}
+	if header[4] != countingVersion || header[5] != counterBits {
+		return int64(read), fmt.Errorf("Unsupported counting filter version %d with %d-bit counters", header[4], header[5])
+	}
+	m := binary.BigEndian.Uint64(header[8:])
+	k := binary.BigEndian.Uint64(header[16:])
+	if m < 1 || maxCountingCounters < m || k < 1 || maxCountingHashes < k {
+		return int64(read), fmt.Errorf("Invalid counting filter size m=%d k=%d", m, k)
+	}
+	size := int((m + 1) / 2)
+	counters := []byte{}
+	for len(counters) < size {
+		chunk := size - len(counters)
+		if countersChunkSize < chunk {
+			chunk = countersChunkSize
+		}
+		counters = append(counters, make([]byte, chunk)...)
+		n, err := io.ReadFull(stream, counters[len(counters)-chunk:])
+		read += n
+		if err != nil {
+			return int64(read), err
+		}
+	}
+	f.m = m
+	f.k = uint(k)
+	f.counters = counters
+	return int64(read), nil
+}
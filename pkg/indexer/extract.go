@@ -0,0 +1,417 @@
+package indexer
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Extracts the fields of a normalizer.Entry from a JSON line in a single
+	pass without allocating. Values are decoded exactly as encoding/json
+	decodes them, which the searcher uses to re-hash lines, e.g. invalid
+	UTF-8 is replaced with U+FFFD and keys match case-insensitively. A line
+	is malformed if it is not a JSON object encoding/json can unmarshal into
+	an Entry.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Fields of a normalized entry
+const (
+	emailField = iota
+	userField
+	domainField
+	passwordField
+	numberOfFields
+
+	maxNestingDepth = 10000 // Same as encoding/json
+)
+
+var (
+	entryFieldNames = [numberOfFields][]byte{
+		[]byte("email"), []byte("user"), []byte("domain"), []byte("password"),
+	}
+
+	errMalformedLine = errors.New("Malformed JSON line")
+)
+
+// entryParser - Extracts the fields of an entry, values are slices of the
+// line or, if they have escapes, of a buffer reused by the next line
+type entryParser struct {
+	values [numberOfFields][]byte
+	buf    []byte
+}
+
+// parse - Extract the fields of a JSON line, missing and null fields are
+// empty
+func (p *entryParser) parse(line []byte) error {
+	for field := range p.values {
+		p.values[field] = nil
+	}
+	p.buf = p.buf[:0]
+
+	pos := skipSpace(line, 0)
+	if len(line) <= pos || line[pos] != '{' {
+		return errMalformedLine
+	}
+	pos = skipSpace(line, pos+1)
+	if pos < len(line) && line[pos] == '}' {
+		pos++
+	} else {
+		for {
+			if len(line) <= pos || line[pos] != '"' {
+				return errMalformedLine
+			}
+			end, plain, ok := scanString(line, pos)
+			if !ok {
+				return errMalformedLine
+			}
+			field := p.fieldOf(line[pos:end], plain)
+
+			pos = skipSpace(line, end)
+			if len(line) <= pos || line[pos] != ':' {
+				return errMalformedLine
+			}
+			pos = skipSpace(line, pos+1)
+			if field < 0 {
+				pos, ok = skipValue(line, pos, 0)
+			} else {
+				pos, ok = p.fieldValue(line, pos, field)
+			}
+			if !ok {
+				return errMalformedLine
+			}
+
+			pos = skipSpace(line, pos)
+			if len(line) <= pos {
+				return errMalformedLine
+			}
+			if line[pos] == '}' {
+				pos++
+				break
+			}
+			if line[pos] != ',' {
+				return errMalformedLine
+			}
+			pos = skipSpace(line, pos+1)
+		}
+	}
+	if skipSpace(line, pos) != len(line) {
+		return errMalformedLine
+	}
+	return nil
+}
+
+// fieldOf - The field of a quoted key, or -1 if it is not an entry field
+func (p *entryParser) fieldOf(quoted []byte, plain bool) int {
+	key := quoted[1 : len(quoted)-1]
+	if !plain {
+		start := len(p.buf)
+		p.buf = appendUnquoted(p.buf, key)
+		key = p.buf[start:]
+		defer func() {
+			p.buf = p.buf[:start]
+		}()
+	}
+	for field, name := range entryFieldNames {
+		if bytes.Equal(key, name) {
+			return field
+		}
+	}
+	for field, name := range entryFieldNames {
+		if bytes.EqualFold(key, name) {
+			return field
+		}
+	}
+	return -1
+}
+
+// fieldValue - Decode the value of an entry field, which must be a string
+// or null, null leaves the field unchanged
+func (p *entryParser) fieldValue(line []byte, pos int, field int) (int, bool) {
+	if bytes.HasPrefix(line[pos:], []byte("null")) {
+		return pos + 4, true
+	}
+	if len(line) <= pos || line[pos] != '"' {
+		return pos, false
+	}
+	end, plain, ok := scanString(line, pos)
+	if !ok {
+		return pos, false
+	}
+	if plain {
+		p.values[field] = line[pos+1 : end-1]
+	} else {
+		start := len(p.buf)
+		p.buf = appendUnquoted(p.buf, line[pos+1:end-1])
+		p.values[field] = p.buf[start:]
+	}
+	return end, true
+}
+
+func skipSpace(line []byte, pos int) int {
+	for pos < len(line) {
+		switch line[pos] {
+		case ' ', '\t', '\n', '\r':
+			pos++
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// scanString - Find the end of the string starting at pos, plain strings
+// are valid UTF-8 without escapes so their value is the string's bytes
+func scanString(line []byte, pos int) (end int, plain bool, ok bool) {
+	plain = true
+	ascii := true
+	start := pos + 1
+	for pos++; pos < len(line); pos++ {
+		c := line[pos]
+		switch {
+		case c == '"':
+			if plain && !ascii && !utf8.Valid(line[start:pos]) {
+				plain = false
+			}
+			return pos + 1, plain, true
+		case c == '\\':
+			plain = false
+			pos++
+			if len(line) <= pos {
+				return pos, false, false
+			}
+			switch line[pos] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				if len(line) <= pos+4 || !isHex(line[pos+1:pos+5]) {
+					return pos, false, false
+				}
+				pos += 4
+			default:
+				return pos, false, false
+			}
+		case c < ' ':
+			return pos, false, false
+		case utf8.RuneSelf <= c:
+			ascii = false
+		}
+	}
+	return pos, false, false
+}
+
+func isHex(buf []byte) bool {
+	for _, c := range buf {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func hexValue(buf []byte) rune {
+	var value rune
+	for _, c := range buf {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c = c - 'a' + 10
+		default:
+			c = c - 'A' + 10
+		}
+		value = value<<4 | rune(c)
+	}
+	return value
+}
+
+// appendUnquoted - Append the decoded value of a string scanned by
+// scanString, without its quotes
+func appendUnquoted(buf []byte, value []byte) []byte {
+	for pos := 0; pos < len(value); {
+		c := value[pos]
+		switch {
+		case c == '\\':
+			switch value[pos+1] {
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'u':
+				r := hexValue(value[pos+2 : pos+6])
+				pos += 6
+				if utf16.IsSurrogate(r) {
+					next := value[pos:]
+					dec := unicode.ReplacementChar
+					if 6 <= len(next) && next[0] == '\\' && next[1] == 'u' {
+						dec = utf16.DecodeRune(r, hexValue(next[2:6]))
+					}
+					if dec != unicode.ReplacementChar {
+						pos += 6
+					}
+					r = dec
+				}
+				buf = appendRune(buf, r)
+				continue
+			default: // '"', '\\', '/'
+				buf = append(buf, value[pos+1])
+			}
+			pos += 2
+		case c < utf8.RuneSelf:
+			buf = append(buf, c)
+			pos++
+		default:
+			r, size := utf8.DecodeRune(value[pos:])
+			if r == utf8.RuneError && size == 1 {
+				buf = appendRune(buf, unicode.ReplacementChar)
+			} else {
+				buf = append(buf, value[pos:pos+size]...)
+			}
+			pos += size
+		}
+	}
+	return buf
+}
+
+func appendRune(buf []byte, r rune) []byte {
+	var encoded [utf8.UTFMax]byte
+	size := utf8.EncodeRune(encoded[:], r)
+	return append(buf, encoded[:size]...)
+}
+
+// skipValue - Skip over any JSON value
+func skipValue(line []byte, pos int, depth int) (int, bool) {
+	if len(line) <= pos || maxNestingDepth < depth {
+		return pos, false
+	}
+	switch c := line[pos]; {
+	case c == '"':
+		end, _, ok := scanString(line, pos)
+		return end, ok
+	case c == '{':
+		return skipContainer(line, pos, depth, '}', true)
+	case c == '[':
+		return skipContainer(line, pos, depth, ']', false)
+	case c == 't':
+		return skipLiteral(line, pos, "true")
+	case c == 'f':
+		return skipLiteral(line, pos, "false")
+	case c == 'n':
+		return skipLiteral(line, pos, "null")
+	case c == '-' || '0' <= c && c <= '9':
+		return skipNumber(line, pos)
+	}
+	return pos, false
+}
+
+// skipContainer - Skip over an object or array
+func skipContainer(line []byte, pos int, depth int, closing byte, object bool) (int, bool) {
+	pos = skipSpace(line, pos+1)
+	if pos < len(line) && line[pos] == closing {
+		return pos + 1, true
+	}
+	for {
+		var ok bool
+		if object {
+			if len(line) <= pos || line[pos] != '"' {
+				return pos, false
+			}
+			pos, _, ok = scanString(line, pos)
+			if !ok {
+				return pos, false
+			}
+			pos = skipSpace(line, pos)
+			if len(line) <= pos || line[pos] != ':' {
+				return pos, false
+			}
+			pos = skipSpace(line, pos+1)
+		}
+		pos, ok = skipValue(line, pos, depth+1)
+		if !ok {
+			return pos, false
+		}
+		pos = skipSpace(line, pos)
+		if len(line) <= pos {
+			return pos, false
+		}
+		if line[pos] == closing {
+			return pos + 1, true
+		}
+		if line[pos] != ',' {
+			return pos, false
+		}
+		pos = skipSpace(line, pos+1)
+	}
+}
+
+func skipLiteral(line []byte, pos int, literal string) (int, bool) {
+	if !bytes.HasPrefix(line[pos:], []byte(literal)) {
+		return pos, false
+	}
+	return pos + len(literal), true
+}
+
+// skipNumber - -?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?
+func skipNumber(line []byte, pos int) (int, bool) {
+	if line[pos] == '-' {
+		pos++
+	}
+	if len(line) <= pos {
+		return pos, false
+	}
+	if line[pos] == '0' {
+		pos++
+	} else if '1' <= line[pos] && line[pos] <= '9' {
+		pos = skipDigits(line, pos)
+	} else {
+		return pos, false
+	}
+	if pos < len(line) && line[pos] == '.' {
+		start := pos + 1
+		pos = skipDigits(line, start)
+		if pos == start {
+			return pos, false
+		}
+	}
+	if pos < len(line) && (line[pos] == 'e' || line[pos] == 'E') {
+		pos++
+		if pos < len(line) && (line[pos] == '+' || line[pos] == '-') {
+			pos++
+		}
+		start := pos
+		pos = skipDigits(line, start)
+		if pos == start {
+			return pos, false
+		}
+	}
+	return pos, true
+}
+
+func skipDigits(line []byte, pos int) int {
+	for pos < len(line) && '0' <= line[pos] && line[pos] <= '9' {
+		pos++
+	}
+	return pos
+}
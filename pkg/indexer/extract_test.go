@@ -0,0 +1,188 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+var extractTests = []string{
+	`{"email": "a@example.com", "user": "a", "domain": "example.com", "password": "hunter2"}`,
+	`{"email":"a@example.com","user":"a","domain":"example.com","password":"hunter2"}`,
+	` { "password" : "p" , "email" : "e" } `,
+	`{}`,
+	`{"EMAIL": "upper", "Password": "mixed"}`,
+	`{"email": "first", "email": "last"}`,
+	`{"email": "kept", "email": null}`,
+	`{"email": null}`,
+	`{"password": "tab\there \"quoted\" back\\slash \/ \b\f\n\r"}`,
+	`{"password": "é中😀"}`,
+	`{"password": "lone \uD83D surrogate"}`,
+	`{"password": "reversed \uDE00\uD83D pair"}`,
+	`{"password": "surrogate then escape \uD83D\n"}`,
+	`{"password": "caf` + "\xc3\xa9" + `"}`,
+	`{"password": "invalid ` + "\xff\xfe" + ` utf8"}`,
+	`{"password": "truncated ` + "\xe4\xb8" + `"}`,
+	`{"p\u0061ssword": "escaped key"}`,
+	`{"user": "u", "extra": {"nested": [1, -2.5e+10, true, false, null, "s", {}, []]}}`,
+	`{"user": "u", "number": 0, "negative": -0.5, "exponent": 1E9}`,
+	`{"user": "u", "extra": "` + "\xff" + `"}`,
+	// Malformed
+	``,
+	`   `,
+	`null`,
+	`[]`,
+	`"string"`,
+	`{`,
+	`{"email": "a"`,
+	`{"email": "a",}`,
+	`{"email" "a"}`,
+	`{"email": "a"} trailing`,
+	`{"email": "a"}{}`,
+	`{email: "a"}`,
+	`{"email": 'a'}`,
+	`{"email": "unterminated}`,
+	`{"email": "bad \x escape"}`,
+	`{"email": "bad \u12 escape"}`,
+	`{"email": "control ` + "\x01" + `"}`,
+	`{"email": 42}`,
+	`{"email": true}`,
+	`{"email": ["a"]}`,
+	`{"email": {"a": "b"}}`,
+	`{"email": nul}`,
+	`{"user": "u", "extra": 01}`,
+	`{"user": "u", "extra": 1.}`,
+	`{"user": "u", "extra": -}`,
+	`{"user": "u", "extra": 1e}`,
+	`{"user": "u", "extra": tru}`,
+	`{"user": "u", "extra": [1,]}`,
+	`{"user": "u", "extra": {"a" 1}}`,
+	`{"user": "u", "extra": [}`,
+}
+
+func TestExtract(t *testing.T) {
+	parser := &entryParser{}
+	for _, line := range extractTests {
+		var expected Credential
+		expectedErr := json.Unmarshal([]byte(line), &expected)
+		if line == `null` {
+			expectedErr = errMalformedLine // Not an object
+		}
+		err := parser.parse([]byte(line))
+		if (err == nil) != (expectedErr == nil) {
+			t.Errorf("%q: expected error %v, got %v", line, expectedErr, err)
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if cred := parsedCredential(parser); cred != expected {
+			t.Errorf("%q: expected %+v, got %+v", line, expected, cred)
+			return
+		}
+	}
+}
+
+func TestExtractFixtures(t *testing.T) {
+	data, err := ioutil.ReadFile("../../test/large-bloomed.json")
+	if err != nil {
+		t.Errorf("Read error: %s", err)
+		return
+	}
+	parser := &entryParser{}
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var expected Credential
+		json.Unmarshal(line, &expected)
+		if err = parser.parse(line); err != nil {
+			t.Errorf("%q: %s", line, err)
+			return
+		}
+		if cred := parsedCredential(parser); cred != expected {
+			t.Errorf("%q: expected %+v, got %+v", line, expected, cred)
+			return
+		}
+	}
+}
+
+// parsedCredential - The credential of the last line parsed
+func parsedCredential(parser *entryParser) Credential {
+	return Credential{
+		Email:    string(parser.values[emailField]),
+		User:     string(parser.values[userField]),
+		Domain:   string(parser.values[domainField]),
+		Password: string(parser.values[passwordField]),
+	}
+}
+
+// TestExtractAllocs - Parsing a line and writing its entries is the per line
+// path of a worker, it must not allocate for keys other than domain suffixes
+func TestExtractAllocs(t *testing.T) {
+	indexes := []*KeyIndex{}
+	outputs := []*bufio.Writer{}
+	for _, key := range []string{"email", "email+password", "user+domain+password"} {
+		header, err := indexfile.New(key, 8, "../../test/small-bloomed.json")
+		if err != nil {
+			t.Errorf("Header error: %s", err)
+			return
+		}
+		fields, _ := indexfile.ParseKey(key)
+		indexes = append(indexes, &KeyIndex{Header: header, fields: fields})
+		outputs = append(outputs, bufio.NewWriterSize(ioutil.Discard, outputBufSize))
+	}
+	header, err := indexfile.NewOrdered("user", indexfile.DefaultPrefixSize, "../../test/small-bloomed.json")
+	if err != nil {
+		t.Errorf("Header error: %s", err)
+		return
+	}
+	indexes = append(indexes, &KeyIndex{Header: header, fields: []string{"user"}})
+	outputs = append(outputs, bufio.NewWriterSize(ioutil.Discard, outputBufSize))
+
+	entries := newEntryWriter(indexes, outputs, nil, 1)
+	for _, line := range extractTests[:20] {
+		buf := []byte(line)
+		entries.write(buf, 1<<40) // Grow the buffers
+		allocs := testing.AllocsPerRun(100, func() {
+			entries.write(buf, 1<<40)
+		})
+		if allocs != 0 {
+			t.Errorf("%q: %.0f allocations per line", line, allocs)
+			return
+		}
+	}
+}
+
+func benchmarkLines(b *testing.B) [][]byte {
+	data, err := ioutil.ReadFile("../../test/large-bloomed.json")
+	if err != nil {
+		b.Fatalf("Read error: %s", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	return lines
+}
+
+func BenchmarkExtractUnmarshal(b *testing.B) {
+	lines := benchmarkLines(b)
+	for n := 0; n < b.N; n++ {
+		for _, line := range lines {
+			var cred Credential
+			json.Unmarshal(line, &cred)
+		}
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	lines := benchmarkLines(b)
+	parser := &entryParser{}
+	for n := 0; n < b.N; n++ {
+		for _, line := range lines {
+			parser.parse(line)
+		}
+	}
+}
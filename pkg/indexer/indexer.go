@@ -16,23 +16,31 @@ package indexer
 	along with this program.  If not, see <http://www.gnu.org/licenses/>.
 	----------------------------------------------------------------------
 
-	[48-bit digest][48-bit offset] = 96-bit (12 byte) entry
+	[header][48, 64, or 96-bit digest][48-bit offset] ...
 
+	Sharded indexes use 64-bit offsets that include the shard ID.
+
+	An indexer can create the indexes of several keys in one pass over the
+	JSON file, each worker writes one file per key that are concatenated
+	into the index of each key.
+
+	Ordered indexes store a prefix of the value in place of the digest.
+
+	See pkg/indexfile for details of the header.
 */
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+
+	"github.com/moloch--/leakdb/pkg/filesystem"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/publicsuffix"
 )
 
 const (
@@ -40,20 +48,36 @@ const (
 	mb = kb * 1024
 	gb = mb * 1024
 
-	digestSize = 6
-	offsetSize = 6
-	entrySize  = digestSize + offsetSize
+	outputBufSize = 64 * kb
+
+	maxMalformedOffsets = 10
 )
 
+// KeyIndex - The index of one key created by an indexer
+type KeyIndex struct {
+	Header *indexfile.Header
+	Output string
+	fields []string
+}
+
 // Worker - Worker thread
 type Worker struct {
-	ID         int
-	Wg         *sync.WaitGroup
-	TargetPath string
-	OutputPath string
-	LineCount  uint64
-	Position   int64
-	Labor      Labor
+	ID          int
+	Wg          *sync.WaitGroup
+	TargetPath  string
+	OutputPaths []string // The worker's part of each index
+	LineCount   uint64
+	Position    int64
+	Labor       Labor
+	Indexes     []*KeyIndex
+	Suffixes    *publicsuffix.List
+	Shard       uint16
+	MaxLineSize int
+	FS          filesystem.FS
+	Err         error // The error that stopped the worker, if any
+
+	Malformed        uint64  // Number of malformed lines skipped
+	MalformedOffsets []int64 // Offsets of the first malformed lines
 }
 
 // Credential - JSON parsed line
@@ -64,144 +88,207 @@ type Credential struct {
 	Password string
 }
 
-// Line - Raw data of a line in the file and offset
-type Line struct {
-	Raw    string
-	Offset int64
-}
-
-// Labor - Each worker's part of a file
+// Labor - Each worker's part of a file, the lines that start in
+// [Start, Stop)
 type Labor struct {
 	Start int64
 	Stop  int64
 }
 
-// Cred - Prase the raw line as a Credential
-func (l *Line) Cred() Credential {
-	var cred Credential
-	json.Unmarshal([]byte(l.Raw), &cred)
-	return cred
+func (w *Worker) start() {
+	go func() {
+		defer w.Wg.Done()
+		w.Err = w.index()
+	}()
 }
 
-func (w *Worker) start(key string) {
-
-	outputFile, err := os.Create(w.OutputPath)
+func (w *Worker) index() error {
+	outputFiles := []filesystem.File{}
+	defer func() {
+		for _, outputFile := range outputFiles {
+			outputFile.Close()
+		}
+	}()
+	outputs := []*bufio.Writer{}
+	for _, outputPath := range w.OutputPaths {
+		outputFile, err := w.FS.Create(outputPath)
+		if err != nil {
+			return err
+		}
+		outputFiles = append(outputFiles, outputFile)
+		outputs = append(outputs, bufio.NewWriterSize(outputFile, outputBufSize))
+	}
+	targetFile, err := w.FS.Open(w.TargetPath)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	targetFile, err := os.Open(w.TargetPath)
+	defer targetFile.Close()
+
+	w.Position = w.Labor.Start
+	_, err = targetFile.Seek(w.Position, 0)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	reader := newLineReader(targetFile, w.Position, w.MaxLineSize)
+	entries := newEntryWriter(w.Indexes, outputs, w.Suffixes, w.Shard)
 
-	go func() {
-		defer func() {
-			outputFile.Close()
-			targetFile.Close()
-			w.Wg.Done()
-		}()
-
-		w.Position = int64(w.Labor.Start)
-		targetFile.Seek(w.Position, 0)
-		scanner := bufio.NewScanner(targetFile)
-
-		for scanner.Scan() {
-			rawLine := scanner.Text()
-			w.LineCount++
-			line := &Line{
-				Raw:    rawLine,
-				Offset: w.Position,
-			}
-			cred := line.Cred()
-			value, _ := getKeyValue(cred, key)
-			digest := sha256.Sum256([]byte(value))
-			offsetBuf := make([]byte, 8)
-			binary.LittleEndian.PutUint64(offsetBuf, uint64(line.Offset))
-			outputFile.Write(digest[:digestSize])
-			outputFile.Write(offsetBuf[:offsetSize])
-			w.Position += int64(len(rawLine) + 1)
-			if w.Labor.Stop <= w.Position {
-				break
-			}
+	for w.Position < w.Labor.Stop {
+		rawLine, offset, err := reader.next()
+		if err == io.EOF {
+			return fmt.Errorf("Unexpected end of %s at offset %d", w.TargetPath, offset)
 		}
-	}()
+		if err != nil && err != errLineTooLong {
+			return err
+		}
+		w.Position = reader.offset
+		w.LineCount++
+		if err == nil {
+			err = entries.write(rawLine, offset)
+		}
+		if err == errLineTooLong || err == errMalformedLine {
+			w.malformed(offset)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for n, output := range outputs {
+		err = output.Flush()
+		if err != nil {
+			return err
+		}
+		err = outputFiles[n].Close()
+		if err != nil {
+			return err
+		}
+	}
+	outputFiles = nil
+	return nil
+}
+
+// malformed - Skip the malformed line at offset
+func (w *Worker) malformed(offset int64) {
+	w.Malformed++
+	if len(w.MalformedOffsets) < maxMalformedOffsets {
+		w.MalformedOffsets = append(w.MalformedOffsets, offset)
+	}
+}
 
+// entryWriter - Parses lines and writes an entry per key value to the
+// output of each index
+type entryWriter struct {
+	parser entryParser
+	keys   []*keyWriter
+	shard  uint16
 }
 
-func getKeyValue(cred Credential, key string) (string, error) {
-	switch key {
-	case "email":
-		return cred.Email, nil
-	case "domain":
-		return cred.Domain, nil
-	case "user":
-		return cred.User, nil
-	case "password":
-		return cred.Password, nil
-	}
-	return "", fmt.Errorf("invalid index key '%s'", key)
+// keyWriter - Writes the entries of one index, plain, composite, and
+// ordered keys are digested from the parsed fields without allocating
+type keyWriter struct {
+	output   io.Writer
+	digester *indexfile.Digester
+	fields   []int // Entry fields of the key in canonical order
+	values   [numberOfFields][]byte
+	suffixes *publicsuffix.List // Set for domain suffix keys
+	offset   []byte
 }
 
-func divisionOfLabor(target string, maxWorkers int) ([]Labor, error) {
-	targetInfo, err := os.Stat(target)
-	if os.IsNotExist(err) {
-		return nil, err
+func newEntryWriter(indexes []*KeyIndex, outputs []*bufio.Writer, suffixes *publicsuffix.List, shard uint16) *entryWriter {
+	entries := &entryWriter{shard: shard}
+	for n, index := range indexes {
+		key := &keyWriter{
+			output:   outputs[n],
+			digester: index.Header.NewDigester(),
+			offset:   make([]byte, index.Header.OffsetSize),
+		}
+		if len(index.fields) == 1 && index.fields[0] == indexfile.DomainSuffixKey {
+			key.suffixes = suffixes
+		}
+		for _, field := range index.fields {
+			key.fields = append(key.fields, entryField(field))
+		}
+		entries.keys = append(entries.keys, key)
 	}
+	return entries
+}
 
-	targetFile, err := os.Open(target)
-	if err != nil {
-		return nil, err
+// entryField - The entry field the values of a key field are read from
+func entryField(field string) int {
+	if field == indexfile.DomainSuffixKey {
+		return domainField
 	}
-	defer targetFile.Close()
+	for entryField, name := range entryFieldNames {
+		if string(name) == field {
+			return entryField
+		}
+	}
+	panic(fmt.Sprintf("Invalid key field '%s'", field)) // Keys are parsed by GetIndexer
+}
 
-	chunkSize := int64(math.Ceil(float64(targetInfo.Size()) / float64(maxWorkers)))
+// write - Parse the line starting at offset and write its entries, nothing
+// is written for a malformed line
+func (e *entryWriter) write(line []byte, offset int64) error {
+	err := e.parser.parse(line)
+	if err != nil {
+		return err
+	}
+	location := indexfile.Location(e.shard, offset)
+	for _, key := range e.keys {
+		err = key.write(&e.parser, location)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	offsets := []Labor{}
-	position := int64(0)
-	for id := 0; id < maxWorkers-1; id++ {
-		cursor := position + chunkSize
-		targetFile.Seek(cursor, 0)
-		for {
-			buf := make([]byte, 1)
-			_, err := targetFile.ReadAt(buf, cursor)
+// write - Write the entries of the last line parsed, this is a single
+// entry except for domain suffix indexes which have one entry per parent
+// domain. Parent domains are strings so domain suffix keys do allocate.
+func (k *keyWriter) write(parser *entryParser, location int64) error {
+	indexfile.PutOffset(k.offset, location)
+	if k.suffixes != nil {
+		for _, suffix := range k.suffixes.Suffixes(string(parser.values[domainField])) {
+			err := k.writeEntry([]byte(suffix))
 			if err != nil {
-				panic(err)
-			}
-			if buf[0] == '\n' {
-				break
+				return err
 			}
-			cursor--
 		}
-		offsets = append(offsets, Labor{
-			Start: position,
-			Stop:  cursor,
-		})
-		position = cursor + 1
+		return nil
 	}
-
-	lastCursor := int64(0)
-	if 1 <= len(offsets) {
-		lastCursor = offsets[len(offsets)-1].Stop + 1
+	values := k.values[:0]
+	for _, field := range k.fields {
+		values = append(values, parser.values[field])
 	}
-	offsets = append(offsets, Labor{
-		Start: lastCursor,
-		Stop:  targetInfo.Size(),
-	})
+	return k.writeEntry(values...)
+}
 
-	return offsets, nil
+func (k *keyWriter) writeEntry(values ...[]byte) error {
+	_, err := k.output.Write(k.digester.Digest(values...))
+	if err != nil {
+		return err
+	}
+	_, err = k.output.Write(k.offset)
+	return err
 }
 
 // Indexer - The main indexer object
 type Indexer struct {
-	key        string
 	tmpDir     string
 	target     string
-	output     string
 	maxWorkers uint
 	workers    []*Worker
 	Offsets    []Labor
 	wg         *sync.WaitGroup
-	NoCleanup  bool
+	NoCleanup  bool // Keep the workers' files, and the partial output if indexing fails
+	FS         filesystem.FS
+	Indexes    []*KeyIndex
+	Header     *indexfile.Header  // Header of the first index
+	Suffixes   *publicsuffix.List // Public suffixes of domain suffix indexes
+	// MaxLineSize - Longer lines are skipped as malformed
+	MaxLineSize int
+	shard       uint16
 }
 
 // Count the lines processed
@@ -213,80 +300,191 @@ func (i *Indexer) Count() int {
 	return int(sum)
 }
 
-// Start the workers
+// Malformed - Number of malformed lines skipped and the offsets of the
+// first few
+func (i *Indexer) Malformed() (int, []int64) {
+	count := uint64(0)
+	offsets := []int64{}
+	for _, worker := range i.workers {
+		count += worker.Malformed
+		offsets = append(offsets, worker.MalformedOffsets...)
+	}
+	if maxMalformedOffsets < len(offsets) {
+		offsets = offsets[:maxMalformedOffsets] // Workers are in file order
+	}
+	return int(count), offsets
+}
+
+// Start the workers, the workers' files are removed and so is the output
+// if indexing fails, unless NoCleanup is set
 func (i *Indexer) Start() error {
-	err := os.MkdirAll(i.tmpDir, 0700)
+	if i.FS == nil {
+		i.FS = filesystem.OS
+	}
+	err := i.index()
+	if !i.NoCleanup {
+		i.FS.RemoveAll(i.tmpDir)
+		if err != nil {
+			for _, index := range i.Indexes {
+				i.FS.Remove(index.Output)
+			}
+		}
+	}
+	return err
+}
+
+func (i *Indexer) index() error {
+	err := i.FS.MkdirAll(i.tmpDir, 0700)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if !i.NoCleanup {
-			os.RemoveAll(i.tmpDir)
-		}
-	}()
 	for id := 0; id < int(i.maxWorkers); id++ {
 		i.wg.Add(1)
-		outputPath := filepath.Join(i.tmpDir, fmt.Sprintf("%d_%s", id, filepath.Base(i.output)))
+		outputPaths := []string{}
+		for n, index := range i.Indexes {
+			name := fmt.Sprintf("%d_%d_%s", id, n, filepath.Base(index.Output))
+			outputPaths = append(outputPaths, filepath.Join(i.tmpDir, name))
+		}
 		worker := &Worker{
-			ID:         id,
-			Wg:         i.wg,
-			TargetPath: i.target,
-			OutputPath: outputPath,
-			Labor:      i.Offsets[id],
+			ID:          id,
+			Wg:          i.wg,
+			TargetPath:  i.target,
+			OutputPaths: outputPaths,
+			Labor:       i.Offsets[id],
+			Indexes:     i.Indexes,
+			Suffixes:    i.Suffixes,
+			Shard:       i.shard,
+			MaxLineSize: i.MaxLineSize,
+			FS:          i.FS,
 		}
-		worker.start(i.key)
+		worker.start()
 		i.workers = append(i.workers, worker)
 	}
 	i.wg.Wait()
+	for _, worker := range i.workers {
+		if worker.Err != nil {
+			return worker.Err
+		}
+	}
 	return i.mergeIndexes()
 }
 
 func (i *Indexer) mergeIndexes() error {
-	outputFile, err := os.Create(i.output)
+	for n, index := range i.Indexes {
+		err := i.mergeIndex(n, index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeIndex - Concatenate the workers' parts of the nth index
+func (i *Indexer) mergeIndex(n int, index *KeyIndex) error {
+	outputFile, err := i.FS.Create(index.Output)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		outputFile.Close()
-	}()
-
-	indexFiles, err := ioutil.ReadDir(i.tmpDir)
+	defer outputFile.Close()
+	err = index.Header.Write(outputFile)
 	if err != nil {
 		return err
 	}
 
-	for _, indexFile := range indexFiles {
-		if !strings.HasSuffix(indexFile.Name(), filepath.Base(i.output)) {
-			continue
-		}
-		inFile := filepath.Join(i.tmpDir, indexFile.Name())
-		in, err := os.Open(inFile)
+	for _, worker := range i.workers {
+		err = i.copyIndex(outputFile, worker.OutputPaths[n])
 		if err != nil {
 			return err
 		}
-		io.Copy(outputFile, in)
-		if !i.NoCleanup {
-			os.Remove(inFile)
-		}
 	}
+	return outputFile.Close()
+}
+
+// copyIndex - Append a worker's index to the output
+func (i *Indexer) copyIndex(outputFile io.Writer, inFile string) error {
+	in, err := i.FS.Open(inFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(outputFile, in)
+	if err != nil {
+		return err
+	}
+	if !i.NoCleanup {
+		i.FS.Remove(inFile)
+	}
+	return nil
+}
+
+// SetShard - Create a sharded index, the target must be the shard's JSON
+// file. Sharded indexes of a dataset can be merged once they are sorted.
+func (i *Indexer) SetShard(shard *indexfile.Shard) error {
+	if shard.Size != i.Header.SourceSize || shard.Checksum != i.Header.SourceChecksum {
+		return fmt.Errorf("%s is not shard %d (%s)", i.target, shard.ID, shard.Path)
+	}
+	for _, index := range i.Indexes {
+		index.Header.SetShard(shard)
+	}
+	i.shard = shard.ID
 	return nil
 }
 
-// GetIndexer - Get an indexer
-func GetIndexer(target, output, key string, maxWorkers uint, tmpDir string, noCleanup bool) (*Indexer, error) {
+// GetIndexer - Get an indexer, digestSize is in bytes
+func GetIndexer(target, output, key string, digestSize int, maxWorkers uint, tmpDir string, noCleanup bool) (*Indexer, error) {
+	return GetMultiIndexer(target, []string{output}, []string{key}, digestSize, maxWorkers, tmpDir, noCleanup)
+}
+
+// GetMultiIndexer - Get an indexer that creates the index of each key in
+// one pass over the target, outputs[n] is the index of keys[n]
+func GetMultiIndexer(target string, outputs []string, keys []string, digestSize int, maxWorkers uint, tmpDir string, noCleanup bool) (*Indexer, error) {
+	if len(keys) == 0 || len(keys) != len(outputs) {
+		return nil, fmt.Errorf("Expected an output for each of %d key(s), got %d", len(keys), len(outputs))
+	}
+	indexes := []*KeyIndex{}
+	for n, key := range keys {
+		fields, err := indexfile.ParseKey(key)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.Join(fields, indexfile.KeyFieldSeparator)
+		header, err := indexfile.New(key, digestSize, target)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, &KeyIndex{Header: header, Output: outputs[n], fields: fields})
+	}
+	return newIndexer(target, indexes, maxWorkers, tmpDir, noCleanup)
+}
+
+// GetOrderedIndexer - Get an indexer for an ordered index of a single
+// field, prefixSize is in bytes
+func GetOrderedIndexer(target, output, key string, prefixSize int, maxWorkers uint, tmpDir string, noCleanup bool) (*Indexer, error) {
+	header, err := indexfile.NewOrdered(key, prefixSize, target)
+	if err != nil {
+		return nil, err
+	}
+	index := &KeyIndex{Header: header, Output: output, fields: []string{key}}
+	return newIndexer(target, []*KeyIndex{index}, maxWorkers, tmpDir, noCleanup)
+}
+
+func newIndexer(target string, indexes []*KeyIndex, maxWorkers uint, tmpDir string, noCleanup bool) (*Indexer, error) {
 	var err error
 	if maxWorkers < 1 {
 		maxWorkers = 1
 	}
 	var wg sync.WaitGroup
 	indexer := &Indexer{
-		key:        key,
-		target:     target,
-		output:     output,
-		NoCleanup:  noCleanup,
-		maxWorkers: maxWorkers,
-		workers:    []*Worker{},
-		wg:         &wg,
+		target:      target,
+		NoCleanup:   noCleanup,
+		maxWorkers:  maxWorkers,
+		workers:     []*Worker{},
+		wg:          &wg,
+		Indexes:     indexes,
+		Header:      indexes[0].Header,
+		Suffixes:    publicsuffix.Default(),
+		MaxLineSize: DefaultMaxLineSize,
+		FS:          filesystem.OS,
 	}
 	indexer.Offsets, err = divisionOfLabor(target, int(maxWorkers))
 	if err != nil {
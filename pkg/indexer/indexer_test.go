@@ -1,12 +1,25 @@
 package indexer
 
 import (
+	"bufio"
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/moloch--/leakdb/internal/testutil"
+	"github.com/moloch--/leakdb/pkg/filesystem"
+	"github.com/moloch--/leakdb/pkg/indexfile"
 )
 
 func testIndex(t *testing.T, input string, key string, expectedSize int) {
+	testIndexDigest(t, input, key, 8, expectedSize)
+}
+
+func testIndexDigest(t *testing.T, input string, key string, digestSize int, expectedSize int) {
 	output, err := ioutil.TempFile("", "output.idx")
 	if err != nil {
 		t.Errorf("temp file error %s", err)
@@ -21,12 +34,15 @@ func testIndex(t *testing.T, input string, key string, expectedSize int) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	indexer, err := GetIndexer(input, output.Name(), key, 1, tempDir, false)
+	indexer, err := GetIndexer(input, output.Name(), key, digestSize, 1, tempDir, false)
 	if err != nil {
 		t.Errorf("Index compute error: %s\n", err)
 		return
 	}
-	indexer.Start()
+	if err = indexer.Start(); err != nil {
+		t.Errorf("Index error: %s\n", err)
+		return
+	}
 
 	output.Seek(0, 0)
 	fileInfo, err := output.Stat()
@@ -34,12 +50,22 @@ func testIndex(t *testing.T, input string, key string, expectedSize int) {
 		t.Errorf("Output file state: %s\n", err)
 		return
 	}
-	if fileInfo.Size()%entrySize != 0 {
-		t.Errorf("Irregular output file modulo: %d\n", fileInfo.Size()%entrySize)
+	header, err := indexfile.Read(output)
+	if err != nil {
+		t.Errorf("Header read error: %s\n", err)
 		return
 	}
-	if fileInfo.Size()/entrySize != int64(expectedSize) {
-		t.Errorf("Irregular output file size: %d\n", fileInfo.Size()/entrySize)
+	if header.Key != key || header.DigestSize != digestSize || header.Verify(input) != nil {
+		t.Errorf("Unexpected header: %v\n", header)
+		return
+	}
+	entrySize := int64(header.EntrySize())
+	if (fileInfo.Size()-header.Size())%entrySize != 0 {
+		t.Errorf("Irregular output file modulo: %d\n", (fileInfo.Size()-header.Size())%entrySize)
+		return
+	}
+	if header.NumberOfEntries(fileInfo.Size()) != expectedSize {
+		t.Errorf("Irregular output file size: %d\n", header.NumberOfEntries(fileInfo.Size()))
 		return
 	}
 }
@@ -67,3 +93,235 @@ func TestIndexerSmallDomain(t *testing.T) {
 func TestIndexerLargeDomain(t *testing.T) {
 	testIndex(t, "../../test/large-bloomed.json", "domain", 8000)
 }
+
+func TestIndexerDigestSizes(t *testing.T) {
+	testIndexDigest(t, "../../test/small-bloomed.json", "email", 6, 50)
+	testIndexDigest(t, "../../test/small-bloomed.json", "email", 12, 50)
+}
+
+func TestIndexerInvalid(t *testing.T) {
+	_, err := GetIndexer("../../test/small-bloomed.json", "", "email", 7, 1, "", false)
+	if err == nil {
+		t.Error("Expected invalid digest size error")
+	}
+	_, err = GetIndexer("../../test/small-bloomed.json", "", "phone", 8, 1, "", false)
+	if err == nil {
+		t.Error("Expected invalid key error")
+	}
+}
+
+func TestIndexerComposite(t *testing.T) {
+	testIndex(t, "../../test/small-bloomed.json", "email+password", 50)
+
+	indexer, err := GetIndexer("../../test/small-bloomed.json", "", "password+email", 8, 1, "", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if indexer.Header.Key != "email+password" {
+		t.Errorf("Expected canonical key, got '%s'", indexer.Header.Key)
+		return
+	}
+	output := &bytes.Buffer{}
+	writer := bufio.NewWriter(output)
+	entries := newEntryWriter(indexer.Indexes, []*bufio.Writer{writer}, nil, 0)
+	err = entries.write([]byte(`{"password": "hunter2", "user": "a", "email": "a@example.com"}`), 0)
+	writer.Flush()
+	if err != nil || !bytes.Equal(output.Bytes()[:8], indexer.Header.Digest("a@example.com\x00hunter2")) {
+		t.Errorf("Unexpected composite entry %x (%v)", output.Bytes(), err)
+		return
+	}
+	_, err = GetIndexer("../../test/small-bloomed.json", "", "email+email", 8, 1, "", false)
+	if err == nil {
+		t.Error("Expected duplicate field error")
+	}
+}
+
+func TestIndexerDomainSuffix(t *testing.T) {
+	// No subdomains, one entry per line
+	testIndex(t, "../../test/small-bloomed.json", indexfile.DomainSuffixKey, 50)
+
+	input, err := ioutil.TempFile("", "subdomains.json")
+	if err != nil {
+		t.Errorf("temp file error %s", err)
+		return
+	}
+	defer os.Remove(input.Name())
+	input.WriteString(`{"email": "a@mail.example.com", "user": "a", "domain": "mail.example.com", "password": "a"}` + "\n")
+	input.WriteString(`{"email": "b@corp.example.co.uk", "user": "b", "domain": "corp.example.co.uk", "password": "b"}` + "\n")
+	input.WriteString(`{"email": "c@co.uk", "user": "c", "domain": "co.uk", "password": "c"}` + "\n")
+	input.Close()
+
+	// mail.example.com, example.com, corp.example.co.uk, example.co.uk, co.uk
+	testIndex(t, input.Name(), indexfile.DomainSuffixKey, 5)
+
+	_, err = GetIndexer(input.Name(), "", "domain-suffix+email", 8, 1, "", false)
+	if err == nil {
+		t.Error("Expected composite domain-suffix error")
+	}
+}
+
+func TestIndexerOrdered(t *testing.T) {
+	indexer, err := GetOrderedIndexer("../../test/small-bloomed.json", "", "user", indexfile.DefaultPrefixSize, 1, "", false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !indexer.Header.IsOrdered() || indexer.Header.DigestSize != indexfile.DefaultPrefixSize {
+		t.Errorf("Unexpected ordered header %v", indexer.Header)
+		return
+	}
+	for _, key := range []string{"email+password", indexfile.DomainSuffixKey} {
+		if _, err = GetOrderedIndexer("../../test/small-bloomed.json", "", key, indexfile.DefaultPrefixSize, 1, "", false); err == nil {
+			t.Errorf("Expected an error for ordered key '%s'", key)
+			return
+		}
+	}
+}
+
+func TestIndexerWriteFailure(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	output := filepath.Join(tempDir, "email.idx")
+	tests := []struct {
+		name      string
+		match     func(name string) bool
+		noCleanup bool
+	}{
+		{"worker", func(name string) bool { return name != output }, false},
+		{"output", func(name string) bool { return name == output }, false},
+		{"no cleanup", func(name string) bool { return name == output }, true},
+	}
+	for _, test := range tests {
+		indexer, err := GetIndexer("../../test/large-bloomed.json", output, "email", 8, 4, tempDir, test.noCleanup)
+		if err != nil {
+			t.Errorf("Index compute error: %s\n", err)
+			return
+		}
+		indexer.FS = &testutil.Faulty{FS: filesystem.OS, Match: test.match, Limit: 1000}
+		err = indexer.Start()
+		if err != testutil.ErrNoSpace {
+			t.Errorf("%s: expected %v, got %v", test.name, testutil.ErrNoSpace, err)
+			return
+		}
+		_, outputErr := os.Stat(output)
+		_, tmpErr := os.Stat(indexer.tmpDir)
+		if (outputErr == nil) != test.noCleanup || (tmpErr == nil) != test.noCleanup {
+			t.Errorf("%s: expected output and worker files to exist %v, got %v %v", test.name, test.noCleanup, outputErr, tmpErr)
+			return
+		}
+		os.Remove(output)
+		os.RemoveAll(indexer.tmpDir)
+	}
+}
+
+func TestIndexerMultiKey(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := "../../test/large-bloomed.json"
+	keys := []string{"email", "user", indexfile.DomainSuffixKey, "password+email"}
+	outputs := []string{}
+	for _, key := range keys {
+		outputs = append(outputs, filepath.Join(tempDir, key+"-multi.idx"))
+	}
+	indexer, err := GetMultiIndexer(input, outputs, keys, 8, 4, tempDir, false)
+	if err != nil {
+		t.Errorf("Index compute error: %s\n", err)
+		return
+	}
+	if err = indexer.Start(); err != nil {
+		t.Errorf("Index error: %s\n", err)
+		return
+	}
+	if indexer.Count() != 8000 {
+		t.Errorf("Expected one pass of 8000 lines, got %d", indexer.Count())
+		return
+	}
+
+	// Each index is identical to the index of its key on its own
+	for n, key := range keys {
+		output := filepath.Join(tempDir, key+".idx")
+		single, err := GetIndexer(input, output, key, 8, 4, tempDir, false)
+		if err != nil {
+			t.Errorf("Index compute error: %s\n", err)
+			return
+		}
+		if err = single.Start(); err != nil {
+			t.Errorf("Index error: %s\n", err)
+			return
+		}
+		expected, _ := ioutil.ReadFile(output)
+		data, _ := ioutil.ReadFile(outputs[n])
+		if len(data) == 0 || !bytes.Equal(data, expected) {
+			t.Errorf("%s index of a multi-key pass differs (%d bytes, expected %d)", key, len(data), len(expected))
+			return
+		}
+	}
+
+	_, err = GetMultiIndexer(input, outputs[:1], keys, 8, 4, tempDir, false)
+	if err == nil {
+		t.Error("Expected an error for missing outputs")
+	}
+}
+
+func TestIndexerMalformed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	lines := []string{
+		`{"email": "a@example.com", "user": "a", "domain": "example.com", "password": "a"}`,
+		`{"email": "truncated@example.com", "user": "tr`,
+		`{"email": "b@example.com", "user": "b", "domain": "example.com", "password": "b"}`,
+		``,
+		`not json`,
+		`{"email": "c@example.com", "user": "c", "domain": "example.com", "password": "c"}`,
+	}
+	input := filepath.Join(tempDir, "malformed.json")
+	ioutil.WriteFile(input, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	expected := []int64{}
+	offset := 0
+	for number, line := range lines {
+		if number == 1 || number == 3 || number == 4 {
+			expected = append(expected, int64(offset))
+		}
+		offset += len(line) + 1
+	}
+
+	output := filepath.Join(tempDir, "email.idx")
+	indexer, err := GetIndexer(input, output, "email", 8, 2, tempDir, false)
+	if err != nil {
+		t.Errorf("Index compute error: %s\n", err)
+		return
+	}
+	if err = indexer.Start(); err != nil {
+		t.Errorf("Index error: %s\n", err)
+		return
+	}
+	count, offsets := indexer.Malformed()
+	if count != len(expected) || !reflect.DeepEqual(offsets, expected) {
+		t.Errorf("Expected %d malformed lines at %v, got %d at %v", len(expected), expected, count, offsets)
+		return
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Errorf("Output error: %s", err)
+		return
+	}
+	if entries := indexer.Header.NumberOfEntries(info.Size()); entries != 3 {
+		t.Errorf("Expected 3 entries, got %d", entries)
+	}
+}
@@ -0,0 +1,151 @@
+package indexer
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Lines of a JSON file and the exact offset each one starts at. Offsets
+	count every byte read, including "\r\n" line endings, so they are
+	correct for any line ending. The file is split between workers at line
+	starts so every line is indexed by exactly one worker.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	lineBufSize = 64 * kb
+
+	// DefaultMaxLineSize - Lines longer than this are skipped as malformed
+	DefaultMaxLineSize = 16 * mb
+)
+
+var (
+	errLineTooLong = errors.New("Line is too long")
+)
+
+// lineReader - Reads lines and counts the bytes of each one, lines that
+// fit in the buffer are returned without copying
+type lineReader struct {
+	reader      *bufio.Reader
+	offset      int64 // Offset of the next line
+	maxLineSize int
+	long        []byte // Lines longer than the buffer
+}
+
+func newLineReader(reader io.Reader, offset int64, maxLineSize int) *lineReader {
+	return &lineReader{
+		reader:      bufio.NewReaderSize(reader, lineBufSize),
+		offset:      offset,
+		maxLineSize: maxLineSize,
+	}
+}
+
+// next - Read the next line without its line ending and the offset it
+// starts at. The line is valid until the next call. Lines longer than
+// maxLineSize are read past and returned as errLineTooLong, the end of the
+// file is io.EOF.
+func (r *lineReader) next() ([]byte, int64, error) {
+	offset := r.offset
+	r.long = r.long[:0]
+	tooLong := false
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		r.offset += int64(len(chunk))
+		if r.maxLineSize < int(r.offset-offset) {
+			tooLong = true
+		}
+		if err == bufio.ErrBufferFull {
+			if !tooLong {
+				r.long = append(r.long, chunk...)
+			}
+			continue
+		}
+		if err == io.EOF && offset < r.offset {
+			err = nil // Last line without a line ending
+		}
+		if err != nil {
+			return nil, offset, err
+		}
+		if tooLong {
+			return nil, offset, errLineTooLong
+		}
+		line := chunk
+		if 0 < len(r.long) {
+			r.long = append(r.long, chunk...)
+			line = r.long
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), offset, nil
+	}
+}
+
+// lineStart - Offset of the first line that starts at or after offset, or
+// the size of the file if there is none
+func lineStart(file io.ReaderAt, offset int64, size int64) (int64, error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+	buf := make([]byte, lineBufSize)
+	for position := offset - 1; position < size; position += int64(len(buf)) {
+		n, err := file.ReadAt(buf, position)
+		if newline := bytes.IndexByte(buf[:n], '\n'); newline != -1 {
+			return position + int64(newline) + 1, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// divisionOfLabor - Split target into a part per worker, each part starts
+// at a line start and ends where the next one starts. Parts are empty if
+// there are more workers than lines, e.g. for tiny files or huge lines.
+func divisionOfLabor(target string, maxWorkers int) ([]Labor, error) {
+	targetFile, err := os.Open(target)
+	if err != nil {
+		return nil, err
+	}
+	defer targetFile.Close()
+	targetInfo, err := targetFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := targetInfo.Size()
+
+	labors := []Labor{}
+	start := int64(0)
+	for id := 1; id < maxWorkers; id++ {
+		stop, err := lineStart(targetFile, size*int64(id)/int64(maxWorkers), size)
+		if err != nil {
+			return nil, err
+		}
+		if stop < start {
+			stop = start // A line spans several parts
+		}
+		labors = append(labors, Labor{Start: start, Stop: stop})
+		start = stop
+	}
+	return append(labors, Labor{Start: start, Stop: size}), nil
+}
@@ -0,0 +1,272 @@
+package indexer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+type failingReader struct{}
+
+var errRead = errors.New("read error")
+
+func (failingReader) Read(buf []byte) (int, error) {
+	return 0, errRead
+}
+
+func TestLineReader(t *testing.T) {
+	long := `{"email": "` + strings.Repeat("a", 3*lineBufSize) + `"}`
+	lines := []struct {
+		line   string
+		ending string
+	}{
+		{"one", "\r\n"}, {"", "\n"}, {"two", "\n"}, {long, "\r\n"},
+		{strings.Repeat("b", len(long)+10), "\n"}, {"last", ""},
+	}
+	data := ""
+	for _, line := range lines {
+		data += line.line + line.ending
+	}
+	reader := newLineReader(strings.NewReader(data), 100, len(long)+2)
+	offset := int64(100)
+	for _, want := range lines {
+		line, lineOffset, err := reader.next()
+		if len(long)+2 < len(want.line) {
+			if err != errLineTooLong || lineOffset != offset {
+				t.Errorf("Expected %v at %d, got %v at %d", errLineTooLong, offset, err, lineOffset)
+				return
+			}
+		} else if err != nil || string(line) != want.line || lineOffset != offset {
+			t.Errorf("Line %.20q at %d (%v), expected %.20q at %d", line, lineOffset, err, want.line, offset)
+			return
+		}
+		offset += int64(len(want.line) + len(want.ending))
+	}
+	if _, _, err := reader.next(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+		return
+	}
+
+	reader = newLineReader(io.MultiReader(strings.NewReader("first\n"), failingReader{}), 0, DefaultMaxLineSize)
+	if line, _, err := reader.next(); err != nil || string(line) != "first" {
+		t.Errorf("Unexpected first line %q (%v)", line, err)
+		return
+	}
+	if _, _, err := reader.next(); err != errRead {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+}
+
+func TestDivisionOfLabor(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	long := strings.Repeat("x", 5*lineBufSize)
+	for _, data := range []string{"", "\n", "a", "a\n", "a\nb\nc\n", "a\r\nb", long + "\nb\n" + long, "\n\n\n\n\n\n"} {
+		target := filepath.Join(tempDir, "target.json")
+		ioutil.WriteFile(target, []byte(data), 0644)
+		for _, workers := range []int{1, 2, 3, 8, 64} {
+			labors, err := divisionOfLabor(target, workers)
+			if err != nil {
+				t.Errorf("%.10q with %d workers: %s", data, workers, err)
+				return
+			}
+			if len(labors) != workers || labors[0].Start != 0 || labors[workers-1].Stop != int64(len(data)) {
+				t.Errorf("%.10q with %d workers: labors %v do not cover the file", data, workers, labors)
+				return
+			}
+			for id, labor := range labors {
+				if labor.Stop < labor.Start || (0 < id && labor.Start != labors[id-1].Stop) {
+					t.Errorf("%.10q with %d workers: labors %v are not contiguous", data, workers, labors)
+					return
+				}
+				if 0 < labor.Start && labor.Start < int64(len(data)) && data[labor.Start-1] != '\n' {
+					t.Errorf("%.10q with %d workers: labor %v does not start at a line", data, workers, labor)
+					return
+				}
+			}
+		}
+	}
+}
+
+// randomLines - Lines of valid, empty, malformed, and huge entries with
+// LF and CRLF line endings
+func randomLines(random *rand.Rand) ([]string, []string) {
+	lines, endings := []string{}, []string{}
+	for n := random.Intn(40); 0 <= n; n-- {
+		var line string
+		switch random.Intn(10) {
+		case 0:
+			line = ""
+		case 1:
+			line = `{"email": "malformed`
+		case 2:
+			line = fmt.Sprintf(`{"email": "huge%d@example.com", "password": "%s"}`, n, strings.Repeat("p", lineBufSize+random.Intn(3*lineBufSize)))
+		default:
+			line = fmt.Sprintf(`{"email": "user%d@example.com", "user": "user%d", "password": "%d"}`, n, n, random.Int())
+		}
+		ending := "\n"
+		if random.Intn(2) == 0 {
+			ending = "\r\n"
+		}
+		lines = append(lines, line)
+		endings = append(endings, ending)
+	}
+	if random.Intn(3) == 0 && lines[len(lines)-1] != "" {
+		endings[len(endings)-1] = "" // No line ending at the end of the file
+	}
+	return lines, endings
+}
+
+func TestIndexerOffsets(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	random := rand.New(rand.NewSource(1))
+	for iteration := 0; iteration < 50; iteration++ {
+		lines, endings := randomLines(random)
+		data := &bytes.Buffer{}
+		valid := map[int64]string{}
+		malformed := 0
+		parser := &entryParser{}
+		for n, line := range lines {
+			if parser.parse([]byte(line)) == nil {
+				valid[int64(data.Len())] = string(parser.values[emailField])
+			} else {
+				malformed++
+			}
+			data.WriteString(line + endings[n])
+		}
+		target := filepath.Join(tempDir, "target.json")
+		ioutil.WriteFile(target, data.Bytes(), 0644)
+
+		output := filepath.Join(tempDir, "email.idx")
+		workers := uint(1 + random.Intn(8))
+		indexer, err := GetIndexer(target, output, "email", 8, workers, tempDir, false)
+		if err != nil {
+			t.Errorf("Index compute error: %s\n", err)
+			return
+		}
+		if err = indexer.Start(); err != nil {
+			t.Errorf("Index error: %s\n", err)
+			return
+		}
+		if indexer.Count() != len(lines) {
+			t.Errorf("Iteration %d: counted %d lines, expected %d", iteration, indexer.Count(), len(lines))
+			return
+		}
+		if count, _ := indexer.Malformed(); count != malformed {
+			t.Errorf("Iteration %d: %d malformed lines, expected %d", iteration, count, malformed)
+			return
+		}
+
+		// Every entry is at the start of a valid line, and every valid line
+		// has exactly one entry
+		index, _ := ioutil.ReadFile(output)
+		header := indexer.Header
+		entries := index[header.Size():]
+		seen := map[int64]bool{}
+		for position := 0; position < len(entries); position += header.EntrySize() {
+			digest := entries[position : position+header.DigestSize]
+			offset := indexfile.Offset(entries[position+header.DigestSize : position+header.EntrySize()])
+			email, ok := valid[offset]
+			if !ok || (0 < offset && data.Bytes()[offset-1] != '\n') {
+				t.Errorf("Iteration %d (%d workers): offset %d is not the start of a valid line", iteration, workers, offset)
+				return
+			}
+			if !bytes.Equal(digest, header.Digest(email)) || seen[offset] {
+				t.Errorf("Iteration %d: entry at offset %d is a duplicate or has the wrong digest", iteration, offset)
+				return
+			}
+			seen[offset] = true
+		}
+		if len(seen) != len(valid) {
+			t.Errorf("Iteration %d: %d entries, expected %d", iteration, len(seen), len(valid))
+			return
+		}
+	}
+}
+
+func TestIndexerTinyFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	line := `{"email": "a@example.com", "user": "a", "domain": "example.com", "password": "a"}`
+	tests := []struct {
+		data    string
+		entries int
+	}{
+		{"", 0}, {"\n", 0}, {line, 1}, {line + "\r\n", 1}, {"\n" + line + "\n\n", 1},
+	}
+	for _, test := range tests {
+		data, entries := test.data, test.entries
+		target := filepath.Join(tempDir, "tiny.json")
+		ioutil.WriteFile(target, []byte(data), 0644)
+		output := filepath.Join(tempDir, "email.idx")
+		indexer, err := GetIndexer(target, output, "email", 8, 16, tempDir, false)
+		if err != nil {
+			t.Errorf("Index compute error: %s\n", err)
+			return
+		}
+		if err = indexer.Start(); err != nil {
+			t.Errorf("Index error: %s\n", err)
+			return
+		}
+		info, err := os.Stat(output)
+		if err != nil || indexer.Header.NumberOfEntries(info.Size()) != entries {
+			t.Errorf("%q: expected %d entries (%v)", data, entries, err)
+			return
+		}
+	}
+}
+
+func TestIndexerMaxLineSize(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	short := `{"email": "a@example.com"}`
+	long := `{"email": "b@example.com", "password": "` + strings.Repeat("p", 2*lineBufSize) + `"}`
+	target := filepath.Join(tempDir, "long.json")
+	ioutil.WriteFile(target, []byte(short+"\n"+long+"\n"+short+"\n"), 0644)
+
+	output := filepath.Join(tempDir, "email.idx")
+	indexer, err := GetIndexer(target, output, "email", 8, 1, tempDir, false)
+	if err != nil {
+		t.Errorf("Index compute error: %s\n", err)
+		return
+	}
+	indexer.MaxLineSize = lineBufSize
+	if err = indexer.Start(); err != nil {
+		t.Errorf("Index error: %s\n", err)
+		return
+	}
+	count, offsets := indexer.Malformed()
+	if count != 1 || len(offsets) != 1 || offsets[0] != int64(len(short)+1) {
+		t.Errorf("Expected the long line to be skipped, got %d at %v", count, offsets)
+	}
+}
@@ -0,0 +1,183 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	A fence file is a sidecar of a sorted index that records where each
+	16-bit digest prefix starts, so a search only has to read one bucket:
+
+	[magic 4][prefix bits 1][version 1][reserved 2][number of entries 8]
+	[index checksum 4][reserved 4]
+	[start of bucket 0 8] ... [start of bucket 65535 8][number of entries 8]
+
+	The number of entries and index checksum are the ID of the index the
+	fence was written for (see sidecar.go).
+
+	Prefixes are the most significant bits of the digest in sort order,
+	i.e. the last two bytes since digests are compared as little endian.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// FenceMagic - First bytes of every fence file
+	FenceMagic = "LKFN"
+	// FenceExt - Extension appended to the index path
+	FenceExt = ".fence"
+	// FenceBits - Number of prefix bits per bucket
+	FenceBits = 16
+	// FenceBuckets - Number of buckets in a fence
+	FenceBuckets = 1 << FenceBits
+	// FenceVersion - Current fence format version
+	FenceVersion = 1
+
+	fenceHeaderSize = 24
+)
+
+// Fence - Start position (in entries) of each digest prefix in a sorted index
+type Fence struct {
+	NumberOfEntries int
+	// IndexChecksum - Checksum of the IndexID the fence was written for
+	IndexChecksum uint32
+	starts        []uint64 // FenceBuckets+1, the last is NumberOfEntries
+}
+
+// FencePath - Path of the fence sidecar of an index
+func FencePath(index string) string {
+	return index + FenceExt
+}
+
+// FenceBucket - The bucket a digest belongs to
+func FenceBucket(digest []byte) int {
+	return int(digest[len(digest)-1])<<8 | int(digest[len(digest)-2])
+}
+
+// Range - Entries in [lower, upper) are the only ones that can match digest
+func (f *Fence) Range(digest []byte) (int, int) {
+	bucket := FenceBucket(digest)
+	return int(f.starts[bucket]), int(f.starts[bucket+1])
+}
+
+// WriteTo - Encode the fence
+func (f *Fence) WriteTo(writer io.Writer) (int64, error) {
+	buf := make([]byte, fenceHeaderSize+8*len(f.starts))
+	copy(buf, FenceMagic)
+	buf[4] = FenceBits
+	buf[5] = FenceVersion
+	binary.LittleEndian.PutUint64(buf[8:], uint64(f.NumberOfEntries))
+	binary.LittleEndian.PutUint32(buf[16:], f.IndexChecksum)
+	for index, start := range f.starts {
+		binary.LittleEndian.PutUint64(buf[fenceHeaderSize+8*index:], start)
+	}
+	written, err := writer.Write(buf)
+	return int64(written), err
+}
+
+// WriteFile - Write the fence to path
+func (f *Fence) WriteFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteTo(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadFence - Read a fence, it must have been written for the index with id
+// otherwise it is stale
+func ReadFence(reader io.Reader, id *IndexID) (*Fence, error) {
+	buf := make([]byte, fenceHeaderSize+8*(FenceBuckets+1))
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	if string(buf[:len(FenceMagic)]) != FenceMagic || buf[4] != FenceBits {
+		return nil, errors.New("Invalid fence header")
+	}
+	if buf[5] != FenceVersion {
+		return nil, fmt.Errorf("Unsupported fence version %d", buf[5])
+	}
+	fence := &Fence{
+		NumberOfEntries: int(binary.LittleEndian.Uint64(buf[8:])),
+		IndexChecksum:   binary.LittleEndian.Uint32(buf[16:]),
+		starts:          make([]uint64, FenceBuckets+1),
+	}
+	err = id.check("Fence", fence.NumberOfEntries, fence.IndexChecksum)
+	if err != nil {
+		return nil, err
+	}
+	previous := uint64(0)
+	for index := range fence.starts {
+		fence.starts[index] = binary.LittleEndian.Uint64(buf[fenceHeaderSize+8*index:])
+		if fence.starts[index] < previous {
+			return nil, errors.New("Fence is not sorted")
+		}
+		previous = fence.starts[index]
+	}
+	if fence.starts[FenceBuckets] != uint64(fence.NumberOfEntries) {
+		return nil, errors.New("Fence does not end at the last entry")
+	}
+	return fence, nil
+}
+
+// ReadFenceFile - Read the fence at path
+func ReadFenceFile(path string, id *IndexID) (*Fence, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFence(bufio.NewReader(file), id)
+}
+
+// FenceBuilder - Builds a fence from the digests of a sorted index, in order
+type FenceBuilder struct {
+	counts []uint64
+}
+
+// NewFenceBuilder - Create an empty fence builder
+func NewFenceBuilder() *FenceBuilder {
+	return &FenceBuilder{counts: make([]uint64, FenceBuckets)}
+}
+
+// Add - Add the next digest of the index
+func (b *FenceBuilder) Add(digest []byte) {
+	b.counts[FenceBucket(digest)]++
+}
+
+// Fence - The fence of all digests added so far
+func (b *FenceBuilder) Fence() *Fence {
+	fence := &Fence{starts: make([]uint64, FenceBuckets+1)}
+	total := uint64(0)
+	for bucket, count := range b.counts {
+		fence.starts[bucket] = total
+		total += count
+	}
+	fence.starts[FenceBuckets] = total
+	fence.NumberOfEntries = int(total)
+	return fence
+}
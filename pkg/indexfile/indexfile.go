@@ -0,0 +1,322 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Index files start with a fixed size header followed by the entries:
+
+	[magic 4][version 2][digest size 1][offset size 1][key 32]
+	[source size 8][source checksum 4][type 1][reserved 11] = 64 bytes
+
+	[digest][48-bit offset] = one entry
+
+	Offsets are 48-bit or 64-bit for sharded indexes (see manifest.go).
+
+	The type is 0 for digest indexes and 1 for ordered indexes, which
+	store a prefix of the value in place of the digest (see ordered.go).
+
+	Indexes created before the header existed have no header and always
+	use a 48-bit digest, these are read as version 0 "legacy" indexes.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	// Magic - First bytes of every index file with a header
+	Magic = "LKDB"
+	// Version - Current index format version
+	Version = 1
+	// HeaderSize - Size of the header in bytes
+	HeaderSize = 64
+
+	// LegacyDigestSize - Digest size of indexes without a header
+	LegacyDigestSize = 6
+	// OffsetSize - 48-bit offsets into the JSON file
+	OffsetSize = 6
+
+	maxKeySize = 32
+
+	// Only the head and tail of the source are hashed, these files can be
+	// terabytes in size so hashing the entire file is not practical
+	checksumSampleSize = 1024 * 1024
+)
+
+var (
+	// DigestSizes - Valid digest sizes in bytes (48, 64, and 96-bit)
+	DigestSizes = []int{6, 8, 12}
+
+	// ErrSourceMismatch - Index was not created from the JSON file
+	ErrSourceMismatch = errors.New("Index does not match the JSON file")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Header - Describes the layout of an index file
+type Header struct {
+	Version        uint16
+	DigestSize     int
+	OffsetSize     int
+	Key            string
+	SourceSize     int64
+	SourceChecksum uint32
+	Type           uint8
+}
+
+// Size - Size of the header on disk, legacy indexes have no header
+func (h *Header) Size() int64 {
+	if h.IsLegacy() {
+		return 0
+	}
+	return HeaderSize
+}
+
+// EntrySize - Size of a single entry in bytes
+func (h *Header) EntrySize() int {
+	return h.DigestSize + h.OffsetSize
+}
+
+// IsLegacy - Index was created before headers existed
+func (h *Header) IsLegacy() bool {
+	return h.Version == 0
+}
+
+// NumberOfEntries - Number of entries in an index file of fileSize bytes
+func (h *Header) NumberOfEntries(fileSize int64) int {
+	return int((fileSize - h.Size()) / int64(h.EntrySize()))
+}
+
+// Position - File position of the entry at index
+func (h *Header) Position(index int) int64 {
+	return h.Size() + int64(index)*int64(h.EntrySize())
+}
+
+// Verify - Check that source is the JSON file the index was created from,
+// legacy indexes do not record their source so they cannot be checked
+func (h *Header) Verify(source string) error {
+	if h.IsLegacy() {
+		return nil
+	}
+	size, checksum, err := Checksum(source)
+	if err != nil {
+		return err
+	}
+	if size != h.SourceSize || checksum != h.SourceChecksum {
+		return ErrSourceMismatch
+	}
+	return nil
+}
+
+// MarshalBinary - Encode the header
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if maxKeySize < len(h.Key) {
+		return nil, fmt.Errorf("Key name '%s' is too long", h.Key)
+	}
+	buf := make([]byte, HeaderSize)
+	copy(buf, Magic)
+	binary.LittleEndian.PutUint16(buf[4:], h.Version)
+	buf[6] = byte(h.DigestSize)
+	buf[7] = byte(h.OffsetSize)
+	copy(buf[8:8+maxKeySize], h.Key)
+	binary.LittleEndian.PutUint64(buf[40:], uint64(h.SourceSize))
+	binary.LittleEndian.PutUint32(buf[48:], h.SourceChecksum)
+	buf[52] = h.Type
+	return buf, nil
+}
+
+// UnmarshalBinary - Decode a header
+func (h *Header) UnmarshalBinary(buf []byte) error {
+	if len(buf) < HeaderSize || string(buf[:len(Magic)]) != Magic {
+		return errors.New("Invalid index header")
+	}
+	h.Version = binary.LittleEndian.Uint16(buf[4:])
+	if Version < h.Version {
+		return fmt.Errorf("Unsupported index version %d", h.Version)
+	}
+	h.DigestSize = int(buf[6])
+	h.OffsetSize = int(buf[7])
+	h.Key = string(bytes.TrimRight(buf[8:8+maxKeySize], "\x00"))
+	h.SourceSize = int64(binary.LittleEndian.Uint64(buf[40:]))
+	h.SourceChecksum = binary.LittleEndian.Uint32(buf[48:])
+	h.Type = buf[52]
+	if h.OffsetSize != OffsetSize && h.OffsetSize != ShardedOffsetSize {
+		return fmt.Errorf("Unsupported offset size %d", h.OffsetSize)
+	}
+	switch h.Type {
+	case TypeDigest:
+		return ValidDigestSize(h.DigestSize)
+	case TypeOrdered:
+		return ValidPrefixSize(h.DigestSize)
+	}
+	return fmt.Errorf("Unsupported index type %d", h.Type)
+}
+
+// Write - Write the header, nothing is written for legacy headers
+func (h *Header) Write(writer io.Writer) error {
+	if h.IsLegacy() {
+		return nil
+	}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(buf)
+	return err
+}
+
+// Legacy - The implicit header of an index without one
+func Legacy() *Header {
+	return &Header{
+		Version:    0,
+		DigestSize: LegacyDigestSize,
+		OffsetSize: OffsetSize,
+	}
+}
+
+// New - Create a header for an index of key over the source JSON file
+func New(key string, digestSize int, source string) (*Header, error) {
+	err := ValidDigestSize(digestSize)
+	if err != nil {
+		return nil, err
+	}
+	if maxKeySize < len(key) {
+		return nil, fmt.Errorf("Key name '%s' is too long", key)
+	}
+	size, checksum, err := Checksum(source)
+	if err != nil {
+		return nil, err
+	}
+	header := &Header{
+		Version:        Version,
+		DigestSize:     digestSize,
+		OffsetSize:     OffsetSize,
+		Key:            key,
+		SourceSize:     size,
+		SourceChecksum: checksum,
+	}
+	return header, nil
+}
+
+// Read - Read the header of an index file, files without a valid magic are
+// assumed to be legacy indexes
+func Read(reader io.ReaderAt) (*Header, error) {
+	buf := make([]byte, HeaderSize)
+	n, err := reader.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < len(Magic) || string(buf[:len(Magic)]) != Magic {
+		return Legacy(), nil
+	}
+	header := &Header{}
+	err = header.UnmarshalBinary(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// ReadFile - Read the header of the index file at path
+func ReadFile(path string) (*Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// ValidDigestSize - Returns an error if size is not a supported digest size
+func ValidDigestSize(size int) error {
+	for _, valid := range DigestSizes {
+		if size == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid digest size %d-bit, must be one of 48, 64, or 96", size*8)
+}
+
+// Checksum - Size and CRC-32C of the first and last MB of a file
+func Checksum(path string) (int64, uint32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+	hash := crc32.New(castagnoli)
+	head := io.NewSectionReader(file, 0, checksumSampleSize)
+	if _, err := io.Copy(hash, head); err != nil {
+		return 0, 0, err
+	}
+	if checksumSampleSize < size {
+		tailStart := size - checksumSampleSize
+		if tailStart < checksumSampleSize {
+			tailStart = checksumSampleSize
+		}
+		tail := io.NewSectionReader(file, tailStart, size-tailStart)
+		if _, err := io.Copy(hash, tail); err != nil {
+			return 0, 0, err
+		}
+	}
+	return size, hash.Sum32(), nil
+}
+
+// Digest - Truncated SHA-256 digest of value
+func Digest(value string, size int) []byte {
+	digest := sha256.Sum256([]byte(value))
+	return digest[:size]
+}
+
+// Compare - Compare two digests as little endian integers, this is the
+// order of entries in a sorted index
+func Compare(a, b []byte) int {
+	for index := len(a) - 1; 0 <= index; index-- {
+		if a[index] < b[index] {
+			return -1
+		}
+		if b[index] < a[index] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// PutOffset - Encode offset into buf
+func PutOffset(buf []byte, offset int64) {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], uint64(offset))
+	copy(buf, tmp[:len(buf)])
+}
+
+// Offset - Decode an offset
+func Offset(buf []byte) int64 {
+	var tmp [8]byte
+	copy(tmp[:], buf)
+	return int64(binary.LittleEndian.Uint64(tmp[:]))
+}
@@ -0,0 +1,460 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	smallJSON = "../../test/small-bloomed.json"
+	largeJSON = "../../test/large-bloomed.json"
+)
+
+func TestHeader(t *testing.T) {
+	header, err := New("email", 12, smallJSON)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buf := &bytes.Buffer{}
+	err = header.Write(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.Len() != HeaderSize || header.EntrySize() != 18 {
+		t.Errorf("Unexpected header size %d or entry size %d", buf.Len(), header.EntrySize())
+		return
+	}
+	parsed, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *parsed != *header {
+		t.Errorf("Header did not round trip %v != %v", parsed, header)
+		return
+	}
+	if err = parsed.Verify(smallJSON); err != nil {
+		t.Errorf("Verify failed: %s", err)
+		return
+	}
+	if err = parsed.Verify(largeJSON); err != ErrSourceMismatch {
+		t.Errorf("Expected %s, got %v", ErrSourceMismatch, err)
+		return
+	}
+
+	if _, err = New("email", 7, smallJSON); err == nil {
+		t.Error("Expected invalid digest size error")
+		return
+	}
+}
+
+func TestLegacyHeader(t *testing.T) {
+	header, err := ReadFile("../../test/small-email-sorted.idx")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !header.IsLegacy() || header.Size() != 0 || header.EntrySize() != 12 {
+		t.Errorf("Expected legacy header, got %v", header)
+		return
+	}
+	if header.NumberOfEntries(600) != 50 {
+		t.Errorf("Unexpected number of entries %d", header.NumberOfEntries(600))
+		return
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// Digests are compared as little endian integers
+	a := []byte{0xff, 0x00, 0x01}
+	b := []byte{0x00, 0x01, 0x01}
+	if Compare(a, b) != -1 || Compare(b, a) != 1 || Compare(a, a) != 0 {
+		t.Error("Unexpected digest order")
+	}
+
+	buf := make([]byte, OffsetSize)
+	PutOffset(buf, 1<<40+42)
+	if Offset(buf) != 1<<40+42 {
+		t.Errorf("Offset did not round trip (%d)", Offset(buf))
+	}
+}
+
+func TestFence(t *testing.T) {
+	digests := [][]byte{
+		{1, 0, 0, 0, 0x00, 0x00},
+		{2, 0, 0, 0, 0x00, 0x00},
+		{0, 0, 0, 0, 0x01, 0x00},
+		{0, 0, 0, 0, 0xff, 0x7f},
+		{9, 0, 0, 0, 0xff, 0xff},
+	}
+	builder := NewFenceBuilder()
+	for _, digest := range digests {
+		builder.Add(digest)
+	}
+	id := testIndexID(t, digests)
+	written := builder.Fence()
+	written.IndexChecksum = id.Checksum
+	buf := &bytes.Buffer{}
+	_, err := written.WriteTo(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = ReadFence(bytes.NewReader(buf.Bytes()), &IndexID{NumberOfEntries: 4, Checksum: id.Checksum}); err == nil {
+		t.Errorf("Expected error reading fence with the wrong number of entries")
+		return
+	}
+	other := testIndexID(t, append(append([][]byte{}, digests[1:]...), digests[0]))
+	if _, err = ReadFence(bytes.NewReader(buf.Bytes()), other); err == nil {
+		t.Errorf("Expected error reading the fence of a different index")
+		return
+	}
+	fence, err := ReadFence(bytes.NewReader(buf.Bytes()), id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := [][2]int{{0, 2}, {0, 2}, {2, 3}, {3, 4}, {4, 5}}
+	for index, digest := range digests {
+		lower, upper := fence.Range(digest)
+		if lower != expected[index][0] || upper != expected[index][1] {
+			t.Errorf("Range of %x is [%d, %d) expected %v", digest, lower, upper, expected[index])
+			return
+		}
+	}
+	lower, upper := fence.Range([]byte{0, 0, 0, 0, 0x00, 0x01})
+	if lower != upper {
+		t.Errorf("Expected empty range for missing prefix, got [%d, %d)", lower, upper)
+	}
+}
+
+// testIndexID - The ID of a legacy index of digests
+func testIndexID(t *testing.T, digests [][]byte) *IndexID {
+	index := []byte{}
+	for n, digest := range digests {
+		entry := make([]byte, LegacyDigestSize+OffsetSize)
+		copy(entry, digest)
+		PutOffset(entry[LegacyDigestSize:], int64(n))
+		index = append(index, entry...)
+	}
+	id, err := NewIndexID(bytes.NewReader(index), int64(len(index)))
+	if err != nil {
+		t.Fatalf("IndexID error: %s", err)
+	}
+	return id
+}
+
+func TestIndexID(t *testing.T) {
+	digests := [][]byte{{1}, {2}, {3}, {4}}
+	id := testIndexID(t, digests)
+	if id.NumberOfEntries != len(digests) || *testIndexID(t, digests) != *id {
+		t.Errorf("Unexpected ID %+v", id)
+		return
+	}
+	for _, changed := range [][][]byte{{{9}, {2}, {3}, {4}}, {{1}, {2}, {3}, {9}}, digests[:3]} {
+		if other := testIndexID(t, changed); other.Checksum == id.Checksum {
+			t.Errorf("Index of %v has the same ID as %v", changed, digests)
+			return
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"email":                      "email",
+		"password+email":             "email+password",
+		"domain+user":                "user+domain",
+		"password+domain+user+email": "email+user+domain+password",
+	} {
+		canonical, err := CanonicalKey(key)
+		if err != nil || canonical != expected {
+			t.Errorf("CanonicalKey(%s) = %s (%v), expected %s", key, canonical, err, expected)
+			return
+		}
+	}
+	for _, key := range []string{"", "phone", "email+", "email+email", "email+phone"} {
+		if _, err := ParseKey(key); err == nil {
+			t.Errorf("Expected error parsing key '%s'", key)
+			return
+		}
+	}
+	values := SplitValues(JoinValues([]string{"a@example.com", "pass:word+1"}))
+	if len(values) != 2 || values[1] != "pass:word+1" {
+		t.Errorf("Values did not round trip %v", values)
+	}
+}
+
+func TestOrderedHeader(t *testing.T) {
+	header, err := NewOrdered("user", DefaultPrefixSize, smallJSON)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buf := &bytes.Buffer{}
+	header.Write(buf)
+	parsed, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *parsed != *header || !parsed.IsOrdered() {
+		t.Errorf("Ordered header did not round trip %v != %v", parsed, header)
+		return
+	}
+	if !bytes.Equal(parsed.Digest("JDoe"), []byte("jdoe\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")) {
+		t.Errorf("Unexpected prefix %q", parsed.Digest("JDoe"))
+		return
+	}
+	if parsed.Compare(parsed.Digest("jdoe"), parsed.Digest("jdoe1")) != -1 || parsed.Compare([]byte{1, 0}, []byte{0, 1}) != 1 {
+		t.Errorf("Ordered indexes must compare lexicographically")
+		return
+	}
+	if len(parsed.Digest("a-very-long-username-indeed")) != DefaultPrefixSize {
+		t.Errorf("Expected the prefix to be truncated")
+		return
+	}
+
+	for _, key := range []string{"email+password", DomainSuffixKey, "nope"} {
+		if _, err = NewOrdered(key, DefaultPrefixSize, smallJSON); err == nil {
+			t.Errorf("Expected an error for ordered key '%s'", key)
+			return
+		}
+	}
+	if _, err = NewOrdered("user", MaxPrefixSize+1, smallJSON); err == nil {
+		t.Errorf("Expected an error for prefix size %d", MaxPrefixSize+1)
+		return
+	}
+	buf.Bytes()[52] = 7
+	if _, err = Read(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("Expected an error for an unknown index type")
+	}
+}
+
+func TestDigester(t *testing.T) {
+	header, err := New("email+password", 8, smallJSON)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ordered, err := NewOrdered("user", MinPrefixSize, smallJSON)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tests := [][]string{
+		{""}, {"JDoe"}, {"a@example.com", "hunter2"}, {"", ""}, {"ÉCOLE"}, {"İx"},
+		{"a-very-long-username"}, {"invalid \xff utf8"}, {"\xe4\xb8"},
+	}
+	for _, header := range []*Header{header, ordered} {
+		digester := header.NewDigester()
+		for _, values := range tests {
+			byteValues := [][]byte{}
+			for _, value := range values {
+				byteValues = append(byteValues, []byte(value))
+			}
+			expected := header.Digest(JoinValues(values))
+			if digest := digester.Digest(byteValues...); !bytes.Equal(digest, expected) {
+				t.Errorf("Digest of %q is %x, expected %x", values, digest, expected)
+				return
+			}
+			allocs := testing.AllocsPerRun(100, func() {
+				digester.Digest(byteValues...)
+			})
+			if allocs != 0 {
+				t.Errorf("Digest of %q allocates %.1f times", values, allocs)
+				return
+			}
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "dataset.json")
+	manifest := NewManifest(path)
+	small, err := manifest.Add(smallJSON)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	large, _ := manifest.Add(largeJSON)
+	again, _ := manifest.Add(smallJSON)
+	if small.ID != 0 || large.ID != 1 || again != small {
+		t.Errorf("Unexpected shard IDs %d, %d, %d", small.ID, large.ID, again.ID)
+		return
+	}
+	if err = manifest.WriteFile(path); err != nil {
+		t.Error(err)
+		return
+	}
+	parsed, err := ReadManifest(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = parsed.Verify(); err != nil {
+		t.Errorf("Verify failed: %s", err)
+		return
+	}
+	if *parsed.Shard(1) != *large || parsed.Shard(2) != nil {
+		t.Errorf("Shards did not round trip %v", parsed.Shards)
+		return
+	}
+
+	header, _ := New("email", 8, smallJSON)
+	header.SetShard(small)
+	if header.VerifyManifest(parsed) != ErrManifestMismatch {
+		t.Errorf("An index of one shard should not match the whole dataset")
+		return
+	}
+	if shards, err := header.IndexedShards(parsed); err != nil || len(shards) != 1 || *shards[0] != *small {
+		t.Errorf("An index of one shard should be matched to it, got %v (%v)", shards, err)
+		return
+	}
+	largeHeader, _ := New("email", 8, largeJSON)
+	largeHeader.SetShard(large)
+	header.SourceSize += largeHeader.SourceSize
+	header.SourceChecksum += largeHeader.SourceChecksum
+	if err = header.VerifyManifest(parsed); err != nil {
+		t.Errorf("Merged header should match the dataset: %s", err)
+		return
+	}
+	if shards, err := header.IndexedShards(parsed); err != nil || len(shards) != 2 {
+		t.Errorf("Merged header should match every shard, got %v (%v)", shards, err)
+		return
+	}
+
+	shard, offset := SplitLocation(Location(513, 1<<40+7))
+	if shard != 513 || offset != 1<<40+7 {
+		t.Errorf("Location did not round trip %d %d", shard, offset)
+		return
+	}
+
+	ioutil.WriteFile(path, []byte(`{"shards": [{"id": 1, "path": "a.json"}, {"id": 1, "path": "b.json"}]}`), 0644)
+	if _, err = ReadManifest(path); err == nil {
+		t.Errorf("Expected an error for duplicate shard IDs")
+	}
+}
+
+func TestStats(t *testing.T) {
+	digests := [][]byte{{1, 0}, {2, 0}, {2, 0}, {2, 0}, {3, 0}, {3, 0}}
+	builder := NewStatsBuilder()
+	for _, digest := range digests {
+		builder.Add(digest)
+	}
+	builder.Duplicate()
+	stats := builder.Stats()
+	if stats.Entries != 6 || stats.DistinctDigests != 3 || stats.LargestRun != 3 || stats.Duplicates != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+		return
+	}
+	if stats.LargestRunDigest != "0200" {
+		t.Errorf("Expected largest run of 0200, got %s", stats.LargestRunDigest)
+		return
+	}
+
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+	id := testIndexID(t, digests)
+	stats.IndexChecksum = id.Checksum
+	path := StatsPath(filepath.Join(tempDir, "test.idx"))
+	if err = stats.WriteFile(path); err != nil {
+		t.Errorf("Write error: %s", err)
+		return
+	}
+	read, err := ReadStatsFile(path, id)
+	if err != nil || *read != *stats {
+		t.Errorf("Read %+v (%v), expected %+v", read, err, stats)
+		return
+	}
+	if _, err = ReadStatsFile(path, &IndexID{NumberOfEntries: 7, Checksum: id.Checksum}); err == nil {
+		t.Errorf("Expected an error reading stale stats")
+		return
+	}
+	if _, err = ReadStatsFile(path, testIndexID(t, digests[1:])); err == nil {
+		t.Errorf("Expected an error reading the stats of a different index")
+	}
+}
+
+func TestRuns(t *testing.T) {
+	digests := [][]byte{{1, 0}, {2, 0}, {2, 0}, {2, 0}, {3, 0}, {4, 0}, {4, 0}, {4, 0}, {4, 0}}
+	builder := NewRunsBuilder(3)
+	for _, digest := range digests {
+		builder.Add(digest)
+	}
+	runs := builder.Runs()
+	if runs.NumberOfEntries != len(digests) || runs.DigestSize != 2 || len(runs.Runs) != 2 {
+		t.Errorf("Unexpected runs %+v", runs)
+		return
+	}
+
+	id := testIndexID(t, digests)
+	runs.IndexChecksum = id.Checksum
+	buf := &bytes.Buffer{}
+	if _, err := runs.WriteTo(buf); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := ReadRuns(bytes.NewReader(buf.Bytes()), &IndexID{NumberOfEntries: len(digests) + 1, Checksum: id.Checksum}); err == nil {
+		t.Errorf("Expected an error reading stale runs")
+		return
+	}
+	other := append([][]byte{{0, 0}}, digests[1:]...)
+	if _, err := ReadRuns(bytes.NewReader(buf.Bytes()), testIndexID(t, other)); err == nil {
+		t.Errorf("Expected an error reading the runs of a different index")
+		return
+	}
+	read, err := ReadRuns(bytes.NewReader(buf.Bytes()), id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := map[byte][2]int64{2: {1, 3}, 4: {5, 4}}
+	for _, digest := range digests {
+		run, ok := read.Lookup(digest)
+		want, recorded := expected[digest[0]]
+		if ok != recorded || run.Start != want[0] || run.Length != want[1] {
+			t.Errorf("Run of %x is %+v (%v), expected %v", digest, run, ok, want)
+			return
+		}
+	}
+
+	// Runs must not overlap or run past the end of the index
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[len(corrupt)-16] = 1 // Second run starts inside the first
+	if _, err = ReadRuns(bytes.NewReader(corrupt), id); err == nil {
+		t.Errorf("Expected an error reading overlapping runs")
+	}
+}
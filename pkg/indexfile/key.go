@@ -0,0 +1,102 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	An index key is a single field such as "email", or a composite of
+	fields joined with "+" such as "email+password". Composite keys are
+	always stored in the canonical field order (email, user, domain,
+	password) so "password+email" and "email+password" are the same index,
+	and the digest is computed over the field values joined by KeySeparator.
+
+	The "domain-suffix" key indexes every suffix of the domain down to the
+	registrable domain, it cannot be combined with other fields.
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// KeyFieldSeparator - Separates the fields of a composite key name
+	KeyFieldSeparator = "+"
+	// KeySeparator - Separates the values of a composite key before hashing
+	KeySeparator = "\x00"
+	// DomainSuffixKey - Index of each domain and its parent domains
+	DomainSuffixKey = "domain-suffix"
+)
+
+var (
+	// KeyFields - Fields that can be indexed, in canonical order
+	KeyFields = []string{"email", "user", "domain", "password"}
+)
+
+// ParseKey - Fields of a single or composite key in canonical order
+func ParseKey(key string) ([]string, error) {
+	if key == DomainSuffixKey {
+		return []string{DomainSuffixKey}, nil
+	}
+	selected := map[string]bool{}
+	for _, field := range strings.Split(key, KeyFieldSeparator) {
+		if field == DomainSuffixKey {
+			return nil, fmt.Errorf("Invalid index key '%s', %s cannot be combined with other fields", key, DomainSuffixKey)
+		}
+		if !isKeyField(field) {
+			return nil, fmt.Errorf("Invalid index key '%s', fields must be one of: %s", key, strings.Join(KeyFields, ", "))
+		}
+		if selected[field] {
+			return nil, fmt.Errorf("Invalid index key '%s', duplicate field '%s'", key, field)
+		}
+		selected[field] = true
+	}
+	fields := []string{}
+	for _, field := range KeyFields {
+		if selected[field] {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// CanonicalKey - Name of a key with its fields in canonical order
+func CanonicalKey(key string) (string, error) {
+	fields, err := ParseKey(key)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(fields, KeyFieldSeparator), nil
+}
+
+// JoinValues - The value of a composite key, values must be in the
+// canonical order of the key's fields
+func JoinValues(values []string) string {
+	return strings.Join(values, KeySeparator)
+}
+
+// SplitValues - Values of a composite key
+func SplitValues(value string) []string {
+	return strings.Split(value, KeySeparator)
+}
+
+func isKeyField(field string) bool {
+	for _, keyField := range KeyFields {
+		if field == keyField {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	A dataset manifest lists the JSON files (shards) of a dataset so each
+	breach can be kept in its own file and indexed independently:
+
+	{"shards": [{"id": 1, "path": "breach-a.json", "size": ..., "checksum": ...}]}
+
+	Paths are relative to the manifest. Sharded indexes use 64-bit offsets,
+	the low 48 bits are the offset into the shard and the high 16 bits are
+	the shard ID, so sorted sharded indexes can be merged into one index of
+	the whole dataset.
+
+	The source size of a sharded index is the total size of its shards and
+	the source checksum is the sum of the shard checksums (see
+	Shard.SourceChecksum), so the source of a merged index can be computed
+	from the headers of its inputs. An index of a single shard or of every
+	shard can be searched with the manifest, an index of some but not all
+	of several shards cannot since its shards cannot be told apart.
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// ShardedOffsetSize - [48-bit offset][16-bit shard ID]
+	ShardedOffsetSize = 8
+	// ShardShift - Bit position of the shard ID in a sharded offset
+	ShardShift = 48
+	// MaxShardID - Largest shard ID
+	MaxShardID = 1<<16 - 1
+
+	offsetMask = 1<<ShardShift - 1
+)
+
+var (
+	// ErrManifestMismatch - Index was not created from the dataset's shards
+	ErrManifestMismatch = errors.New("Index does not match the dataset manifest")
+)
+
+// Shard - A JSON file of a dataset
+type Shard struct {
+	ID       uint16 `json:"id"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// SourceChecksum - Checksum of the shard as part of a dataset, this covers
+// the shard ID so the same file cannot be used as two shards
+func (s *Shard) SourceChecksum() uint32 {
+	buf := make([]byte, 14)
+	binary.LittleEndian.PutUint16(buf, s.ID)
+	binary.LittleEndian.PutUint64(buf[2:], uint64(s.Size))
+	binary.LittleEndian.PutUint32(buf[10:], s.Checksum)
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// Manifest - The shards of a dataset
+type Manifest struct {
+	Shards []*Shard `json:"shards"`
+
+	dir string
+}
+
+// NewManifest - An empty manifest that will be saved to path
+func NewManifest(path string) *Manifest {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		dir = filepath.Dir(path)
+	}
+	return &Manifest{Shards: []*Shard{}, dir: dir}
+}
+
+// ReadManifest - Read a manifest file
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := NewManifest(path)
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s (%s)", path, err)
+	}
+	ids := map[uint16]bool{}
+	for _, shard := range manifest.Shards {
+		if ids[shard.ID] {
+			return nil, fmt.Errorf("Invalid manifest %s, duplicate shard ID %d", path, shard.ID)
+		}
+		ids[shard.ID] = true
+	}
+	return manifest, nil
+}
+
+// WriteFile - Save the manifest, shard paths are relative to the manifest
+func (m *Manifest) WriteFile(path string) error {
+	sort.Slice(m.Shards, func(a, b int) bool {
+		return m.Shards[a].ID < m.Shards[b].ID
+	})
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Shard - The shard with id, or nil
+func (m *Manifest) Shard(id uint16) *Shard {
+	for _, shard := range m.Shards {
+		if shard.ID == id {
+			return shard
+		}
+	}
+	return nil
+}
+
+// Path - Path of a shard's JSON file
+func (m *Manifest) Path(shard *Shard) string {
+	if filepath.IsAbs(shard.Path) {
+		return shard.Path
+	}
+	return filepath.Join(m.dir, shard.Path)
+}
+
+// Add - Add a JSON file to the dataset, files that are already in the
+// dataset return their existing shard
+func (m *Manifest) Add(path string) (*Shard, error) {
+	size, checksum, err := Checksum(path)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	nextID := 0
+	for _, shard := range m.Shards {
+		shardPath, err := filepath.Abs(m.Path(shard))
+		if err == nil && shardPath == absPath {
+			if shard.Size != size || shard.Checksum != checksum {
+				return nil, fmt.Errorf("Shard %d (%s) has changed since it was added to the manifest", shard.ID, path)
+			}
+			return shard, nil
+		}
+		if nextID <= int(shard.ID) {
+			nextID = int(shard.ID) + 1
+		}
+	}
+	if MaxShardID < nextID {
+		return nil, errors.New("Manifest has too many shards")
+	}
+	relPath, err := filepath.Rel(m.dir, absPath)
+	if err != nil {
+		relPath = absPath
+	}
+	shard := &Shard{ID: uint16(nextID), Path: relPath, Size: size, Checksum: checksum}
+	m.Shards = append(m.Shards, shard)
+	return shard, nil
+}
+
+// Source - Size and checksum of a sharded index of every shard
+func (m *Manifest) Source() (int64, uint32) {
+	size, checksum := int64(0), uint32(0)
+	for _, shard := range m.Shards {
+		size += shard.Size
+		checksum += shard.SourceChecksum()
+	}
+	return size, checksum
+}
+
+// Verify - Check that each shard's JSON file has not changed
+func (m *Manifest) Verify() error {
+	for _, shard := range m.Shards {
+		err := m.VerifyShard(shard)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyShard - Check that the shard's JSON file has not changed
+func (m *Manifest) VerifyShard(shard *Shard) error {
+	size, checksum, err := Checksum(m.Path(shard))
+	if err != nil {
+		return err
+	}
+	if size != shard.Size || checksum != shard.Checksum {
+		return fmt.Errorf("Shard %d (%s) does not match the manifest", shard.ID, shard.Path)
+	}
+	return nil
+}
+
+// IsSharded - Entry offsets include a shard ID
+func (h *Header) IsSharded() bool {
+	return h.OffsetSize == ShardedOffsetSize
+}
+
+// SetShard - Make the header a sharded index of a single shard
+func (h *Header) SetShard(shard *Shard) {
+	h.OffsetSize = ShardedOffsetSize
+	h.SourceSize = shard.Size
+	h.SourceChecksum = shard.SourceChecksum()
+}
+
+// VerifyManifest - Check that the index was created from every shard of
+// the manifest
+func (h *Header) VerifyManifest(manifest *Manifest) error {
+	if !h.IsSharded() {
+		return errors.New("Index is not sharded, it must be searched with its JSON file")
+	}
+	size, checksum := manifest.Source()
+	if size != h.SourceSize || checksum != h.SourceChecksum {
+		return ErrManifestMismatch
+	}
+	return nil
+}
+
+// IndexedShards - Shards of the manifest the index was created from, every
+// shard for an index of the whole dataset or the one shard of an index of
+// a single shard. Shards added to the manifest after a shard was indexed
+// do not stop its index from being searched.
+func (h *Header) IndexedShards(manifest *Manifest) ([]*Shard, error) {
+	err := h.VerifyManifest(manifest)
+	if err == nil {
+		return manifest.Shards, nil
+	}
+	if err != ErrManifestMismatch {
+		return nil, err
+	}
+	for _, shard := range manifest.Shards {
+		if shard.Size == h.SourceSize && shard.SourceChecksum() == h.SourceChecksum {
+			return []*Shard{shard}, nil
+		}
+	}
+	return nil, err
+}
+
+// Location - Sharded offset of offset in shard
+func Location(shard uint16, offset int64) int64 {
+	return int64(shard)<<ShardShift | offset
+}
+
+// SplitLocation - Shard and offset of a sharded offset
+func SplitLocation(location int64) (uint16, int64) {
+	return uint16(location >> ShardShift), location & offsetMask
+}
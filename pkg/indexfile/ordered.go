@@ -0,0 +1,174 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Ordered indexes are sorted by value instead of by digest so values
+	that share a prefix are next to each other, which makes prefix and
+	wildcard searches a range scan:
+
+	[lowercase value prefix, zero padded][48-bit offset] = one entry
+
+	Values longer than the prefix size are truncated, so searches for
+	prefixes longer than the prefix size (and exact searches) must check
+	each result against the JSON file.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// TypeDigest - Entries are sorted by the digest of the value
+	TypeDigest = 0
+	// TypeOrdered - Entries are sorted by a prefix of the value
+	TypeOrdered = 1
+
+	// DefaultPrefixSize - Default prefix size of ordered indexes in bytes
+	DefaultPrefixSize = 16
+	// MinPrefixSize - Smallest prefix size of ordered indexes in bytes
+	MinPrefixSize = 4
+	// MaxPrefixSize - Largest prefix size of ordered indexes in bytes
+	MaxPrefixSize = 64
+)
+
+// IsOrdered - Entries are sorted by a prefix of the value
+func (h *Header) IsOrdered() bool {
+	return h.Type == TypeOrdered
+}
+
+// Digest - The entry digest of value, ordered indexes use a prefix of the
+// value in place of a digest
+func (h *Header) Digest(value string) []byte {
+	if h.IsOrdered() {
+		return Prefix(value, h.DigestSize)
+	}
+	return Digest(value, h.DigestSize)
+}
+
+// Compare - Compare two entry digests in the order of the index
+func (h *Header) Compare(a, b []byte) int {
+	if h.IsOrdered() {
+		return bytes.Compare(a, b)
+	}
+	return Compare(a, b)
+}
+
+// NewOrdered - Create a header for an ordered index of key over the source
+// JSON file, only single field keys can be ordered
+func NewOrdered(key string, prefixSize int, source string) (*Header, error) {
+	err := ValidPrefixSize(prefixSize)
+	if err != nil {
+		return nil, err
+	}
+	if !isKeyField(key) {
+		return nil, fmt.Errorf("Invalid ordered index key '%s', must be one of: %s", key, strings.Join(KeyFields, ", "))
+	}
+	size, checksum, err := Checksum(source)
+	if err != nil {
+		return nil, err
+	}
+	header := &Header{
+		Version:        Version,
+		DigestSize:     prefixSize,
+		OffsetSize:     OffsetSize,
+		Key:            key,
+		SourceSize:     size,
+		SourceChecksum: checksum,
+		Type:           TypeOrdered,
+	}
+	return header, nil
+}
+
+// ValidPrefixSize - Returns an error if size is not a supported prefix size
+func ValidPrefixSize(size int) error {
+	if size < MinPrefixSize || MaxPrefixSize < size {
+		return fmt.Errorf("Invalid prefix size %d, must be %d to %d bytes", size, MinPrefixSize, MaxPrefixSize)
+	}
+	return nil
+}
+
+// Prefix - The lowercase value truncated or zero padded to size bytes
+func Prefix(value string, size int) []byte {
+	prefix := make([]byte, size)
+	copy(prefix, strings.ToLower(value))
+	return prefix
+}
+
+// Digester - Computes the same digests as Header.Digest from byte slices,
+// its buffers are reused so once they have grown a digest does not
+// allocate. A Digester is not safe for concurrent use.
+type Digester struct {
+	header *Header
+	hash   hash.Hash
+	value  []byte
+	digest []byte
+}
+
+// NewDigester - A Digester for entries of this index
+func (h *Header) NewDigester() *Digester {
+	return &Digester{
+		header: h,
+		hash:   sha256.New(),
+		digest: make([]byte, 0, sha256.Size+MaxPrefixSize),
+	}
+}
+
+// Digest - Equal to Header.Digest(JoinValues(values)), the digest is only
+// valid until the next call
+func (d *Digester) Digest(values ...[]byte) []byte {
+	d.value = d.value[:0]
+	for index, value := range values {
+		if 0 < index {
+			d.value = append(d.value, KeySeparator...)
+		}
+		d.value = append(d.value, value...)
+	}
+	if d.header.IsOrdered() {
+		return d.prefix()
+	}
+	d.hash.Reset()
+	d.hash.Write(d.value)
+	d.digest = d.hash.Sum(d.digest[:0])
+	return d.digest[:d.header.DigestSize]
+}
+
+// prefix - Prefix of the value like the Prefix function, runes are
+// lowercased one at a time the same way strings.ToLower does
+func (d *Digester) prefix() []byte {
+	size := d.header.DigestSize
+	d.digest = d.digest[:0]
+	var encoded [utf8.UTFMax]byte
+	for position := 0; position < len(d.value) && len(d.digest) < size; {
+		r, width := utf8.DecodeRune(d.value[position:])
+		position += width
+		n := utf8.EncodeRune(encoded[:], unicode.ToLower(r))
+		d.digest = append(d.digest, encoded[:n]...)
+	}
+	if size < len(d.digest) {
+		d.digest = d.digest[:size]
+	}
+	for len(d.digest) < size {
+		d.digest = append(d.digest, 0)
+	}
+	return d.digest
+}
@@ -0,0 +1,241 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	A runs file is a sidecar of a sorted index that records where each
+	large run of entries sharing a digest starts and how long it is, e.g.
+	gmail.com in a domain index or the empty value of any key, so a search
+	can count and page through a run without walking it:
+
+	[magic 4][digest size 1][version 1][reserved 2][number of entries 8]
+	[min run length 8][number of runs 8][index checksum 4][reserved 4]
+	[digest][start 8][length 8] ... one per run in index order
+
+	Runs shorter than the min run length are not recorded. The number of
+	entries and index checksum are the ID of the index the runs were
+	written for (see sidecar.go).
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// RunsMagic - First bytes of every runs file
+	RunsMagic = "LKRN"
+	// RunsExt - Extension appended to the index path
+	RunsExt = ".runs"
+	// DefaultMinRunLength - Runs of at least this many entries are recorded
+	DefaultMinRunLength = 1024
+	// RunsVersion - Current runs format version
+	RunsVersion = 1
+
+	runsHeaderSize = 40
+)
+
+// Run - Entries [Start, Start+Length) of a sorted index share Digest
+type Run struct {
+	Digest []byte
+	Start  int64
+	Length int64
+}
+
+// Runs - The large runs of a sorted index
+type Runs struct {
+	NumberOfEntries int
+	DigestSize      int
+	MinLength       int
+	Runs            []Run
+	// IndexChecksum - Checksum of the IndexID the runs were written for
+	IndexChecksum uint32
+
+	byDigest map[string]int
+}
+
+// RunsPath - Path of the runs sidecar of an index
+func RunsPath(index string) string {
+	return index + RunsExt
+}
+
+// Lookup - The run of digest, false if its run is shorter than MinLength.
+// Lookup is safe to call from multiple goroutines.
+func (r *Runs) Lookup(digest []byte) (Run, bool) {
+	index, ok := r.byDigest[string(digest)]
+	if !ok {
+		return Run{}, false
+	}
+	return r.Runs[index], true
+}
+
+// indexDigests - Index the runs by digest for Lookup
+func (r *Runs) indexDigests() *Runs {
+	r.byDigest = make(map[string]int, len(r.Runs))
+	for index, run := range r.Runs {
+		r.byDigest[string(run.Digest)] = index
+	}
+	return r
+}
+
+// WriteTo - Encode the runs
+func (r *Runs) WriteTo(writer io.Writer) (int64, error) {
+	buf := make([]byte, runsHeaderSize, runsHeaderSize+len(r.Runs)*(r.DigestSize+16))
+	copy(buf, RunsMagic)
+	buf[4] = byte(r.DigestSize)
+	buf[5] = RunsVersion
+	binary.LittleEndian.PutUint64(buf[8:], uint64(r.NumberOfEntries))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(r.MinLength))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(len(r.Runs)))
+	binary.LittleEndian.PutUint32(buf[32:], r.IndexChecksum)
+	var position [16]byte
+	for _, run := range r.Runs {
+		binary.LittleEndian.PutUint64(position[:], uint64(run.Start))
+		binary.LittleEndian.PutUint64(position[8:], uint64(run.Length))
+		buf = append(buf, run.Digest...)
+		buf = append(buf, position[:]...)
+	}
+	written, err := writer.Write(buf)
+	return int64(written), err
+}
+
+// WriteFile - Write the runs to path
+func (r *Runs) WriteFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = r.WriteTo(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadRuns - Read runs, they must have been written for the index with id
+// otherwise they are stale
+func ReadRuns(reader io.Reader, id *IndexID) (*Runs, error) {
+	buf := make([]byte, runsHeaderSize)
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	if string(buf[:len(RunsMagic)]) != RunsMagic {
+		return nil, errors.New("Invalid runs header")
+	}
+	if buf[5] != RunsVersion {
+		return nil, fmt.Errorf("Unsupported runs version %d", buf[5])
+	}
+	runs := &Runs{
+		NumberOfEntries: int(binary.LittleEndian.Uint64(buf[8:])),
+		DigestSize:      int(buf[4]),
+		MinLength:       int(binary.LittleEndian.Uint64(buf[16:])),
+		IndexChecksum:   binary.LittleEndian.Uint32(buf[32:]),
+	}
+	err = id.check("Runs", runs.NumberOfEntries, runs.IndexChecksum)
+	if err != nil {
+		return nil, err
+	}
+	numberOfEntries := runs.NumberOfEntries
+	numberOfRuns := binary.LittleEndian.Uint64(buf[24:])
+	if uint64(numberOfEntries) < numberOfRuns {
+		return nil, errors.New("Runs have more runs than entries")
+	}
+	runs.Runs = make([]Run, 0, numberOfRuns)
+	end := int64(0)
+	for index := uint64(0); index < numberOfRuns; index++ {
+		buf = make([]byte, runs.DigestSize+16)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+		run := Run{
+			Digest: buf[:runs.DigestSize],
+			Start:  int64(binary.LittleEndian.Uint64(buf[runs.DigestSize:])),
+			Length: int64(binary.LittleEndian.Uint64(buf[runs.DigestSize+8:])),
+		}
+		if run.Start < end || run.Length < 1 || int64(numberOfEntries)-run.Start < run.Length {
+			return nil, errors.New("Runs are not sorted or exceed the index")
+		}
+		end = run.Start + run.Length
+		runs.Runs = append(runs.Runs, run)
+	}
+	return runs.indexDigests(), nil
+}
+
+// ReadRunsFile - Read the runs at path
+func ReadRunsFile(path string, id *IndexID) (*Runs, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadRuns(bufio.NewReader(file), id)
+}
+
+// RunsBuilder - Builds runs from the digests of a sorted index, in order
+type RunsBuilder struct {
+	runs     Runs
+	previous []byte
+	start    int64
+	position int64
+}
+
+// NewRunsBuilder - Create an empty runs builder, runs shorter than
+// minLength are not recorded
+func NewRunsBuilder(minLength int) *RunsBuilder {
+	if minLength < 1 {
+		minLength = 1
+	}
+	return &RunsBuilder{runs: Runs{MinLength: minLength, Runs: []Run{}}}
+}
+
+// Add - Add the next digest of the index
+func (b *RunsBuilder) Add(digest []byte) {
+	if b.previous == nil || string(b.previous) != string(digest) {
+		b.runs.Runs = b.appendRun(b.runs.Runs)
+		b.previous = append(b.previous[:0], digest...)
+		b.start = b.position
+	}
+	b.position++
+}
+
+// appendRun - Append the current run to runs if it is long enough
+func (b *RunsBuilder) appendRun(runs []Run) []Run {
+	length := b.position - b.start
+	if length < int64(b.runs.MinLength) {
+		return runs
+	}
+	return append(runs, Run{
+		Digest: append([]byte{}, b.previous...),
+		Start:  b.start,
+		Length: length,
+	})
+}
+
+// Runs - The runs of all digests added so far
+func (b *RunsBuilder) Runs() *Runs {
+	runs := b.runs
+	runs.Runs = b.appendRun(append([]Run{}, b.runs.Runs...))
+	runs.NumberOfEntries = int(b.position)
+	runs.DigestSize = len(b.previous)
+	return runs.indexDigests()
+}
@@ -0,0 +1,92 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Sidecars such as the fence are written next to an index by the sorter,
+	so a new index written to the same path leaves them stale. Each sidecar
+	records the ID of the index it was written for and is rejected if the
+	ID does not match, the ID is the number of entries and a CRC-32C of the
+	index size, its header, and its first and last entries.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// IndexID - Identifies the index a sidecar was written for
+type IndexID struct {
+	NumberOfEntries int
+	Checksum        uint32
+}
+
+// NewIndexID - The ID of an index of size bytes
+func NewIndexID(index io.ReaderAt, size int64) (*IndexID, error) {
+	header, err := Read(index)
+	if err != nil {
+		return nil, err
+	}
+	id := &IndexID{NumberOfEntries: header.NumberOfEntries(size)}
+	hash := crc32.New(castagnoli)
+	var sizeBuf [8]byte
+	binary.LittleEndian.PutUint64(sizeBuf[:], uint64(size))
+	hash.Write(sizeBuf[:])
+	sections := [][2]int64{{0, header.Size()}}
+	if 0 < id.NumberOfEntries {
+		entrySize := int64(header.EntrySize())
+		sections = append(sections,
+			[2]int64{header.Position(0), entrySize},
+			[2]int64{header.Position(id.NumberOfEntries - 1), entrySize})
+	}
+	for _, section := range sections {
+		_, err = io.Copy(hash, io.NewSectionReader(index, section[0], section[1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	id.Checksum = hash.Sum32()
+	return id, nil
+}
+
+// ReadIndexID - The ID of the index at path
+func ReadIndexID(path string) (*IndexID, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return NewIndexID(file, info.Size())
+}
+
+// check - Returns an error if a sidecar with numberOfEntries and checksum
+// was written for a different index
+func (id *IndexID) check(sidecar string, numberOfEntries int, checksum uint32) error {
+	if numberOfEntries != id.NumberOfEntries {
+		return fmt.Errorf("%s has %d entries, index has %d", sidecar, numberOfEntries, id.NumberOfEntries)
+	}
+	if checksum != id.Checksum {
+		return fmt.Errorf("%s was written for a different index", sidecar)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package indexfile
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	A stats file is a JSON sidecar of a sorted index written by the sorter,
+	it records how many entries and distinct digests the index has and the
+	largest run of entries that share a digest (the most common value),
+	and the checksum of the ID of the index it was written for (see
+	sidecar.go).
+*/
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// StatsExt - Extension appended to the index path
+	StatsExt = ".stats"
+)
+
+// Stats - Statistics of a sorted index
+type Stats struct {
+	Entries          int64  `json:"entries"`
+	DistinctDigests  int64  `json:"distinct_digests"`
+	LargestRun       int64  `json:"largest_run"`
+	LargestRunDigest string `json:"largest_run_digest"`
+	// Duplicates - Identical entries removed by the sorter
+	Duplicates int64 `json:"duplicates"`
+	// IndexChecksum - Checksum of the IndexID the stats were written for
+	IndexChecksum uint32 `json:"index_checksum"`
+}
+
+// StatsPath - Path of the stats sidecar of an index
+func StatsPath(index string) string {
+	return index + StatsExt
+}
+
+// WriteFile - Write the stats to path
+func (s *Stats) WriteFile(path string) error {
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ReadStatsFile - Read the stats at path, they must have been written for
+// the index with id otherwise they are stale
+func ReadStatsFile(path string, id *IndexID) (*Stats, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+	err = json.Unmarshal(data, stats)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid stats %s (%s)", path, err)
+	}
+	err = id.check("Stats", int(stats.Entries), stats.IndexChecksum)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// StatsBuilder - Builds stats from the digests of a sorted index, in order
+type StatsBuilder struct {
+	stats    Stats
+	previous []byte
+	run      int64
+	largest  []byte
+}
+
+// NewStatsBuilder - Create an empty stats builder
+func NewStatsBuilder() *StatsBuilder {
+	return &StatsBuilder{}
+}
+
+// Add - Add the next digest of the index
+func (b *StatsBuilder) Add(digest []byte) {
+	b.stats.Entries++
+	if b.previous != nil && string(b.previous) == string(digest) {
+		b.run++
+	} else {
+		b.stats.DistinctDigests++
+		b.previous = append(b.previous[:0], digest...)
+		b.run = 1
+	}
+	if b.stats.LargestRun < b.run {
+		b.stats.LargestRun = b.run
+		b.largest = append(b.largest[:0], digest...)
+	}
+}
+
+// Duplicate - Count an identical entry that was removed from the index
+func (b *StatsBuilder) Duplicate() {
+	b.stats.Duplicates++
+}
+
+// Stats - The stats of all digests added so far
+func (b *StatsBuilder) Stats() *Stats {
+	stats := b.stats
+	stats.LargestRunDigest = hex.EncodeToString(b.largest)
+	return &stats
+}
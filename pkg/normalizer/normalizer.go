@@ -21,10 +21,10 @@ import (
 	"bufio"
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
+
+	"github.com/moloch--/leakdb/pkg/targets"
 )
 
 // Entry - A single entry
@@ -37,12 +37,9 @@ type Entry struct {
 
 // Normalize - Normalizer job
 type Normalize struct {
-	Format     Format
-	Targets    []string
-	Output     *os.File
-	Recursive  bool
-	SkipPrefix string
-	SkipSuffix string
+	Format  Format
+	Targets []string
+	Output  *os.File
 
 	target      string
 	targetCount int
@@ -58,12 +55,6 @@ func (n *Normalize) GetStatus() (string, int) {
 func (n *Normalize) lineQueue(lines chan<- string) {
 	defer close(lines)
 	for _, target := range n.Targets {
-		if n.SkipPrefix != "" && strings.HasPrefix(target, n.SkipPrefix) {
-			continue
-		}
-		if n.SkipSuffix != "" && strings.HasSuffix(target, n.SkipSuffix) {
-			continue
-		}
 		err := n.normalizeFile(lines, target)
 		if err != nil {
 			n.Errors = append(n.Errors, err)
@@ -129,8 +120,8 @@ func (n *Normalize) Start() {
 }
 
 // GetNormalizer - Start the normalizer
-func GetNormalizer(format Format, target string, output string, recursive bool, skipPrefix, skipSuffix string) (*Normalize, error) {
-	targets, err := getTargets(target, recursive)
+func GetNormalizer(format Format, target string, options *targets.Options, output string) (*Normalize, error) {
+	files, err := targets.Find(target, options)
 	if err != nil {
 		return nil, err
 	}
@@ -142,51 +133,8 @@ func GetNormalizer(format Format, target string, output string, recursive bool,
 		return nil, err
 	}
 	return &Normalize{
-		Format:     format,
-		Targets:    targets,
-		Output:     outputFile,
-		Recursive:  recursive,
-		SkipPrefix: skipPrefix,
-		SkipSuffix: skipSuffix,
+		Format:  format,
+		Targets: files,
+		Output:  outputFile,
 	}, nil
 }
-
-// getTargets - Get targets from target directory
-func getTargets(target string, recursive bool) ([]string, error) {
-	targetStat, err := os.Stat(target)
-	if err != nil {
-		return []string{}, err
-	}
-	targets := []string{}
-	switch mode := targetStat.Mode(); {
-	case mode.IsDir():
-		if recursive {
-			err = filepath.Walk(target, func(currentPath string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					targets = append(targets, currentPath)
-				}
-				return nil
-			})
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			files, err := ioutil.ReadDir(target)
-			if err != nil {
-				return nil, err
-			}
-			for _, file := range files {
-				if err != nil || file.IsDir() {
-					continue
-				}
-				targets = append(targets, filepath.Join(target, file.Name()))
-			}
-		}
-	case mode.IsRegular():
-		targets = []string{target}
-	}
-	return targets, nil
-}
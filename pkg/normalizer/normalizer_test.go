@@ -29,33 +29,6 @@ var (
 `)
 )
 
-func TestGetTargets(t *testing.T) {
-	files, err := getTargets("../../test/a", false)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	if len(files) != 1 {
-		t.Errorf("Unexpected number of targets %d", len(files))
-		return
-	}
-	if files[0] != "../../test/a/a.txt" {
-		t.Errorf("Unexpected target '%s'", files[0])
-		return
-	}
-
-	files, err = getTargets("../../test/a", true)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	if len(files) != 2 {
-		t.Errorf("Unexpected number of recursive targets %d: %v", len(files), files)
-		return
-	}
-
-}
-
 func TestNormalize(t *testing.T) {
 	target := "../../test/a"
 	output, err := ioutil.TempFile("", "leakdb_test_")
@@ -65,7 +38,7 @@ func TestNormalize(t *testing.T) {
 	}
 	defer os.Remove(output.Name())
 	format := Formats[colonNewline]
-	normalize, err := GetNormalizer(format, target, output.Name(), false, "", "")
+	normalize, err := GetNormalizer(format, target, nil, output.Name())
 	if err != nil {
 		t.Error(err)
 		return
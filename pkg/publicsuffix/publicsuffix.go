@@ -0,0 +1,120 @@
+package publicsuffix
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Splits domains on their public suffix (https://publicsuffix.org/) so
+	that "mail.example.co.uk" is understood to belong to "example.co.uk"
+	and not "co.uk". A small list of common suffixes is built in, the full
+	list can be loaded from a public_suffix_list.dat file.
+*/
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// List - A set of public suffix rules, the zero List has no rules so every
+// domain has a single label public suffix
+type List struct {
+	rules      map[string]bool
+	wildcards  map[string]bool // "*.ck" is stored as "ck"
+	exceptions map[string]bool // "!www.ck" is stored as "www.ck"
+}
+
+// Parse - Parse rules in the public suffix list format, one rule per line
+// and "//" comments
+func Parse(reader io.Reader) (*List, error) {
+	list := &List{
+		rules:      map[string]bool{},
+		wildcards:  map[string]bool{},
+		exceptions: map[string]bool{},
+	}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule := strings.ToLower(strings.Fields(line)[0])
+		if strings.HasPrefix(rule, "!") {
+			list.exceptions[rule[1:]] = true
+		} else if strings.HasPrefix(rule, "*.") {
+			list.wildcards[rule[2:]] = true
+		} else {
+			list.rules[rule] = true
+		}
+	}
+	return list, scanner.Err()
+}
+
+// Load - Load a public suffix list file
+func Load(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file)
+}
+
+// Default - The built-in list
+func Default() *List {
+	list, _ := Parse(strings.NewReader(defaultRules))
+	return list
+}
+
+// PublicSuffix - Number of labels of domain that are its public suffix,
+// domains without a matching rule use the last label (the "*" rule)
+func (l *List) PublicSuffix(domain string) int {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for index := range labels {
+		candidate := strings.Join(labels[index:], ".")
+		if l.exceptions[candidate] {
+			return len(labels) - index - 1
+		}
+		if l.rules[candidate] {
+			return len(labels) - index
+		}
+		if index+1 < len(labels) && l.wildcards[strings.Join(labels[index+1:], ".")] {
+			return len(labels) - index
+		}
+	}
+	return 1
+}
+
+// Suffixes - Every suffix of domain down to the registrable domain, e.g.
+// "mail.corp.example.co.uk" returns "mail.corp.example.co.uk",
+// "corp.example.co.uk" and "example.co.uk". A domain that is itself a
+// public suffix only returns itself.
+func (l *List) Suffixes(domain string) []string {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return []string{domain}
+	}
+	labels := strings.Split(domain, ".")
+	registrable := l.PublicSuffix(domain) + 1
+	if len(labels) <= registrable {
+		return []string{domain}
+	}
+	suffixes := []string{}
+	for index := 0; index <= len(labels)-registrable; index++ {
+		suffixes = append(suffixes, strings.Join(labels[index:], "."))
+	}
+	return suffixes
+}
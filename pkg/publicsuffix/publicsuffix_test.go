@@ -0,0 +1,46 @@
+package publicsuffix
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSuffixes(t *testing.T) {
+	list := Default()
+	for domain, expected := range map[string][]string{
+		"example.com":             {"example.com"},
+		"mail.example.com":        {"mail.example.com", "example.com"},
+		"mail.corp.example.co.uk": {"mail.corp.example.co.uk", "corp.example.co.uk", "example.co.uk"},
+		"Mail.Example.CO.UK":      {"Mail.Example.CO.UK", "Example.CO.UK"},
+		"co.uk":                   {"co.uk"},
+		"com":                     {"com"},
+		"foo.bar.github.io":       {"foo.bar.github.io", "bar.github.io"},
+		"state.tx.us":             {"state.tx.us"},
+		"example.com.":            {"example.com"},
+	} {
+		suffixes := list.Suffixes(domain)
+		if !reflect.DeepEqual(suffixes, expected) {
+			t.Errorf("Suffixes(%s) = %v, expected %v", domain, suffixes, expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse(strings.NewReader("// comment\n\n*.ck\n!www.ck\nuk\nco.uk  extra\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for domain, expected := range map[string]int{
+		"a.b.ck":        2,
+		"www.ck":        1,
+		"example.co.uk": 2,
+		"example.uk":    1,
+		"example.com":   1,
+	} {
+		if suffix := list.PublicSuffix(domain); suffix != expected {
+			t.Errorf("PublicSuffix(%s) = %d, expected %d", domain, suffix, expected)
+		}
+	}
+}
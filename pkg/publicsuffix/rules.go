@@ -0,0 +1,141 @@
+package publicsuffix
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+// defaultRules - Common multi-label suffixes from the public suffix list,
+// single label TLDs are handled by the implicit "*" rule
+const defaultRules = `
+// United Kingdom
+ac.uk
+co.uk
+gov.uk
+ltd.uk
+me.uk
+net.uk
+nhs.uk
+org.uk
+plc.uk
+police.uk
+sch.uk
+
+// Australia
+asn.au
+com.au
+edu.au
+gov.au
+id.au
+net.au
+org.au
+
+// New Zealand
+ac.nz
+co.nz
+govt.nz
+net.nz
+org.nz
+
+// Japan
+ac.jp
+co.jp
+go.jp
+ne.jp
+or.jp
+
+// China, Hong Kong, Taiwan
+com.cn
+edu.cn
+gov.cn
+net.cn
+org.cn
+com.hk
+edu.hk
+gov.hk
+org.hk
+com.tw
+edu.tw
+org.tw
+
+// Korea, Singapore, Southeast Asia
+ac.kr
+co.kr
+or.kr
+com.sg
+edu.sg
+gov.sg
+co.id
+com.my
+com.ph
+co.th
+ac.th
+com.vn
+
+// India, Pakistan
+ac.in
+co.in
+gov.in
+net.in
+org.in
+com.pk
+
+// Americas
+com.ar
+com.br
+gov.br
+net.br
+org.br
+com.co
+com.mx
+gob.mx
+org.mx
+com.pe
+ca.us
+dc.us
+fl.us
+ga.us
+il.us
+ma.us
+ny.us
+oh.us
+pa.us
+tx.us
+va.us
+wa.us
+
+// Europe, Middle East, Africa
+com.es
+com.pl
+com.tr
+com.ua
+co.il
+ac.il
+com.sa
+com.eg
+com.ng
+ac.za
+co.za
+gov.za
+org.za
+
+// Private domains where each subdomain belongs to a different owner
+appspot.com
+blogspot.com
+cloudfront.net
+github.io
+herokuapp.com
+s3.amazonaws.com
+`
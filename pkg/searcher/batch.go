@@ -0,0 +1,163 @@
+package searcher
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// batchNeedle - A digest and every input value that hashes to it
+type batchNeedle struct {
+	digest []byte
+	values []string
+}
+
+// FindAll - Find many values in a single forward pass over the index, the
+// needles are sorted so each search starts where the previous one ended.
+// Results are keyed by input value, values without results map to an
+// empty slice.
+func (i *Index) FindAll(values []string) (map[string][]*Credential, error) {
+	results := map[string][]*Credential{}
+	needles := i.batchNeedles(values, results)
+
+	position := 0
+	for _, needle := range needles {
+		var offsets []int64
+		var err error
+		if lower, upper, ok := i.run(needle.digest); ok {
+			offsets, err = readOffsets(i.index, i.Header, lower, upper)
+			position = upper
+		} else {
+			offsets, position, err = i.gallopOffsets(needle.digest, position)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, offset := range offsets {
+			cred, err := i.credential(offset)
+			if err != nil {
+				return nil, err
+			}
+			matched := false
+			for _, value := range needle.values {
+				if cred.Matches(i.Key, value) {
+					match := *cred
+					results[value] = append(results[value], &match)
+					matched = true
+				}
+			}
+			if !matched {
+				atomic.AddUint64(&i.falseMatches, 1)
+			}
+		}
+	}
+	return results, nil
+}
+
+// gallopOffsets - JSON file offsets of the entries matching needle at or
+// after position, and the position after the last one
+func (i *Index) gallopOffsets(needle []byte, position int) ([]int64, int, error) {
+	if i.fence != nil {
+		lower, _ := i.fence.Range(needle)
+		if position < lower {
+			position = lower
+		}
+	}
+	position, err := i.gallop(needle, position)
+	if err != nil {
+		return nil, position, err
+	}
+	offsets := []int64{}
+	for ; position < i.NumberOfEntries; position++ {
+		entry, err := GetEntry(i.index, i.Header, position)
+		if err != nil {
+			return nil, position, err
+		}
+		if i.Header.Compare(entry.Digest, needle) != 0 {
+			break
+		}
+		offsets = append(offsets, entry.OffsetInt64())
+	}
+	return offsets, position, nil
+}
+
+// batchNeedles - Hash and sort the values, duplicate values are searched once
+func (i *Index) batchNeedles(values []string, results map[string][]*Credential) []*batchNeedle {
+	byDigest := map[string]*batchNeedle{}
+	needles := []*batchNeedle{}
+	for _, value := range values {
+		if _, ok := results[value]; ok {
+			continue
+		}
+		results[value] = []*Credential{}
+		digest := i.Header.Digest(value)
+		if needle, ok := byDigest[string(digest)]; ok {
+			needle.values = append(needle.values, value)
+			continue
+		}
+		needle := &batchNeedle{digest: digest, values: []string{value}}
+		byDigest[string(digest)] = needle
+		needles = append(needles, needle)
+	}
+	sort.Slice(needles, func(a, b int) bool {
+		return i.Header.Compare(needles[a].digest, needles[b].digest) < 0
+	})
+	return needles
+}
+
+// gallop - Index of the first entry at or after position that is not less
+// than needle. The step doubles until we pass the needle and then we binary
+// search the last step, so nearby needles cost a few reads and distant ones
+// cost a logarithmic number of reads.
+func (i *Index) gallop(needle []byte, position int) (int, error) {
+	lower := position
+	step := 1
+	for lower < i.NumberOfEntries {
+		entry, err := GetEntry(i.index, i.Header, lower)
+		if err != nil {
+			return lower, err
+		}
+		if 0 <= i.Header.Compare(entry.Digest, needle) {
+			break
+		}
+		lower += step
+		step *= 2
+	}
+	// The needle is in (lower - step/2, lower]
+	if step == 1 {
+		return lower, nil
+	}
+	end := lower
+	if i.NumberOfEntries < end {
+		end = i.NumberOfEntries
+	}
+	return i.searchEntries(lower-step/2+1, end, func(digest []byte) bool {
+		return 0 <= i.Header.Compare(digest, needle)
+	})
+}
+
+// StartBatch - Find many values in the index file, see Index.FindAll
+func StartBatch(values []string, key string, target string, index string) (map[string][]*Credential, error) {
+	idx, err := Open(target, index, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+	return idx.FindAll(values)
+}
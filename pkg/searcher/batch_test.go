@@ -0,0 +1,117 @@
+package searcher
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// jsonValues - Every value of key in a JSON file
+func jsonValues(t testing.TB, target string, key string) []string {
+	file, err := os.Open(target)
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	defer file.Close()
+	values := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var cred Credential
+		json.Unmarshal(scanner.Bytes(), &cred)
+		value, _ := keyValue(&cred, key)
+		values = append(values, value)
+	}
+	return values
+}
+
+func testFindAll(t *testing.T, index *Index, values []string) {
+	results, err := index.FindAll(values)
+	if err != nil {
+		t.Errorf("FindAll failed %s", err)
+		return
+	}
+	for _, value := range values {
+		expected, _ := index.Find(value)
+		if len(results[value]) != len(expected) {
+			t.Errorf("FindAll returned %d results for '%s', Find returned %d", len(results[value]), value, len(expected))
+			return
+		}
+		for _, cred := range results[value] {
+			if !cred.Matches(index.Key, value) {
+				t.Errorf("FindAll returned %v for '%s'", cred, value)
+				return
+			}
+		}
+	}
+}
+
+func TestFindAllEmail(t *testing.T) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer index.Close()
+	values := jsonValues(t, largeJSON, "email")
+	values = append(values, "does-not-exist@example.com", values[0], "")
+	testFindAll(t, index, values)
+
+	results, _ := index.FindAll([]string{"does-not-exist@example.com"})
+	if matches, ok := results["does-not-exist@example.com"]; !ok || len(matches) != 0 {
+		t.Errorf("Expected an empty result for a missing value, got %v", results)
+		return
+	}
+}
+
+func TestFindAllDomain(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	values := jsonValues(t, largeJSON, "domain")
+	for _, path := range []string{largeDomainIndex, buildIndex(t, tempDir, largeJSON, "domain", 8)} {
+		index, err := Open(largeJSON, path, "domain", nil)
+		if err != nil {
+			t.Errorf("Open failed %s", err)
+			return
+		}
+		testFindAll(t, index, values)
+		testFindAll(t, index, values[:3])
+		index.Close()
+	}
+}
+
+// BenchmarkFind - One search per value
+func BenchmarkFind(b *testing.B) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", nil)
+	if err != nil {
+		b.Fatalf("Open failed %s", err)
+	}
+	defer index.Close()
+	values := jsonValues(b, largeJSON, "email")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, value := range values {
+			index.Find(value)
+		}
+	}
+}
+
+// BenchmarkFindAll - All values in one pass
+func BenchmarkFindAll(b *testing.B) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", nil)
+	if err != nil {
+		b.Fatalf("Open failed %s", err)
+	}
+	defer index.Close()
+	values := jsonValues(b, largeJSON, "email")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		index.FindAll(values)
+	}
+}
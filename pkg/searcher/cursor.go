@@ -0,0 +1,263 @@
+package searcher
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Wildcard - Matches any number of characters in a prefix pattern
+	Wildcard = "*"
+)
+
+var (
+	// ErrNotOrdered - Prefix searches need an ordered index
+	ErrNotOrdered = errors.New("Prefix searches require an ordered index")
+)
+
+// Cursor - Iterates over the entries matching a value without loading them
+// all into memory. Matching entries are contiguous in a sorted index so
+// the cursor only needs the range [First, Last).
+type Cursor struct {
+	First    int
+	Last     int
+	Position int
+
+	index   *Index
+	matches func(cred *Credential) bool
+}
+
+// Cursor - Create a cursor over the entries matching value, the range of
+// a large run is read from the runs sidecar instead of being searched for
+func (i *Index) Cursor(value string) (*Cursor, error) {
+	needle := i.Header.Digest(value)
+	first, last, ok := i.run(needle)
+	if !ok {
+		var err error
+		first, last, err = i.searchRange(needle)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cursor{
+		First:    first,
+		Last:     last,
+		Position: first,
+		index:    i,
+		matches: func(cred *Credential) bool {
+			return cred.Matches(i.Key, value)
+		},
+	}, nil
+}
+
+// searchRange - Binary search the entries [first, last) matching needle
+func (i *Index) searchRange(needle []byte) (int, int, error) {
+	lower, upper := 0, i.NumberOfEntries
+	if i.fence != nil {
+		lower, upper = i.fence.Range(needle)
+	}
+	first, err := i.searchEntries(lower, upper, func(digest []byte) bool {
+		return 0 <= i.Header.Compare(digest, needle)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := i.searchEntries(first, upper, func(digest []byte) bool {
+		return 0 < i.Header.Compare(digest, needle)
+	})
+	return first, last, err
+}
+
+// searchEntries - Like sort.Search, the first entry in [lower, upper) whose
+// digest f is true for. sort.Search cannot stop early so the search ends
+// on the first read error, which is returned once it is done.
+func (i *Index) searchEntries(lower int, upper int, f func(digest []byte) bool) (int, error) {
+	var err error
+	index := lower + sort.Search(upper-lower, func(index int) bool {
+		if err != nil {
+			return true
+		}
+		entry, entryErr := GetEntry(i.index, i.Header, lower+index)
+		if entryErr != nil {
+			err = entryErr
+			return true
+		}
+		return f(entry.Digest)
+	})
+	return index, err
+}
+
+// PrefixCursor - Create a cursor over the values of an ordered index that
+// match a pattern such as "jdoe" or "j*doe", patterns match any value that
+// starts with them. Entries are found by the literal prefix before the
+// first wildcard, the rest of the pattern is checked against each result.
+func (i *Index) PrefixCursor(pattern string) (*Cursor, error) {
+	if !i.Header.IsOrdered() {
+		return nil, ErrNotOrdered
+	}
+	if !strings.HasSuffix(pattern, Wildcard) {
+		pattern += Wildcard
+	}
+	prefix := []byte(strings.ToLower(LiteralPrefix(pattern)))
+	if i.Header.DigestSize < len(prefix) {
+		prefix = prefix[:i.Header.DigestSize]
+	}
+	first, err := i.searchEntries(0, i.NumberOfEntries, func(digest []byte) bool {
+		return 0 <= bytes.Compare(digest[:len(prefix)], prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	last, err := i.searchEntries(first, i.NumberOfEntries, func(digest []byte) bool {
+		return 0 < bytes.Compare(digest[:len(prefix)], prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	foldCase := i.Key != "password"
+	return &Cursor{
+		First:    first,
+		Last:     last,
+		Position: first,
+		index:    i,
+		matches: func(cred *Credential) bool {
+			value, _ := keyValue(cred, i.Key)
+			return matchWildcard(pattern, value, foldCase)
+		},
+	}, nil
+}
+
+// LiteralPrefix - The part of a pattern before the first wildcard
+func LiteralPrefix(pattern string) string {
+	if index := strings.Index(pattern, Wildcard); 0 <= index {
+		return pattern[:index]
+	}
+	return pattern
+}
+
+// matchWildcard - The whole value matches the pattern, each "*" matches
+// any number of characters
+func matchWildcard(pattern string, value string, foldCase bool) bool {
+	if foldCase {
+		pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	}
+	parts := strings.Split(pattern, Wildcard)
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := len(parts) - 1
+	if last == 0 {
+		return value == ""
+	}
+	for _, part := range parts[1:last] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+	return strings.HasSuffix(value, parts[last])
+}
+
+// Count - Number of entries with a matching digest, computed without
+// reading the JSON file. This may include rare digest collisions that
+// Next will skip, and for prefix cursors any value that matches the
+// literal prefix but not the rest of the pattern.
+func (c *Cursor) Count() int {
+	return c.Last - c.First
+}
+
+// Skip - Move the cursor to the nth matching entry
+func (c *Cursor) Skip(n int) {
+	c.Position = c.First + n
+	if c.Position < c.First {
+		c.Position = c.First
+	}
+	if c.Last < c.Position {
+		c.Position = c.Last
+	}
+}
+
+// Next - Get the next matching credential, returns io.EOF once the cursor
+// reaches the end of the matching entries
+func (c *Cursor) Next() (*Credential, error) {
+	for c.Position < c.Last {
+		entry, err := GetEntry(c.index.index, c.index.Header, c.Position)
+		if err != nil {
+			return nil, err
+		}
+		c.Position++
+		cred, err := c.credentialAt(entry.OffsetInt64())
+		if err != nil || cred != nil {
+			return cred, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// credentialAt - The credential of the line at offset, nil if it does not
+// match the cursor
+func (c *Cursor) credentialAt(offset int64) (*Credential, error) {
+	cred, err := c.index.credential(offset)
+	if err != nil {
+		return nil, err
+	}
+	if c.matches(cred) {
+		return cred, nil
+	}
+	atomic.AddUint64(&c.index.falseMatches, 1)
+	return nil, nil
+}
+
+// Page - Credentials of the entries [page*pageSize, (page+1)*pageSize),
+// pages may be short if they contain digest collisions. The entries of a
+// page are read with a single read, so paging deep into a large run costs
+// the same as reading the first page.
+func (c *Cursor) Page(page int, pageSize int) ([]*Credential, error) {
+	c.Skip(page * pageSize)
+	end := c.Position + pageSize
+	if c.Last < end {
+		end = c.Last
+	}
+	results := []*Credential{}
+	if end <= c.Position {
+		return results, nil
+	}
+	offsets, err := readOffsets(c.index.index, c.index.Header, c.Position, end)
+	if err != nil {
+		return nil, err
+	}
+	c.Position = end
+	for _, offset := range offsets {
+		cred, err := c.credentialAt(offset)
+		if err != nil {
+			return nil, err
+		}
+		if cred != nil {
+			results = append(results, cred)
+		}
+	}
+	return results, nil
+}
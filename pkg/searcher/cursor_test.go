@@ -0,0 +1,207 @@
+package searcher
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/sorter"
+)
+
+func TestCursor(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	domains := []string{"nsw.gov.au", "does-not-exist.com"}
+	for _, cred := range largeCreds {
+		domains = append(domains, cred.Domain)
+	}
+	for _, path := range []string{largeDomainIndex, buildIndex(t, tempDir, largeJSON, "domain", 6)} {
+		index, err := Open(largeJSON, path, "domain", nil)
+		if err != nil {
+			t.Errorf("Open failed %s", err)
+			return
+		}
+		defer index.Close()
+		for _, domain := range domains {
+			expected, _ := index.Find(domain)
+			cursor, err := index.Cursor(domain)
+			if err != nil || cursor.Count() != len(expected) {
+				t.Errorf("Cursor count %d != %d for %s (%v)", cursor.Count(), len(expected), domain, err)
+				return
+			}
+			results := cursorResults(t, cursor)
+			for _, cred := range results {
+				if cred.Domain != domain {
+					t.Errorf("Cursor returned %v for %s", cred, domain)
+					return
+				}
+			}
+			if len(results) != len(expected) {
+				t.Errorf("Cursor returned %d results, expected %d", len(results), len(expected))
+				return
+			}
+
+			// Pages must cover every result exactly once
+			paged := 0
+			for page := 0; page*4 < cursor.Count(); page++ {
+				results, err := cursor.Page(page, 4)
+				if err != nil || 4 < len(results) {
+					t.Errorf("Page %d has %d results (%v)", page, len(results), err)
+					return
+				}
+				paged += len(results)
+			}
+			if paged != len(expected) {
+				t.Errorf("Pages returned %d results, expected %d", paged, len(expected))
+				return
+			}
+			if results, err := cursor.Page(100, 4); err != nil || len(results) != 0 {
+				t.Errorf("Page past the end returned %d results (%v)", len(results), err)
+				return
+			}
+		}
+	}
+}
+
+// cursorResults - Every credential the cursor returns
+func cursorResults(t *testing.T, cursor *Cursor) []*Credential {
+	results := []*Credential{}
+	for {
+		cred, err := cursor.Next()
+		if err == io.EOF {
+			return results
+		}
+		if err != nil {
+			t.Fatalf("Cursor failed %s", err)
+		}
+		results = append(results, cred)
+	}
+}
+
+func buildOrderedIndex(t *testing.T, tempDir string, target string, key string, prefixSize int) string {
+	unsorted := filepath.Join(tempDir, key+"-ordered.idx")
+	index, err := indexer.GetOrderedIndexer(target, unsorted, key, prefixSize, 2, tempDir, false)
+	if err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	if err = index.Start(); err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	sorted := filepath.Join(tempDir, key+"-ordered-sorted.idx")
+	sort, err := sorter.GetSorter(unsorted, sorted, 2, 1, tempDir, false)
+	if err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	if err = sort.Start(); err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	return sorted
+}
+
+func TestPrefixCursor(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	users := jsonValues(t, largeJSON, "user")
+	for _, prefixSize := range []int{indexfile.MinPrefixSize, indexfile.DefaultPrefixSize} {
+		index, err := Open(largeJSON, buildOrderedIndex(t, tempDir, largeJSON, "user", prefixSize), "", nil)
+		if err != nil {
+			t.Errorf("Open failed %s", err)
+			return
+		}
+		defer index.Close()
+		if index.HasFence() {
+			t.Errorf("Ordered indexes should not have a fence")
+			return
+		}
+
+		for _, pattern := range []string{"pspoor2", "ps", "PSPO", "p*r2", "*2", "a*b*c", "does-not-exist", users[0], users[0] + "*"} {
+			expected := 0
+			for _, user := range users {
+				if matchWildcard(pattern+"*", user, true) {
+					expected++
+				}
+			}
+			cursor, err := index.PrefixCursor(pattern)
+			if err != nil {
+				t.Errorf("PrefixCursor failed %s", err)
+				return
+			}
+			results := cursorResults(t, cursor)
+			for _, cred := range results {
+				if !matchWildcard(pattern+"*", cred.User, true) {
+					t.Errorf("PrefixCursor(%s) returned %v", pattern, cred)
+					return
+				}
+			}
+			if len(results) != expected {
+				t.Errorf("PrefixCursor(%s) found %d of %d (prefix size %d)", pattern, len(results), expected, prefixSize)
+				return
+			}
+		}
+
+		// Exact searches still work on an ordered index
+		for _, cred := range largeCreds {
+			results, err := index.Find(cred.User)
+			if err != nil || len(results) == 0 {
+				t.Errorf("Find(%s) on an ordered index returned %v (%v)", cred.User, results, err)
+				return
+			}
+			for _, result := range results {
+				if !strings.EqualFold(result.User, cred.User) {
+					t.Errorf("Find(%s) on an ordered index returned %v", cred.User, result)
+					return
+				}
+			}
+		}
+	}
+
+	index, err := Open(largeJSON, largeEmailIndex, "email", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer index.Close()
+	if _, err = index.PrefixCursor("ps"); err != ErrNotOrdered {
+		t.Errorf("Expected %s, got %v", ErrNotOrdered, err)
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		value    string
+		foldCase bool
+		match    bool
+	}{
+		{"jdoe*", "jdoe", true, true},
+		{"jdoe*", "JDoe99", true, true},
+		{"jdoe*", "JDoe99", false, false},
+		{"jdoe", "jdoe99", true, false},
+		{"j*doe", "jdoe", true, true},
+		{"j*doe", "john.doe", true, true},
+		{"j*doe", "john.doe2", true, false},
+		{"*doe*", "john.doe2", true, true},
+		{"a*b*b", "abb", true, true},
+		{"a*b*b", "ab", true, false},
+		{"*", "", true, true},
+	} {
+		if matchWildcard(test.pattern, test.value, test.foldCase) != test.match {
+			t.Errorf("matchWildcard(%q, %q, %v) != %v", test.pattern, test.value, test.foldCase, test.match)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package searcher
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+// Options - How an index is opened
+type Options struct {
+	// Mmap - Memory-map the index and JSON files
+	Mmap bool
+	// FenceInterval - Keep every Nth digest in memory when the index has no
+	// fence sidecar, 0 disables the in-memory fence
+	FenceInterval int
+}
+
+// fence - Narrows a search to the entries in [lower, upper)
+type fence interface {
+	Range(needle []byte) (int, int)
+}
+
+// sampledFence - Every interval-th digest of the index
+type sampledFence struct {
+	interval        int
+	digestSize      int
+	numberOfEntries int
+	samples         []byte
+}
+
+func newSampledFence(indexFile io.ReaderAt, header *indexfile.Header, numberOfEntries int, interval int) (*sampledFence, error) {
+	fence := &sampledFence{
+		interval:        interval,
+		digestSize:      header.DigestSize,
+		numberOfEntries: numberOfEntries,
+		samples:         []byte{},
+	}
+	digest := make([]byte, header.DigestSize)
+	for index := 0; index < numberOfEntries; index += interval {
+		_, err := indexFile.ReadAt(digest, header.Position(index))
+		if err != nil {
+			return nil, err
+		}
+		fence.samples = append(fence.samples, digest...)
+	}
+	return fence, nil
+}
+
+func (f *sampledFence) sample(index int) []byte {
+	return f.samples[index*f.digestSize : (index+1)*f.digestSize]
+}
+
+// Range - Matches start after the last sample less than needle and end
+// before the first sample greater than needle
+func (f *sampledFence) Range(needle []byte) (int, int) {
+	numberOfSamples := len(f.samples) / f.digestSize
+	first := sort.Search(numberOfSamples, func(index int) bool {
+		return 0 <= indexfile.Compare(f.sample(index), needle)
+	})
+	last := sort.Search(numberOfSamples, func(index int) bool {
+		return 0 < indexfile.Compare(f.sample(index), needle)
+	})
+	lower := 0
+	if 0 < first {
+		lower = (first - 1) * f.interval
+	}
+	upper := last * f.interval
+	if f.numberOfEntries < upper {
+		upper = f.numberOfEntries
+	}
+	return lower, upper
+}
+
+// Index - An open index and the JSON file it was created from, all reads
+// use ReadAt so Find can be called from multiple goroutines
+type Index struct {
+	// Number of lines with a matching digest but not a matching value,
+	// first so it is 64-bit aligned for atomic access
+	falseMatches uint64
+
+	Header          *indexfile.Header
+	Key             string
+	NumberOfEntries int
+	// Stats - Stats from the sorter's sidecar, nil if there is none
+	Stats *indexfile.Stats
+	// Runs - Large runs of identical digests from the sorter's sidecar,
+	// nil if there is none
+	Runs *indexfile.Runs
+
+	targetFiles []*os.File
+	indexFile   *os.File
+	target      io.ReaderAt
+	index       io.ReaderAt
+	mappings    [][]byte
+	fence       fence
+}
+
+// shardReader - Reads the JSON file of the shard in the high bits of the
+// offset, see indexfile.Location
+type shardReader []io.ReaderAt
+
+func (s shardReader) ReadAt(buf []byte, location int64) (int, error) {
+	shard, offset := indexfile.SplitLocation(location)
+	if len(s) <= int(shard) || s[shard] == nil {
+		return 0, fmt.Errorf("Shard %d is not in the dataset", shard)
+	}
+	return s[shard].ReadAt(buf, offset)
+}
+
+// Find - Find all credentials where the index key equals value
+func (i *Index) Find(value string) ([]*Credential, error) {
+	needle := i.Header.Digest(value)
+	var offsets []int64
+	var err error
+	if lower, upper, ok := i.run(needle); ok {
+		offsets, err = readOffsets(i.index, i.Header, lower, upper)
+	} else {
+		lower, upper := 0, i.NumberOfEntries
+		if i.fence != nil {
+			lower, upper = i.fence.Range(needle)
+		}
+		offsets, err = findOffsets(needle, i.index, i.Header, lower, upper)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return i.matchOffsets(offsets, value)
+}
+
+// FalseMatches - Number of digest collisions discarded by searches of this
+// index, this is a debug metric
+func (i *Index) FalseMatches() uint64 {
+	return atomic.LoadUint64(&i.falseMatches)
+}
+
+// Count - Number of entries with a matching digest, like Cursor.Count this
+// may include rare digest collisions. Values with a large run are counted
+// from the runs sidecar without reading the index.
+func (i *Index) Count(value string) (int, error) {
+	needle := i.Header.Digest(value)
+	if lower, upper, ok := i.run(needle); ok {
+		return upper - lower, nil
+	}
+	cursor, err := i.Cursor(value)
+	if err != nil {
+		return 0, err
+	}
+	return cursor.Count(), nil
+}
+
+// run - Entries [lower, upper) if needle has a run in the runs sidecar
+func (i *Index) run(needle []byte) (int, int, bool) {
+	if i.Runs == nil {
+		return 0, 0, false
+	}
+	run, ok := i.Runs.Lookup(needle)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(run.Start), int(run.Start + run.Length), true
+}
+
+// HasFence - Searches are narrowed by a fence
+func (i *Index) HasFence() bool {
+	return i.fence != nil
+}
+
+// HasRuns - Large runs are read from a runs sidecar
+func (i *Index) HasRuns() bool {
+	return i.Runs != nil
+}
+
+// IsMapped - The index and JSON files are memory-mapped
+func (i *Index) IsMapped() bool {
+	return 0 < len(i.mappings)
+}
+
+// Close - Unmap and close the files
+func (i *Index) Close() error {
+	var err error
+	for _, data := range i.mappings {
+		if unmapErr := munmap(data); unmapErr != nil && err == nil {
+			err = unmapErr
+		}
+	}
+	i.mappings = nil
+	for _, file := range append([]*os.File{i.indexFile}, i.targetFiles...) {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Open - Open an index and the JSON file it was created from, key may be
+// blank if the index has a header. Sharded indexes are opened with the
+// dataset manifest in place of the JSON file. If options.Mmap is set the
+// files are memory-mapped, when the platform does not support mmap the
+// files are read normally. An index of a single shard can also be opened
+// with the manifest. The fence sidecar written by the sorter is
+// loaded if it exists and matches the index, as are the stats and runs
+// sidecars.
+func Open(target string, index string, key string, options *Options) (*Index, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	indexFile, err := openFile(index)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{
+		indexFile: indexFile,
+		index:     indexFile,
+	}
+	err = idx.load(target, index, key, options)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (i *Index) load(target string, index string, key string, options *Options) error {
+	header, err := indexfile.Read(i.indexFile)
+	if err != nil {
+		return err
+	}
+	if header.IsSharded() {
+		err = i.openShards(target, header, options)
+	} else {
+		err = i.openTarget(target, header, options)
+	}
+	if err != nil {
+		return fmt.Errorf("%s (%s, %s)", err, index, target)
+	}
+	i.Key, err = resolveKey(key, header)
+	if err != nil {
+		return err
+	}
+	i.Header = header
+
+	indexStat, err := i.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	i.NumberOfEntries = header.NumberOfEntries(indexStat.Size())
+	id, err := indexfile.NewIndexID(i.indexFile, indexStat.Size())
+	if err != nil {
+		return err
+	}
+
+	if options.Mmap {
+		i.index, err = i.mmap(i.indexFile, i.index)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A missing or stale sidecar is not an error, it just means searches
+	// are slower. Fences bucket entries by digest so ordered indexes
+	// never have one.
+	stats, err := indexfile.ReadStatsFile(indexfile.StatsPath(index), id)
+	if err == nil {
+		i.Stats = stats
+	}
+	runs, err := indexfile.ReadRunsFile(indexfile.RunsPath(index), id)
+	if err == nil && (len(runs.Runs) == 0 || runs.DigestSize == header.DigestSize) {
+		i.Runs = runs
+	}
+	if header.IsOrdered() {
+		return nil
+	}
+	fence, err := indexfile.ReadFenceFile(indexfile.FencePath(index), id)
+	if err == nil {
+		i.fence = fence
+	} else if 0 < options.FenceInterval {
+		i.fence, err = newSampledFence(i.index, header, i.NumberOfEntries, options.FenceInterval)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openTarget - Open the JSON file of an index
+func (i *Index) openTarget(target string, header *indexfile.Header, options *Options) error {
+	err := header.Verify(target)
+	if err != nil {
+		return err
+	}
+	i.target, err = i.openJSON(target, options)
+	return err
+}
+
+// openShards - Open the JSON file of every shard of a dataset manifest the
+// index was created from
+func (i *Index) openShards(target string, header *indexfile.Header, options *Options) error {
+	manifest, err := indexfile.ReadManifest(target)
+	if err != nil {
+		return err
+	}
+	indexed, err := header.IndexedShards(manifest)
+	if err != nil {
+		return err
+	}
+	shards := shardReader{}
+	for _, shard := range indexed {
+		err = manifest.VerifyShard(shard)
+		if err != nil {
+			return err
+		}
+		for len(shards) <= int(shard.ID) {
+			shards = append(shards, nil)
+		}
+		shards[shard.ID], err = i.openJSON(manifest.Path(shard), options)
+		if err != nil {
+			return err
+		}
+	}
+	i.target = shards
+	return nil
+}
+
+func (i *Index) openJSON(path string, options *Options) (io.ReaderAt, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i.targetFiles = append(i.targetFiles, file)
+	if options.Mmap {
+		return i.mmap(file, file)
+	}
+	return file, nil
+}
+
+// mmap - Memory-map file, if the platform does not support mmap reader
+// is returned
+func (i *Index) mmap(file *os.File, reader io.ReaderAt) (io.ReaderAt, error) {
+	data, err := mmapFile(file)
+	if err == errMmapUnsupported {
+		return reader, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.mappings = append(i.mappings, data)
+	return bytes.NewReader(data), nil
+}
+
+func openFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return file, nil
+}
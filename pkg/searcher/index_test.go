@@ -0,0 +1,492 @@
+package searcher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/sorter"
+)
+
+func testIndexFind(t *testing.T, useMmap bool) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", &Options{Mmap: useMmap})
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer index.Close()
+	for _, cred := range largeCreds {
+		results, err := index.Find(cred.Email)
+		if err != nil {
+			t.Errorf("Find failed %s", err)
+			return
+		}
+		if len(results) != 1 || results[0].Password != cred.Password {
+			t.Errorf("Find returned unexpected results %v", results)
+			return
+		}
+	}
+	results, err := index.Find("does-not-exist@example.com")
+	if err != nil || len(results) != 0 {
+		t.Errorf("Find of missing value returned %v (%v)", results, err)
+		return
+	}
+}
+
+func TestIndexFind(t *testing.T) {
+	testIndexFind(t, false)
+}
+
+func TestIndexFindMmap(t *testing.T) {
+	testIndexFind(t, true)
+}
+
+func TestIndexFindConcurrent(t *testing.T) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", &Options{Mmap: true})
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer index.Close()
+	wg := sync.WaitGroup{}
+	errs := make(chan string, 8*len(largeCreds))
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, cred := range largeCreds {
+				results, err := index.Find(cred.Email)
+				if err != nil || len(results) != 1 || results[0].Email != cred.Email {
+					errs <- cred.Email
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for email := range errs {
+		t.Errorf("Concurrent find failed for %s", email)
+	}
+}
+
+func TestIndexOpenInvalid(t *testing.T) {
+	_, err := Open(largeJSON, "../../test", "email", nil)
+	if err == nil {
+		t.Errorf("Expected error opening a directory as an index")
+		return
+	}
+	_, err = Open("does-not-exist.json", largeEmailIndex, "email", nil)
+	if err == nil {
+		t.Errorf("Expected error opening missing JSON file")
+		return
+	}
+}
+
+func TestIndexFence(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Domains have many duplicates so matches span fence boundaries
+	domains := []string{"nsw.gov.au", "does-not-exist.com"}
+	for _, cred := range largeCreds {
+		domains = append(domains, cred.Domain)
+	}
+	expected := map[string]int{}
+	index := buildIndex(t, tempDir, largeJSON, "domain", 6)
+	plain, err := Open(largeJSON, largeDomainIndex, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer plain.Close()
+	for _, domain := range domains {
+		results, _ := plain.Find(domain)
+		expected[domain] = len(results)
+	}
+	if expected["nsw.gov.au"] != 13 {
+		t.Errorf("Expected 13 results without a fence, got %d", expected["nsw.gov.au"])
+		return
+	}
+
+	check := func(idx *Index, name string) {
+		for _, domain := range domains {
+			results, err := idx.Find(domain)
+			if err != nil || len(results) != expected[domain] {
+				t.Errorf("%s: expected %d results for %s, got %d (%v)", name, expected[domain], domain, len(results), err)
+			}
+		}
+	}
+
+	sidecar, err := Open(largeJSON, index, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer sidecar.Close()
+	if !sidecar.HasFence() {
+		t.Errorf("Expected the sorter's fence sidecar to be loaded")
+		return
+	}
+	check(sidecar, "sidecar")
+
+	for _, interval := range []int{1, 7, 100, 100000} {
+		sampled, err := Open(largeJSON, largeDomainIndex, "domain", &Options{FenceInterval: interval})
+		if err != nil {
+			t.Errorf("Open failed %s", err)
+			return
+		}
+		check(sampled, "sampled")
+		sampled.Close()
+	}
+
+	// A fence from a different index must not be used
+	fence, _ := ioutil.ReadFile(indexfile.FencePath(index))
+	stale := tempDir + "/stale.idx"
+	ioutil.WriteFile(stale, []byte{}, 0600)
+	ioutil.WriteFile(indexfile.FencePath(stale), fence, 0600)
+	staleIndex, err := Open(largeJSON, stale, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer staleIndex.Close()
+	if staleIndex.HasFence() {
+		t.Errorf("Stale fence was loaded")
+		return
+	}
+
+	// Nor any sidecar of an index with the same number of entries
+	if sidecar.Stats == nil || !sidecar.HasRuns() {
+		t.Errorf("Expected the sorter's stats and runs sidecars to be loaded")
+		return
+	}
+	for _, path := range []func(string) string{indexfile.StatsPath, indexfile.RunsPath} {
+		data, _ := ioutil.ReadFile(path(index))
+		ioutil.WriteFile(path(stale), data, 0600)
+	}
+	data, _ := ioutil.ReadFile(index)
+	entrySize := sidecar.Header.EntrySize()
+	last := data[len(data)-entrySize+sidecar.Header.DigestSize:]
+	last[0]++ // Offset of the last entry
+	ioutil.WriteFile(stale, data, 0600)
+	staleIndex, err = Open(largeJSON, stale, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer staleIndex.Close()
+	if staleIndex.HasFence() || staleIndex.Stats != nil || staleIndex.HasRuns() {
+		t.Errorf("Sidecars of a different index were loaded")
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	index, err := Open(largeJSON, buildIndex(t, tempDir, largeJSON, "domain", 6), "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer index.Close()
+	if index.Stats == nil {
+		t.Errorf("Expected the sorter's stats sidecar to be loaded")
+		return
+	}
+	stats := index.Stats
+	if stats.Entries != 8000 || stats.DistinctDigests < 1 || 8000 <= stats.DistinctDigests || stats.LargestRun < 13 {
+		t.Errorf("Unexpected stats %+v", stats)
+		return
+	}
+
+	legacy, err := Open(largeJSON, largeDomainIndex, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer legacy.Close()
+	if legacy.Stats != nil {
+		t.Errorf("Index without a stats sidecar has stats")
+	}
+}
+
+// runsJSON - The large fixture plus a domain and an empty domain with runs
+// longer than a block, like gmail.com in a real dataset
+func runsJSON(t *testing.T, tempDir string) string {
+	data, err := ioutil.ReadFile(largeJSON)
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	}
+	buf := bytes.NewBuffer(data)
+	for n := 0; n < 6000; n++ {
+		fmt.Fprintf(buf, `{"email": "user%d@gmail.com", "user": "user%d", "domain": "gmail.com", "password": "%d"}`+"\n", n, n, n)
+		if n%4 == 0 {
+			fmt.Fprintf(buf, `{"email": "", "user": "nodomain%d", "domain": "", "password": "%d"}`+"\n", n, n)
+		}
+	}
+	target := filepath.Join(tempDir, "runs.json")
+	ioutil.WriteFile(target, buf.Bytes(), 0644)
+	return target
+}
+
+func TestIndexRuns(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	target := runsJSON(t, tempDir)
+	index := buildIndex(t, tempDir, target, "domain", 8)
+	runs, err := Open(target, index, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer runs.Close()
+	if !runs.HasRuns() || len(runs.Runs.Runs) != 2 {
+		t.Errorf("Expected the sorter's runs sidecar with 2 runs, got %+v", runs.Runs)
+		return
+	}
+	scanned, err := Open(target, index, "domain", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer scanned.Close()
+	scanned.Runs = nil
+
+	expected := map[string]int{"gmail.com": 6000, "": 1500, "nsw.gov.au": 13, "does-not-exist.com": 0}
+	values := []string{}
+	for value, count := range expected {
+		values = append(values, value)
+		runsCount, _ := runs.Count(value)
+		scannedCount, _ := scanned.Count(value)
+		if runsCount != count || scannedCount != count {
+			t.Errorf("Expected a count of %d for '%s', got %d and %d without runs", count, value, runsCount, scannedCount)
+			return
+		}
+		results, _ := runs.Find(value)
+		if len(results) != count {
+			t.Errorf("Expected %d results for '%s', got %d", count, value, len(results))
+			return
+		}
+		for _, cred := range results {
+			if !cred.Matches("domain", value) {
+				t.Errorf("Find returned %v for '%s'", cred, value)
+				return
+			}
+		}
+
+		// Pages deep into a run are the same as walking the run
+		cursor, err := runs.Cursor(value)
+		if err != nil {
+			t.Errorf("Cursor failed %s", err)
+			return
+		}
+		scanCursor, err := scanned.Cursor(value)
+		if err != nil {
+			t.Errorf("Cursor failed %s", err)
+			return
+		}
+		if cursor.First != scanCursor.First || cursor.Last != scanCursor.Last {
+			t.Errorf("Cursor of '%s' is [%d, %d) expected [%d, %d)", value, cursor.First, cursor.Last, scanCursor.First, scanCursor.Last)
+			return
+		}
+		for _, page := range []int{0, 1, 7, count / 100} {
+			paged, err := cursor.Page(page, 100)
+			if err != nil {
+				t.Errorf("Page %d of '%s' failed %s", page, value, err)
+				return
+			}
+			scanCursor.Skip(page * 100)
+			for _, cred := range paged {
+				walked, err := scanCursor.Next()
+				if err != nil || *walked != *cred {
+					t.Errorf("Page %d of '%s' has %v, expected %v", page, value, cred, walked)
+					return
+				}
+			}
+		}
+	}
+	testFindAll(t, runs, values)
+}
+
+// BenchmarkStart - Opens the files on every query
+func BenchmarkStart(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		cred := largeCreds[n%len(largeCreds)]
+		Start(cred.Email, "email", largeJSON, largeEmailIndex)
+	}
+}
+
+func benchmarkIndexFind(b *testing.B, useMmap bool) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", &Options{Mmap: useMmap})
+	if err != nil {
+		b.Fatalf("Open failed %s", err)
+	}
+	defer index.Close()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cred := largeCreds[n%len(largeCreds)]
+		index.Find(cred.Email)
+	}
+}
+
+// BenchmarkIndexFind - Reuses open files
+func BenchmarkIndexFind(b *testing.B) {
+	benchmarkIndexFind(b, false)
+}
+
+// BenchmarkIndexFindMmap - Reuses memory-mapped files
+func BenchmarkIndexFindMmap(b *testing.B) {
+	benchmarkIndexFind(b, true)
+}
+
+// BenchmarkIndexFindFence - Reuses open files, narrowing with an in-memory fence
+func BenchmarkIndexFindFence(b *testing.B) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", &Options{FenceInterval: 64})
+	if err != nil {
+		b.Fatalf("Open failed %s", err)
+	}
+	defer index.Close()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cred := largeCreds[n%len(largeCreds)]
+		index.Find(cred.Email)
+	}
+}
+
+// buildShards - Split target into two shards of a dataset and build a
+// merged sharded index of key
+func buildShards(t *testing.T, tempDir string, target string, key string) (string, string, []string) {
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	half := len(lines) / 2
+	manifestPath := filepath.Join(tempDir, "dataset.json")
+	manifest := indexfile.NewManifest(manifestPath)
+	sorted := []string{}
+	for id, shardLines := range [][][]byte{lines[:half], lines[half:]} {
+		shardPath := filepath.Join(tempDir, fmt.Sprintf("shard-%d.json", id))
+		ioutil.WriteFile(shardPath, bytes.Join(shardLines, nil), 0644)
+		shard, err := manifest.Add(shardPath)
+		if err != nil {
+			t.Fatalf("Manifest error: %s", err)
+		}
+		unsorted := filepath.Join(tempDir, fmt.Sprintf("shard-%d.idx", id))
+		index, err := indexer.GetIndexer(shardPath, unsorted, key, 8, 2, tempDir, false)
+		if err != nil {
+			t.Fatalf("Index error: %s", err)
+		}
+		if err = index.SetShard(shard); err != nil {
+			t.Fatalf("Shard error: %s", err)
+		}
+		if err = index.Start(); err != nil {
+			t.Fatalf("Index error: %s", err)
+		}
+		sorted = append(sorted, filepath.Join(tempDir, fmt.Sprintf("shard-%d-sorted.idx", id)))
+		sort, err := sorter.GetSorter(unsorted, sorted[id], 2, 1, tempDir, false)
+		if err != nil {
+			t.Fatalf("Sort error: %s", err)
+		}
+		if err = sort.Start(); err != nil {
+			t.Fatalf("Sort error: %s", err)
+		}
+	}
+	if err = manifest.WriteFile(manifestPath); err != nil {
+		t.Fatalf("Manifest error: %s", err)
+	}
+	merged := filepath.Join(tempDir, "merged.idx")
+	if err = sorter.Merge(sorted, merged); err != nil {
+		t.Fatalf("Merge error: %s", err)
+	}
+	return manifestPath, merged, sorted
+}
+
+func TestIndexSharded(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifest, merged, shards := buildShards(t, tempDir, largeJSON, "email")
+	for _, useMmap := range []bool{false, true} {
+		index, err := Open(manifest, merged, "", &Options{Mmap: useMmap})
+		if err != nil {
+			t.Errorf("Open failed %s", err)
+			return
+		}
+		defer index.Close()
+		if !index.HasFence() || index.NumberOfEntries != len(jsonValues(t, largeJSON, "email")) {
+			t.Errorf("Unexpected merged index %d entries (fence %v)", index.NumberOfEntries, index.HasFence())
+			return
+		}
+		for _, cred := range largeCreds {
+			results, err := index.Find(cred.Email)
+			if err != nil || len(results) != 1 || results[0].Password != cred.Password {
+				t.Errorf("Find(%s) returned %v (%v)", cred.Email, results, err)
+				return
+			}
+		}
+		results, _ := index.FindAll(jsonValues(t, largeJSON, "email"))
+		for value, creds := range results {
+			if len(creds) == 0 {
+				t.Errorf("FindAll did not find '%s'", value)
+				return
+			}
+		}
+	}
+
+	// A sharded index must be opened with the manifest of its shards
+	if _, err = Open(largeJSON, merged, "", nil); err == nil {
+		t.Errorf("Expected an error opening a sharded index with a JSON file")
+		return
+	}
+	first, err := Open(manifest, shards[0], "", nil)
+	if err != nil {
+		t.Errorf("Open of one shard failed %s", err)
+		return
+	}
+	defer first.Close()
+	firstData, _ := ioutil.ReadFile(filepath.Join(tempDir, "shard-0.json"))
+	for _, cred := range largeCreds {
+		results, err := first.Find(cred.Email)
+		inFirst := bytes.Contains(firstData, []byte(`"`+cred.Email+`"`))
+		if err != nil || (len(results) == 1) != inFirst {
+			t.Errorf("Find(%s) in the first shard returned %v (%v)", cred.Email, results, err)
+			return
+		}
+	}
+	other, _ := indexfile.ReadManifest(manifest)
+	other.Shards = other.Shards[1:]
+	otherPath := filepath.Join(tempDir, "other.json")
+	other.WriteFile(otherPath)
+	if _, err = Open(otherPath, shards[0], "", nil); err == nil {
+		t.Errorf("Expected an error opening a shard that is not in the manifest")
+		return
+	}
+	if _, err = Open(manifest, buildIndex(t, tempDir, largeJSON, "email", 8), "", nil); err == nil {
+		t.Errorf("Expected an error opening an index that is not sharded with a manifest")
+	}
+}
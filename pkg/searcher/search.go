@@ -18,22 +18,29 @@ package searcher
 */
 
 import (
-	"bufio"
-	"crypto/sha256"
-	"encoding/binary"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
 )
 
 const (
-	digestSize = 6
-	offsetSize = 6
+	// Lines are read in chunks of this size until a newline is found
+	lineChunkSize = 512
+
+	// Ranges of up to this many entries are read with a single read
+	maxBlockEntries = 4096
+)
 
-	// EntrySize - Single entry size in bytes
-	EntrySize = digestSize + offsetSize
+var (
+	// ErrNoKey - Results cannot be verified without the key of the index
+	ErrNoKey = errors.New("Index has no key, specify the key it was created from")
 )
 
 // Credential - JSON parsed line
@@ -44,120 +51,278 @@ type Credential struct {
 	Password string
 }
 
-// Entry - [48-bit digest][48-bit offset] = 96-bit (12 byte) entry
+// Entry - [digest][48-bit offset], the digest size is set by the index header
 type Entry struct {
 	Digest []byte
 	Offset []byte
 }
 
-// Value - The numeric value of the digest
-func (e *Entry) Value() uint64 {
-	buf := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	copy(buf, e.Digest)
-	return binary.LittleEndian.Uint64(buf)
-}
-
 // OffsetInt64 - Offset as an int64
 func (e *Entry) OffsetInt64() int64 {
-	buf := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	copy(buf, e.Offset)
-	return int64(binary.LittleEndian.Uint64(buf))
+	return indexfile.Offset(e.Offset)
 }
 
 // GetEntry - Get an index entry from file at index
-func GetEntry(indexFile *os.File, index int) *Entry {
-	position := int64(index * EntrySize)
-	entry := &Entry{
-		Digest: make([]byte, digestSize),
-		Offset: make([]byte, offsetSize),
-	}
-	_, err := indexFile.ReadAt(entry.Digest, position)
-	if err != nil && err != io.EOF {
-		panic(fmt.Sprintf("file read error as position %d (%s)", position, err))
-	}
-	_, err = indexFile.ReadAt(entry.Offset, position+digestSize)
-	if err != nil && err != io.EOF {
-		panic(fmt.Sprintf("file read error as position %d (%s)", position+digestSize, err))
+func GetEntry(indexFile io.ReaderAt, header *indexfile.Header, index int) (*Entry, error) {
+	position := header.Position(index)
+	buf := make([]byte, header.EntrySize())
+	n, err := indexFile.ReadAt(buf, position)
+	if n < len(buf) {
+		return nil, fmt.Errorf("Index read error at position %d (%s)", position, err)
 	}
-	return entry
+	return &Entry{
+		Digest: buf[:header.DigestSize],
+		Offset: buf[header.DigestSize:],
+	}, nil
 }
 
-func binaryTreeWalk(needle uint64, indexFile *os.File, numberOfEntries int) (int, error) {
-	lower := 0
-	upper := numberOfEntries - 1 // Zero index
+// binaryTreeWalk - Find any entry matching needle in [lower, upper), -1 if
+// there is none
+func binaryTreeWalk(needle []byte, indexFile io.ReaderAt, header *indexfile.Header, lower int, upper int) (int, error) {
+	upper-- // Zero index
 	for lower <= upper {
 		middle := lower + ((upper - lower) / 2)
-		entryValue := GetEntry(indexFile, middle).Value()
-		if needle < entryValue {
+		entry, err := GetEntry(indexFile, header, middle)
+		if err != nil {
+			return -1, err
+		}
+		cmp := header.Compare(needle, entry.Digest)
+		if cmp < 0 {
 			upper = middle - 1
-		} else if entryValue < needle {
+		} else if 0 < cmp {
 			lower = middle + 1
 		} else {
 			return middle, nil
 		}
 	}
-	return -1, errors.New("Entry not found")
+	return -1, nil
 }
 
-func binaryTreeSearch(needle uint64, targetFile, indexFile *os.File, numberOfEntries int) []*Credential {
-	results := []*Credential{}
-	match, err := binaryTreeWalk(needle, indexFile, numberOfEntries)
-	if err != nil {
-		return []*Credential{}
+// scanBlock - Read [lower, upper) with a single read and search it in memory
+func scanBlock(needle []byte, indexFile io.ReaderAt, header *indexfile.Header, lower int, upper int) ([]int64, error) {
+	entrySize := header.EntrySize()
+	block := make([]byte, (upper-lower)*entrySize)
+	n, err := indexFile.ReadAt(block, header.Position(lower))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Index read error at position %d (%s)", header.Position(lower), err)
+	}
+	numberOfEntries := n / entrySize
+	digest := func(index int) []byte {
+		return block[index*entrySize : index*entrySize+header.DigestSize]
+	}
+	first := sort.Search(numberOfEntries, func(index int) bool {
+		return 0 <= header.Compare(digest(index), needle)
+	})
+	offsets := []int64{}
+	for index := first; index < numberOfEntries && header.Compare(digest(index), needle) == 0; index++ {
+		position := index*entrySize + header.DigestSize
+		offsets = append(offsets, indexfile.Offset(block[position:position+header.OffsetSize]))
+	}
+	return offsets, nil
+}
+
+// findOffsets - JSON file offsets of every entry matching needle, only
+// entries in [lower, upper) are considered. Small ranges are read as one
+// block, large ranges are binary searched on disk.
+func findOffsets(needle []byte, indexFile io.ReaderAt, header *indexfile.Header, lower int, upper int) ([]int64, error) {
+	if upper <= lower {
+		return []int64{}, nil
+	}
+	if upper-lower <= maxBlockEntries {
+		return scanBlock(needle, indexFile, header, lower, upper)
+	}
+	match, err := binaryTreeWalk(needle, indexFile, header, lower, upper)
+	if err != nil || match < 0 {
+		return []int64{}, err
 	}
-	match--
-	for GetEntry(indexFile, match).Value() == needle {
+	for lower < match {
+		entry, err := GetEntry(indexFile, header, match-1)
+		if err != nil {
+			return nil, err
+		}
+		if header.Compare(entry.Digest, needle) != 0 {
+			break
+		}
 		match-- // Walk backwards and find the first entry
 	}
-	match++
-	for GetEntry(indexFile, match).Value() == needle {
-		entry := GetEntry(indexFile, match)
-		targetFile.Seek(entry.OffsetInt64(), 0)
-		reader := bufio.NewReader(targetFile)
-		line, _ := reader.ReadString('\n')
-		var cred Credential
-		json.Unmarshal([]byte(line), &cred)
-		results = append(results, &cred)
-		match++
-	}
-	return results
-}
-
-func find(value string, targetFile, indexFile *os.File, numberOfEntries int) ([]*Credential, error) {
-	digest := sha256.Sum256([]byte(value))
-	buf := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	copy(buf, digest[:digestSize])
-	needle := binary.LittleEndian.Uint64(buf)
-	results := binaryTreeSearch(needle, targetFile, indexFile, numberOfEntries)
+	offsets := []int64{}
+	for ; match < upper; match++ {
+		entry, err := GetEntry(indexFile, header, match)
+		if err != nil {
+			return nil, err
+		}
+		if header.Compare(entry.Digest, needle) != 0 {
+			break
+		}
+		offsets = append(offsets, entry.OffsetInt64())
+	}
+	return offsets, nil
+}
+
+// keyValue - Get the value of a single field from a credential
+func keyValue(cred *Credential, field string) (string, bool) {
+	switch field {
+	case "email":
+		return cred.Email, true
+	case "user":
+		return cred.User, true
+	case "domain":
+		return cred.Domain, true
+	case "password":
+		return cred.Password, true
+	}
+	return "", false
+}
+
+// Matches - Digests are truncated so different values can collide, check
+// the value of the credential actually equals the value we searched for.
+// Composite keys compare each field, passwords are compared exactly,
+// domain suffixes match subdomains, and all other fields are
+// case-insensitive. Nothing matches an invalid key.
+func (cred *Credential) Matches(key string, value string) bool {
+	fields, err := indexfile.ParseKey(key)
+	if err != nil {
+		return false // Unknown key, nothing can match it
+	}
+	values := indexfile.SplitValues(value)
+	if len(values) != len(fields) {
+		return false
+	}
+	for index, field := range fields {
+		credValue, _ := keyValue(cred, field)
+		if field == indexfile.DomainSuffixKey {
+			if !isSubdomain(cred.Domain, values[index]) {
+				return false
+			}
+		} else if field == "password" {
+			if credValue != values[index] {
+				return false
+			}
+		} else if !strings.EqualFold(credValue, values[index]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSubdomain - Domain is parent or a subdomain of parent
+func isSubdomain(domain string, parent string) bool {
+	domain, parent = strings.ToLower(domain), strings.ToLower(parent)
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
+
+// readOffsets - JSON file offsets of the entries in [lower, upper), read in
+// blocks of up to maxBlockEntries so a run is never walked entry by entry
+func readOffsets(indexFile io.ReaderAt, header *indexfile.Header, lower int, upper int) ([]int64, error) {
+	entrySize := header.EntrySize()
+	offsets := make([]int64, 0, upper-lower)
+	block := []byte{}
+	for lower < upper {
+		numberOfEntries := upper - lower
+		if maxBlockEntries < numberOfEntries {
+			numberOfEntries = maxBlockEntries
+		}
+		if len(block) < numberOfEntries*entrySize {
+			block = make([]byte, numberOfEntries*entrySize)
+		}
+		n, err := indexFile.ReadAt(block[:numberOfEntries*entrySize], header.Position(lower))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("Index read error at position %d (%s)", header.Position(lower), err)
+		}
+		if n < numberOfEntries*entrySize {
+			numberOfEntries = n / entrySize
+			upper = lower + numberOfEntries // Truncated index
+		}
+		for index := 0; index < numberOfEntries; index++ {
+			position := index*entrySize + header.DigestSize
+			offsets = append(offsets, indexfile.Offset(block[position:position+header.OffsetSize]))
+		}
+		lower += numberOfEntries
+	}
+	return offsets, nil
+}
+
+// matchOffsets - Credentials of the lines at offsets that match value,
+// lines with a colliding digest are discarded
+func (i *Index) matchOffsets(offsets []int64, value string) ([]*Credential, error) {
+	results := []*Credential{}
+	for _, offset := range offsets {
+		cred, err := i.credential(offset)
+		if err != nil {
+			return nil, err
+		}
+		if cred.Matches(i.Key, value) {
+			results = append(results, cred)
+		} else {
+			atomic.AddUint64(&i.falseMatches, 1)
+		}
+	}
 	return results, nil
 }
 
-// Start - Fine a value in the index file
-func Start(value string, target string, index string) ([]*Credential, error) {
-	targetStat, err := os.Stat(target)
-	if os.IsNotExist(err) || targetStat.IsDir() {
+// credential - Read and parse the line starting at offset, every indexed
+// line is valid JSON so a line that is not means the JSON file has changed
+func (i *Index) credential(offset int64) (*Credential, error) {
+	line, err := readLine(i.target, offset)
+	if err != nil {
 		return nil, err
 	}
-	targetFile, err := os.OpenFile(target, os.O_RDONLY, 0600)
+	cred := &Credential{}
+	err = json.Unmarshal(line, cred)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Invalid JSON line at offset %d (%s)", offset, err)
 	}
-	defer targetFile.Close()
+	return cred, nil
+}
 
-	indexStat, err := os.Stat(index)
-	if os.IsNotExist(err) || indexStat.IsDir() {
-		return nil, err
+// readLine - Read the line starting at offset, ReadAt does not move a file
+// offset so this is safe to call from multiple goroutines
+func readLine(targetFile io.ReaderAt, offset int64) ([]byte, error) {
+	line := []byte{}
+	buf := make([]byte, lineChunkSize)
+	for position := offset; ; {
+		n, err := targetFile.ReadAt(buf, position)
+		if newline := bytes.IndexByte(buf[:n], '\n'); newline != -1 {
+			return append(line, buf[:newline]...), nil
+		}
+		line = append(line, buf[:n]...)
+		if err == io.EOF && 0 < len(line) {
+			return line, nil // Last line without a line ending
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JSON read error at offset %d (%s)", offset, err)
+		}
+		position += int64(n)
 	}
-	indexFile, err := os.OpenFile(index, os.O_RDONLY, 0600)
+}
+
+// resolveKey - The key of the index, legacy indexes do not record a key so
+// the caller must provide it otherwise results could not be verified
+func resolveKey(key string, header *indexfile.Header) (string, error) {
+	if key == "" {
+		if header.Key == "" {
+			return "", ErrNoKey
+		}
+		return header.Key, nil
+	}
+	key, err := indexfile.CanonicalKey(key)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if header.Key != "" && header.Key != key {
+		return "", fmt.Errorf("Index key is '%s' not '%s'", header.Key, key)
 	}
-	defer indexFile.Close()
+	return key, nil
+}
 
-	numberOfEntries := int(indexStat.Size() / EntrySize)
-	results, err := find(value, targetFile, indexFile, numberOfEntries)
+// Start - Find a value in the index file, key is the field the index was
+// created from and may be blank if the index has a header. Start opens the
+// files on every call, use Open to search the same index repeatedly.
+func Start(value string, key string, target string, index string) ([]*Credential, error) {
+	idx, err := Open(target, index, key, nil)
 	if err != nil {
 		return nil, err
 	}
-	return results, nil
+	defer idx.Close()
+	return idx.Find(value)
 }
@@ -1,7 +1,17 @@
 package searcher
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/sorter"
 )
 
 const (
@@ -64,7 +74,7 @@ var (
 
 func TestSearchSmallEmail(t *testing.T) {
 	for _, cred := range smallCreds {
-		results, err := Start(cred.Email, smallJSON, smallEmailIndex)
+		results, err := Start(cred.Email, "email", smallJSON, smallEmailIndex)
 		if err != nil {
 			t.Errorf("Search failed %s", err)
 			return
@@ -83,7 +93,7 @@ func TestSearchSmallEmail(t *testing.T) {
 
 func TestSearchSmallUser(t *testing.T) {
 	for _, cred := range smallCreds {
-		results, err := Start(cred.User, smallJSON, smallUserIndex)
+		results, err := Start(cred.User, "user", smallJSON, smallUserIndex)
 		if len(cred.User) == 0 {
 			t.Errorf("Invalid smallCred %s", cred.User)
 			return
@@ -106,7 +116,7 @@ func TestSearchSmallUser(t *testing.T) {
 
 func TestSearchSmallDomain(t *testing.T) {
 	for _, cred := range smallCreds {
-		results, err := Start(cred.Domain, smallJSON, smallDomainIndex)
+		results, err := Start(cred.Domain, "domain", smallJSON, smallDomainIndex)
 		if err != nil {
 			t.Errorf("Search failed %s", err)
 			return
@@ -125,7 +135,7 @@ func TestSearchSmallDomain(t *testing.T) {
 
 func TestSearchLargeEmail(t *testing.T) {
 	for _, cred := range largeCreds {
-		results, err := Start(cred.Email, largeJSON, largeEmailIndex)
+		results, err := Start(cred.Email, "email", largeJSON, largeEmailIndex)
 		if err != nil {
 			t.Errorf("Search failed %s", err)
 			return
@@ -144,7 +154,7 @@ func TestSearchLargeEmail(t *testing.T) {
 
 func TestSearchLargeUser(t *testing.T) {
 	for _, cred := range largeCreds {
-		results, err := Start(cred.User, largeJSON, largeUserIndex)
+		results, err := Start(cred.User, "user", largeJSON, largeUserIndex)
 		if err != nil {
 			t.Errorf("Search failed %s", err)
 			return
@@ -162,7 +172,7 @@ func TestSearchLargeUser(t *testing.T) {
 
 func TestSearchLargeDomain(t *testing.T) {
 	for _, cred := range largeCreds {
-		results, err := Start(cred.Domain, largeJSON, largeDomainIndex)
+		results, err := Start(cred.Domain, "domain", largeJSON, largeDomainIndex)
 		if err != nil {
 			t.Errorf("Search failed %s", err)
 			return
@@ -185,3 +195,257 @@ func TestSearchLargeDomain(t *testing.T) {
 		}
 	}
 }
+
+// buildIndex - Index and sort target, returns the path of the sorted index
+func buildIndex(t *testing.T, tempDir string, target string, key string, digestSize int) string {
+	unsorted := filepath.Join(tempDir, key+".idx")
+	index, err := indexer.GetIndexer(target, unsorted, key, digestSize, 2, tempDir, false)
+	if err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	if err = index.Start(); err != nil {
+		t.Fatalf("Index error: %s", err)
+	}
+	sorted := filepath.Join(tempDir, key+"-sorted.idx")
+	sort, err := sorter.GetSorter(unsorted, sorted, 2, 1, tempDir, false)
+	if err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	if err = sort.Start(); err != nil {
+		t.Fatalf("Sort error: %s", err)
+	}
+	return sorted
+}
+
+func TestSearchDigestSizes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, digestSize := range []int{6, 8, 12} {
+		index := buildIndex(t, tempDir, largeJSON, "email", digestSize)
+		for _, cred := range largeCreds {
+			results, err := Start(cred.Email, "email", largeJSON, index)
+			if err != nil {
+				t.Errorf("Search failed %s", err)
+				return
+			}
+			if len(results) != 1 || results[0].Password != cred.Password {
+				t.Errorf("%d-bit search returned wrong result %v", digestSize*8, results)
+				return
+			}
+		}
+	}
+}
+
+func TestSearchMismatchedJSON(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	index := buildIndex(t, tempDir, smallJSON, "email", 8)
+	_, err = Start(smallCreds[0].Email, "", largeJSON, index)
+	if err == nil {
+		t.Error("Search did not refuse a mismatched JSON file")
+		return
+	}
+}
+
+func TestSearchFalseMatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Legacy index where both lines have the digest of the first email
+	lines := []string{
+		`{"email":"Jfashion16@ebay.co.uk","user":"jfashion16","domain":"ebay.co.uk","password":"Q4MqeIEG"}`,
+		`{"email":"mmathivath@gov.uk","user":"mmathivath","domain":"gov.uk","password":"unvPnAyz"}`,
+	}
+	target := filepath.Join(tempDir, "collision.json")
+	ioutil.WriteFile(target, []byte(lines[0]+"\n"+lines[1]+"\n"), 0600)
+	digest := indexfile.Digest("jfashion16@ebay.co.uk", indexfile.LegacyDigestSize)
+	index := []byte{}
+	for _, offset := range []int64{0, int64(len(lines[0]) + 1)} {
+		offsetBuf := make([]byte, indexfile.OffsetSize)
+		indexfile.PutOffset(offsetBuf, offset)
+		index = append(index, digest...)
+		index = append(index, offsetBuf...)
+	}
+	indexPath := filepath.Join(tempDir, "collision.idx")
+	ioutil.WriteFile(indexPath, index, 0600)
+
+	if _, err = Open(target, indexPath, "", nil); err != ErrNoKey {
+		t.Errorf("Expected %v opening a legacy index without a key, got %v", ErrNoKey, err)
+		return
+	}
+	idx, err := Open(target, indexPath, "email", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer idx.Close()
+	results, err := idx.Find("jfashion16@ebay.co.uk")
+	if err != nil {
+		t.Errorf("Search failed %s", err)
+		return
+	}
+	if len(results) != 1 || results[0].Password != "Q4MqeIEG" {
+		t.Errorf("Search returned false match %v", results)
+		return
+	}
+	if idx.FalseMatches() != 1 {
+		t.Errorf("Expected one false match, got %d", idx.FalseMatches())
+		return
+	}
+}
+
+type failingReaderAt struct{}
+
+var errReadAt = errors.New("read error")
+
+func (failingReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	return 0, errReadAt
+}
+
+func TestSearchReadErrors(t *testing.T) {
+	index, err := Open(largeJSON, largeEmailIndex, "email", nil)
+	if err != nil {
+		t.Errorf("Open failed %s", err)
+		return
+	}
+	defer index.Close()
+	value := largeCreds[0].Email
+	cursor, err := index.Cursor(value)
+	if err != nil {
+		t.Errorf("Cursor failed %s", err)
+		return
+	}
+
+	// Reads of the JSON file fail
+	target := index.target
+	index.target = failingReaderAt{}
+	if _, err = index.Find(value); err == nil {
+		t.Error("Find did not return the read error")
+		return
+	}
+	if _, err = index.FindAll([]string{value}); err == nil {
+		t.Error("FindAll did not return the read error")
+		return
+	}
+	if _, err = cursor.Next(); err == nil || err == io.EOF {
+		t.Errorf("Next did not return the read error, got %v", err)
+		return
+	}
+	if _, err = cursor.Page(0, 10); err == nil {
+		t.Error("Page did not return the read error")
+		return
+	}
+	index.target = target
+
+	// Reads of the index fail
+	index.index = failingReaderAt{}
+	if _, err = index.Find(value); err == nil {
+		t.Error("Find did not return the read error")
+		return
+	}
+	if _, err = index.FindAll([]string{value}); err == nil {
+		t.Error("FindAll did not return the read error")
+		return
+	}
+	if _, err = index.Cursor(value); err == nil {
+		t.Error("Cursor did not return the read error")
+		return
+	}
+	if _, err = index.Count(value); err == nil {
+		t.Error("Count did not return the read error")
+		return
+	}
+}
+
+func TestSearchComposite(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	index := buildIndex(t, tempDir, largeJSON, "password+email", 8)
+	for _, cred := range largeCreds {
+		value := indexfile.JoinValues([]string{cred.Email, cred.Password})
+		results, err := Start(value, "", largeJSON, index)
+		if err != nil {
+			t.Errorf("Search failed %s", err)
+			return
+		}
+		if len(results) != 1 || results[0].Email != cred.Email {
+			t.Errorf("Composite search returned %v", results)
+			return
+		}
+		results, err = Start(value, "password+email", largeJSON, index)
+		if err != nil || len(results) != 1 {
+			t.Errorf("Composite search with non-canonical key returned %v (%v)", results, err)
+			return
+		}
+		wrong := indexfile.JoinValues([]string{cred.Email, cred.Password + "x"})
+		results, _ = Start(wrong, "", largeJSON, index)
+		if len(results) != 0 {
+			t.Errorf("Composite search with wrong password returned %v", results)
+			return
+		}
+	}
+	if _, err = Start(largeCreds[0].Email, "email", largeJSON, index); err == nil {
+		t.Errorf("Expected key mismatch error")
+	}
+}
+
+func TestSearchDomainSuffix(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	target := filepath.Join(tempDir, "subdomains.json")
+	lines := ""
+	for _, domain := range []string{"example.com", "mail.example.com", "corp.example.co.uk", "example.co.uk", "notexample.com"} {
+		lines += fmt.Sprintf(`{"email": "a@%s", "user": "a", "domain": "%s", "password": "a"}`+"\n", domain, domain)
+	}
+	ioutil.WriteFile(target, []byte(lines), 0644)
+
+	index := buildIndex(t, tempDir, target, indexfile.DomainSuffixKey, 8)
+	for domain, expected := range map[string]int{
+		"example.com":        2,
+		"mail.example.com":   1,
+		"example.co.uk":      2,
+		"corp.example.co.uk": 1,
+		"co.uk":              0,
+		"com":                0,
+	} {
+		results, err := Start(domain, indexfile.DomainSuffixKey, target, index)
+		if err != nil {
+			t.Errorf("Search failed %s", err)
+			return
+		}
+		if len(results) != expected {
+			t.Errorf("Expected %d results for '%s', got %d", expected, domain, len(results))
+			return
+		}
+		for _, result := range results {
+			if !isSubdomain(result.Domain, domain) {
+				t.Errorf("Result %v is not in '%s'", result, domain)
+				return
+			}
+		}
+	}
+}
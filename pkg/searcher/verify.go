@@ -0,0 +1,246 @@
+package searcher
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+	"github.com/moloch--/leakdb/pkg/publicsuffix"
+)
+
+const (
+	// DefaultVerifySample - Default number of entries that are re-hashed
+	DefaultVerifySample = 1000
+
+	// CheckOpen - The index header and JSON file(s) match
+	CheckOpen = "open"
+	// CheckAlignment - The index is a whole number of entries
+	CheckAlignment = "alignment"
+	// CheckOrder - Entries are sorted
+	CheckOrder = "order"
+	// CheckOffsets - Every offset is the start of a line of the JSON file
+	CheckOffsets = "offsets"
+	// CheckDigests - Digests match the re-hashed key of their line
+	CheckDigests = "digests"
+
+	maxCheckErrors = 10
+)
+
+// VerifyOptions - Options of Verify
+type VerifyOptions struct {
+	// Sample - Number of entries, evenly spaced, whose digest is checked
+	// against the re-hashed key of their line, 0 checks every entry
+	Sample int
+	// Mmap - Memory-map the index and JSON file(s)
+	Mmap bool
+}
+
+// Check - Result of one verification check
+type Check struct {
+	Name     string   `json:"name"`
+	OK       bool     `json:"ok"`
+	Checked  int      `json:"checked"`
+	Failures int      `json:"failures"`
+	Errors   []string `json:"errors,omitempty"` // The first few failures
+}
+
+func (c *Check) fail(format string, args ...interface{}) {
+	c.OK = false
+	c.Failures++
+	if len(c.Errors) < maxCheckErrors {
+		c.Errors = append(c.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// VerifyReport - Result of verifying an index
+type VerifyReport struct {
+	Index   string   `json:"index"`
+	Target  string   `json:"target"`
+	Key     string   `json:"key"`
+	Entries int      `json:"entries"`
+	OK      bool     `json:"ok"`
+	Checks  []*Check `json:"checks"`
+}
+
+func (r *VerifyReport) check(name string) *Check {
+	check := &Check{Name: name, OK: true}
+	r.Checks = append(r.Checks, check)
+	return check
+}
+
+// Verify - Check that an index is sorted, is a whole number of entries,
+// that every offset is the start of a line of the JSON file, and that a
+// sample of digests match the re-hashed key of their line. Verification
+// failures are reported rather than returned as an error.
+func Verify(target string, index string, key string, options *VerifyOptions) *VerifyReport {
+	if options == nil {
+		options = &VerifyOptions{Sample: DefaultVerifySample}
+	}
+	report := &VerifyReport{Index: index, Target: target, Key: key}
+	open := report.check(CheckOpen)
+	open.Checked = 1
+	idx, err := Open(target, index, key, &Options{Mmap: options.Mmap})
+	if err != nil {
+		open.fail("%s", err)
+		return report
+	}
+	defer idx.Close()
+	report.Key = idx.Key
+	report.Entries = idx.NumberOfEntries
+
+	alignment := report.check(CheckAlignment)
+	alignment.Checked = 1
+	info, err := idx.indexFile.Stat()
+	if err != nil {
+		alignment.fail("%s", err)
+	} else if extra := (info.Size() - idx.Header.Size()) % int64(idx.Header.EntrySize()); extra != 0 {
+		alignment.fail("%d trailing bytes after the last entry", extra)
+	}
+
+	order := report.check(CheckOrder)
+	offsets := report.check(CheckOffsets)
+	digests := report.check(CheckDigests)
+	fields, err := indexfile.ParseKey(idx.Key)
+	if err != nil {
+		digests.fail("Index key is unknown, use the key it was created with (%s)", err)
+		fields = nil
+	}
+	stride := 1
+	if 0 < options.Sample && options.Sample < idx.NumberOfEntries {
+		stride = (idx.NumberOfEntries + options.Sample - 1) / options.Sample
+	}
+
+	entries := bufio.NewReader(io.NewSectionReader(idx.index, idx.Header.Size(), int64(idx.NumberOfEntries*idx.Header.EntrySize())))
+	buf := make([]byte, idx.Header.EntrySize())
+	previous := make([]byte, idx.Header.DigestSize)
+	for position := 0; position < idx.NumberOfEntries; position++ {
+		_, err = io.ReadFull(entries, buf)
+		if err != nil {
+			order.fail("Failed to read entry %d (%s)", position, err)
+			break
+		}
+		digest := buf[:idx.Header.DigestSize]
+		order.Checked++
+		if 0 < position && idx.Header.Compare(digest, previous) < 0 {
+			order.fail("Entry %d (%x) is less than the entry before it (%x)", position, digest, previous)
+		}
+		copy(previous, digest)
+
+		location := indexfile.Offset(buf[idx.Header.DigestSize:])
+		offsets.Checked++
+		if !idx.isLineStart(location) {
+			offsets.fail("Entry %d offset %s is not the start of a line", position, formatLocation(idx.Header, location))
+			continue
+		}
+		if fields != nil && position%stride == 0 {
+			digests.Checked++
+			if !idx.matchesLine(digest, location, fields) {
+				digests.fail("Entry %d digest %x does not match the line at %s", position, digest, formatLocation(idx.Header, location))
+			}
+		}
+	}
+
+	report.OK = true
+	for _, check := range report.Checks {
+		report.OK = report.OK && check.OK
+	}
+	return report
+}
+
+// isLineStart - The location is the start of a line, i.e. the first byte of
+// its file or the byte after a newline, and is not past the end of the file
+func (i *Index) isLineStart(location int64) bool {
+	buf := make([]byte, 1)
+	if n, _ := i.target.ReadAt(buf, location); n != 1 || buf[0] == '\n' {
+		return false
+	}
+	_, offset := indexfile.SplitLocation(location)
+	if !i.Header.IsSharded() {
+		offset = location
+	}
+	if offset == 0 {
+		return true
+	}
+	n, _ := i.target.ReadAt(buf, location-1)
+	return n == 1 && buf[0] == '\n'
+}
+
+// matchesLine - The digest is the digest of one of the values the line at
+// location is indexed by
+func (i *Index) matchesLine(digest []byte, location int64, fields []string) bool {
+	cred, err := i.credential(location)
+	if err != nil {
+		return false
+	}
+	for _, value := range indexedValues(cred, fields) {
+		if bytes.Equal(i.Header.Digest(value), digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedValues - Values a credential may be indexed by, the public suffix
+// list used to create a domain suffix index is not known so an empty list
+// is used, which includes every parent domain any list would
+func indexedValues(cred *Credential, fields []string) []string {
+	if len(fields) == 1 && fields[0] == indexfile.DomainSuffixKey {
+		return (&publicsuffix.List{}).Suffixes(cred.Domain)
+	}
+	values := []string{}
+	for _, field := range fields {
+		if value, ok := keyValue(cred, field); ok {
+			values = append(values, value)
+		}
+	}
+	return []string{indexfile.JoinValues(values)}
+}
+
+func formatLocation(header *indexfile.Header, location int64) string {
+	if header.IsSharded() {
+		shard, offset := indexfile.SplitLocation(location)
+		return fmt.Sprintf("%d of shard %d", offset, shard)
+	}
+	return fmt.Sprintf("%d", location)
+}
+
+// WriteJSON - Write the report as JSON
+func (r *VerifyReport) WriteJSON(writer io.Writer) error {
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
+
+// Failed - Names of the checks that failed
+func (r *VerifyReport) Failed() []string {
+	failed := []string{}
+	for _, check := range r.Checks {
+		if !check.OK {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
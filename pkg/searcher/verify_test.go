@@ -0,0 +1,132 @@
+package searcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+// corrupt - Copy of index with its entries modified by fn
+func corrupt(t *testing.T, index string, output string, fn func(entries []byte, header *indexfile.Header) []byte) string {
+	data, err := ioutil.ReadFile(index)
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	}
+	header, err := indexfile.ReadFile(index)
+	if err != nil {
+		t.Fatalf("Header error: %s", err)
+	}
+	entries := fn(data[header.Size():], header)
+	err = ioutil.WriteFile(output, append(data[:header.Size()], entries...), 0644)
+	if err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	return output
+}
+
+func failedChecks(report *VerifyReport) map[string]bool {
+	failed := map[string]bool{}
+	for _, name := range report.Failed() {
+		failed[name] = true
+	}
+	return failed
+}
+
+func TestVerify(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, key := range []string{"email", "domain-suffix", "email+password"} {
+		index := buildIndex(t, tempDir, largeJSON, key, 8)
+		report := Verify(largeJSON, index, "", &VerifyOptions{Sample: 0})
+		if !report.OK {
+			t.Errorf("Valid %s index failed verification: %v", key, report.Failed())
+			return
+		}
+		for _, check := range report.Checks[2:] {
+			if check.Checked != report.Entries {
+				t.Errorf("%s checked %d of %d entries", check.Name, check.Checked, report.Entries)
+				return
+			}
+		}
+	}
+	report := Verify(largeJSON, largeEmailIndex, "email", nil)
+	if !report.OK || len(report.Checks) != 5 || report.Checks[4].Checked != DefaultVerifySample {
+		t.Errorf("Legacy index failed verification %+v", report)
+		return
+	}
+
+	index := buildIndex(t, tempDir, largeJSON, "user", 8)
+	tests := []struct {
+		name   string
+		check  string
+		modify func(entries []byte, header *indexfile.Header) []byte
+	}{
+		{"unsorted", CheckOrder, func(entries []byte, header *indexfile.Header) []byte {
+			size := header.EntrySize()
+			first := append([]byte{}, entries[:size]...)
+			copy(entries, entries[len(entries)-size:])
+			copy(entries[len(entries)-size:], first)
+			return entries
+		}},
+		{"misaligned", CheckAlignment, func(entries []byte, header *indexfile.Header) []byte {
+			return append(entries, 0, 0, 0)
+		}},
+		{"offset", CheckOffsets, func(entries []byte, header *indexfile.Header) []byte {
+			offset := entries[header.DigestSize:header.EntrySize()]
+			indexfile.PutOffset(offset, indexfile.Offset(offset)+1)
+			return entries
+		}},
+		{"digest", CheckDigests, func(entries []byte, header *indexfile.Header) []byte {
+			// The largest digest keeps the index sorted
+			last := entries[len(entries)-header.EntrySize():]
+			for index := 0; index < header.DigestSize; index++ {
+				last[index] = 0xff
+			}
+			return entries
+		}},
+	}
+	for _, test := range tests {
+		corrupted := corrupt(t, index, filepath.Join(tempDir, test.name+".idx"), test.modify)
+		report := Verify(largeJSON, corrupted, "", &VerifyOptions{Sample: 0})
+		failed := failedChecks(report)
+		if report.OK || len(failed) != 1 || !failed[test.check] {
+			t.Errorf("%s index: expected only the %s check to fail, failed %v", test.name, test.check, report.Failed())
+			return
+		}
+	}
+
+	report = Verify(smallJSON, index, "", nil)
+	if report.OK || !failedChecks(report)[CheckOpen] {
+		t.Errorf("Expected the open check to fail for the wrong JSON file")
+	}
+}
+
+func TestVerifyDomainSuffix(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Trailing dots are trimmed when the index is created
+	target := filepath.Join(tempDir, "domains.json")
+	lines := ""
+	for _, domain := range []string{"mail.example.com.", "corp.example.co.uk", "co.uk.", "localhost", ""} {
+		lines += `{"email": "a@` + domain + `", "domain": "` + domain + `"}` + "\n"
+	}
+	ioutil.WriteFile(target, []byte(lines), 0644)
+	index := buildIndex(t, tempDir, target, indexfile.DomainSuffixKey, 8)
+	report := Verify(target, index, "", &VerifyOptions{Sample: 0})
+	if !report.OK {
+		t.Errorf("Valid domain suffix index failed verification: %v", report.Failed())
+	}
+}
@@ -0,0 +1,270 @@
+package sorter
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	K-way merge of sorted runs (tapes or sorted indexes). Each run is read
+	sequentially through its own buffered reader into a single reused
+	entry buffer, and the runs are kept in a min-heap ordered by their
+	current entry, so merging makes no per-entry allocations or syscalls.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/moloch--/leakdb/pkg/filesystem"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+const (
+	minMergeBufSize = 4 * Kb
+)
+
+// run - A sorted run of entries read sequentially
+type run struct {
+	path       string
+	file       filesystem.File
+	reader     *bufio.Reader
+	entry      []byte
+	digestSize int
+
+	// Entries of runs rebased onto a shard are read into source and
+	// rewritten into entry with a sharded offset
+	source []byte
+	shard  uint16
+}
+
+// openRun - Open a sorted run of header's entries starting at offset in path
+func openRun(fs filesystem.FS, path string, offset int64, header *indexfile.Header, bufSize int) (*run, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &run{
+		path:       path,
+		file:       file,
+		reader:     bufio.NewReaderSize(file, bufSize),
+		entry:      make([]byte, header.EntrySize()),
+		digestSize: header.DigestSize,
+	}, nil
+}
+
+// rebase - Read entries of header's layout and rewrite their offsets as
+// sharded offsets of shard, the run must have been opened with a sharded
+// header
+func (r *run) rebase(header *indexfile.Header, shard uint16) {
+	r.source = make([]byte, header.EntrySize())
+	r.shard = shard
+}
+
+// next - Read the next entry of the run, returns false at the end of the run
+func (r *run) next() (bool, error) {
+	if r.source != nil {
+		ok, err := r.read(r.source)
+		if ok {
+			copy(r.entry, r.source[:r.digestSize])
+			offset := indexfile.Offset(r.source[r.digestSize:])
+			indexfile.PutOffset(r.entry[r.digestSize:], indexfile.Location(r.shard, offset))
+		}
+		return ok, err
+	}
+	return r.read(r.entry)
+}
+
+func (r *run) read(buf []byte) (bool, error) {
+	_, err := io.ReadFull(r.reader, buf)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("Irregular file size %s", r.path)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// digest - Digest of the current entry
+func (r *run) digest() []byte {
+	return r.entry[:r.digestSize]
+}
+
+// Close - Close the run's file
+func (r *run) Close() error {
+	return r.file.Close()
+}
+
+// mergeHeap - Min-heap of runs ordered by their current entry
+type mergeHeap struct {
+	runs    []*run
+	compare func(a, b []byte) int // Compares entries
+}
+
+func (h *mergeHeap) less(a, b int) bool {
+	return h.compare(h.runs[a].entry, h.runs[b].entry) < 0
+}
+
+// Len - Number of runs in the heap
+func (h *mergeHeap) Len() int {
+	return len(h.runs)
+}
+
+// Push - Add a run to the heap
+func (h *mergeHeap) Push(r *run) {
+	h.runs = append(h.runs, r)
+	child := len(h.runs) - 1
+	for 0 < child {
+		parent := (child - 1) / 2
+		if !h.less(child, parent) {
+			break
+		}
+		h.runs[child], h.runs[parent] = h.runs[parent], h.runs[child]
+		child = parent
+	}
+}
+
+// Min - The run with the lowest current entry
+func (h *mergeHeap) Min() *run {
+	return h.runs[0]
+}
+
+// Fix - Restore the heap after the minimum run has advanced
+func (h *mergeHeap) Fix() {
+	parent := 0
+	for {
+		lowest := parent
+		left, right := 2*parent+1, 2*parent+2
+		if left < len(h.runs) && h.less(left, lowest) {
+			lowest = left
+		}
+		if right < len(h.runs) && h.less(right, lowest) {
+			lowest = right
+		}
+		if lowest == parent {
+			return
+		}
+		h.runs[parent], h.runs[lowest] = h.runs[lowest], h.runs[parent]
+		parent = lowest
+	}
+}
+
+// Pop - Remove the minimum run from the heap
+func (h *mergeHeap) Pop() {
+	last := len(h.runs) - 1
+	h.runs[0] = h.runs[last]
+	h.runs[last] = nil
+	h.runs = h.runs[:last]
+	h.Fix()
+}
+
+// mergeOptions - What a merge writes besides the entries
+type mergeOptions struct {
+	fence  *indexfile.FenceBuilder
+	stats  *indexfile.StatsBuilder
+	runs   *indexfile.RunsBuilder
+	dedupe bool   // Drop identical entries, runs must be sorted by entry
+	merged func() // Called after each entry is merged
+}
+
+// mergeRuns - Merge sorted runs into writer in the order of the index
+func mergeRuns(runs []*run, header *indexfile.Header, writer io.Writer, options *mergeOptions) error {
+	heap := &mergeHeap{
+		runs:    make([]*run, 0, len(runs)),
+		compare: entryCompare(header, options.dedupe),
+	}
+	for _, r := range runs {
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Push(r)
+		}
+	}
+	var previous []byte
+	for 0 < heap.Len() {
+		r := heap.Min()
+		if options.dedupe && previous != nil && bytes.Equal(previous, r.entry) {
+			if options.stats != nil {
+				options.stats.Duplicate()
+			}
+		} else {
+			if options.fence != nil {
+				options.fence.Add(r.digest())
+			}
+			if options.stats != nil {
+				options.stats.Add(r.digest())
+			}
+			if options.runs != nil {
+				options.runs.Add(r.digest())
+			}
+			_, err := writer.Write(r.entry)
+			if err != nil {
+				return err
+			}
+			if options.dedupe {
+				previous = append(previous[:0], r.entry...)
+			}
+		}
+		if options.merged != nil {
+			options.merged()
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix()
+		} else {
+			heap.Pop()
+		}
+	}
+	return nil
+}
+
+// entryCompare - Compares entries in the order of the index, entries with
+// the same digest are ordered by offset if byOffset is set
+func entryCompare(header *indexfile.Header, byOffset bool) func(a, b []byte) int {
+	digestSize := header.DigestSize
+	return func(a, b []byte) int {
+		result := header.Compare(a[:digestSize], b[:digestSize])
+		if result == 0 && byOffset {
+			result = indexfile.Compare(a[digestSize:], b[digestSize:])
+		}
+		return result
+	}
+}
+
+// mergeBufSizeOf - Size of a merge buffer given a share of memory, there is
+// little to gain from buffers larger than mergeBufSize
+func mergeBufSizeOf(share int) int {
+	if mergeBufSize < share {
+		return mergeBufSize
+	}
+	if share < minMergeBufSize {
+		return minMergeBufSize
+	}
+	return share
+}
@@ -0,0 +1,92 @@
+package sorter
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	Memory budget of a sort. While sorting, tape buffers are allocated once
+	and reused, one per worker plus one being read from the index, and each
+	worker has a radix sort scratch buffer of the same size:
+
+		(2 * workers + 1) * tape size <= max memory
+
+	While merging, each tape has a read buffer and the output has a write
+	buffer, (tapes + 1) * merge buffer size <= max memory. Merge buffers are
+	at least 4Kb, so the budget is exceeded only by indexes of more than
+	max memory / 4Kb tapes. Each tape holds at least one entry.
+*/
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// Memory - Memory used by a sort in bytes
+type Memory struct {
+	Budget   int64 // Max memory
+	InUse    int64 // Tape, sort, and merge buffers currently allocated
+	Peak     int64 // Peak of InUse
+	PeakHeap int64 // Peak heap of the process measured while sorting
+}
+
+// memoryAccount - Accounts the buffers of a sort, safe for concurrent use
+type memoryAccount struct {
+	inUse    int64
+	peak     int64
+	peakHeap int64
+}
+
+func (m *memoryAccount) alloc(size int) {
+	inUse := atomic.AddInt64(&m.inUse, int64(size))
+	storeMax(&m.peak, inUse)
+}
+
+func (m *memoryAccount) free(size int) {
+	atomic.AddInt64(&m.inUse, -int64(size))
+}
+
+// sampleHeap - Measure the heap, this stops the world so is called once per
+// tape rather than per entry
+func (m *memoryAccount) sampleHeap() {
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	storeMax(&m.peakHeap, int64(stats.HeapAlloc))
+}
+
+func storeMax(addr *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if value <= current || atomic.CompareAndSwapInt64(addr, current, value) {
+			return
+		}
+	}
+}
+
+// tapesInFlight - Number of tape buffers, one per worker and one to read
+// the next tape into while the workers sort
+func tapesInFlight(maxWorkers int) int {
+	return maxWorkers + 1
+}
+
+// entriesPerTapeOf - Entries per tape that fit in maxMemory with a tape
+// buffer per tape in flight and a scratch buffer per worker
+func entriesPerTapeOf(maxMemory int, maxWorkers int, entrySize int) int {
+	buffers := tapesInFlight(maxWorkers) + maxWorkers
+	entries := maxMemory / (buffers * entrySize)
+	if entries < 1 {
+		entries = 1
+	}
+	return entries
+}
@@ -0,0 +1,273 @@
+package sorter
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/moloch--/leakdb/pkg/filesystem"
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+const (
+	mergeBufSize = 1 * Mb
+)
+
+// mergeInput - A sorted index being merged
+type mergeInput struct {
+	*run
+	header *indexfile.Header
+	// Source size and checksum of the input as part of the dataset
+	sourceSize     int64
+	sourceChecksum uint32
+}
+
+// MergeOptions - Options of MergeWith
+type MergeOptions struct {
+	// Manifest - Inputs that are not sharded are rebased onto the shard of
+	// the manifest that matches their JSON file, so indexes created before
+	// a dataset had a manifest can be merged
+	Manifest *indexfile.Manifest
+	// Dedupe - Drop identical entries, e.g. when merging an index of a
+	// shard into an index that already contains it. Only adjacent entries
+	// are compared so the inputs should be sorted with Sorter.Dedupe.
+	Dedupe bool
+	// MinRunLength - See Sorter.MinRunLength, 0 is
+	// indexfile.DefaultMinRunLength
+	MinRunLength int
+	// FS - File system the inputs and output are opened on, nil is
+	// filesystem.OS
+	FS filesystem.FS
+}
+
+// Merge - Merge sorted sharded indexes of the same key into one sorted
+// index, the inputs must be indexes of different shards of a dataset
+func Merge(inputs []string, output string) error {
+	return MergeWith(inputs, output, &MergeOptions{})
+}
+
+// MergeWith - Merge, rebasing inputs that are not sharded onto the shards
+// of options.Manifest. The output must not be one of the inputs, if the
+// merge fails the output and its sidecars are removed.
+func MergeWith(inputs []string, output string, options *MergeOptions) error {
+	if len(inputs) == 0 {
+		return errors.New("No indexes to merge")
+	}
+	fs := options.FS
+	if fs == nil {
+		fs = filesystem.OS
+	}
+	for _, path := range inputs {
+		if isSameFile(path, output) {
+			return fmt.Errorf("%s is an input of the merge, it cannot be the output", output)
+		}
+	}
+	mergeInputs := []*mergeInput{}
+	defer func() {
+		for _, input := range mergeInputs {
+			input.Close()
+		}
+	}()
+	rebased := map[uint16]string{}
+	for _, path := range inputs {
+		input, err := openMergeInput(fs, path, options.Manifest)
+		if err != nil {
+			return err
+		}
+		mergeInputs = append(mergeInputs, input)
+		err = canMerge(mergeInputs[0], input)
+		if err != nil {
+			return err
+		}
+		if input.source != nil {
+			if previous, ok := rebased[input.shard]; ok {
+				return fmt.Errorf("%s and %s are both indexes of shard %d", previous, path, input.shard)
+			}
+			rebased[input.shard] = path
+		}
+	}
+
+	header := *mergeInputs[0].header
+	header.OffsetSize = indexfile.ShardedOffsetSize
+	header.SourceSize, header.SourceChecksum = 0, 0
+	for _, input := range mergeInputs {
+		header.SourceSize += input.sourceSize
+		header.SourceChecksum += input.sourceChecksum
+	}
+
+	err := writeMerge(fs, mergeInputs, &header, output, options)
+	if err != nil {
+		fs.Remove(output)
+		fs.Remove(indexfile.FencePath(output))
+		fs.Remove(indexfile.StatsPath(output))
+		fs.Remove(indexfile.RunsPath(output))
+	}
+	return err
+}
+
+// writeMerge - Merge the inputs into output and write its sidecars
+func writeMerge(fs filesystem.FS, mergeInputs []*mergeInput, header *indexfile.Header, output string, options *MergeOptions) error {
+	outputFile, err := fs.Create(output)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	writer := bufio.NewWriterSize(outputFile, mergeBufSize)
+	err = header.Write(writer)
+	if err != nil {
+		return err
+	}
+	var fence *indexfile.FenceBuilder
+	if !header.IsOrdered() {
+		fence = indexfile.NewFenceBuilder()
+	}
+
+	runs := make([]*run, len(mergeInputs))
+	for index, input := range mergeInputs {
+		runs[index] = input.run
+	}
+	stats := indexfile.NewStatsBuilder()
+	minRunLength := options.MinRunLength
+	if minRunLength == 0 {
+		minRunLength = indexfile.DefaultMinRunLength
+	}
+	digestRuns := indexfile.NewRunsBuilder(minRunLength)
+	err = mergeRuns(runs, header, writer, &mergeOptions{
+		fence:  fence,
+		stats:  stats,
+		runs:   digestRuns,
+		dedupe: options.Dedupe,
+	})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	info, err := outputFile.Stat()
+	if err != nil {
+		return err
+	}
+	id, err := indexfile.NewIndexID(outputFile, info.Size())
+	if err != nil {
+		return err
+	}
+	mergedStats := stats.Stats()
+	mergedStats.IndexChecksum = id.Checksum
+	err = mergedStats.WriteFile(indexfile.StatsPath(output))
+	if err != nil {
+		return err
+	}
+	mergedRuns := digestRuns.Runs()
+	mergedRuns.IndexChecksum = id.Checksum
+	err = mergedRuns.WriteFile(indexfile.RunsPath(output))
+	if err != nil {
+		return err
+	}
+	if fence != nil {
+		mergedFence := fence.Fence()
+		mergedFence.IndexChecksum = id.Checksum
+		err = mergedFence.WriteFile(indexfile.FencePath(output))
+		if err != nil {
+			return err
+		}
+	}
+	return outputFile.Close()
+}
+
+// isSameFile - Both paths are the same file, e.g. through a relative path
+// or a link
+func isSameFile(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// openMergeInput - Open a sorted index, indexes that are not sharded are
+// rebased onto their shard of manifest
+func openMergeInput(fs filesystem.FS, path string, manifest *indexfile.Manifest) (*mergeInput, error) {
+	header, err := indexfile.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if header.IsSharded() {
+		run, err := openRun(fs, path, header.Size(), header, mergeBufSize)
+		if err != nil {
+			return nil, err
+		}
+		return &mergeInput{
+			run:            run,
+			header:         header,
+			sourceSize:     header.SourceSize,
+			sourceChecksum: header.SourceChecksum,
+		}, nil
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%s is not a sharded index, a manifest is required to merge it", path)
+	}
+	if header.IsLegacy() {
+		return nil, fmt.Errorf("%s has no header, its JSON file cannot be found in the manifest", path)
+	}
+	shard := findShard(manifest, header)
+	if shard == nil {
+		return nil, fmt.Errorf("%s was not created from a shard of the manifest", path)
+	}
+	sharded := *header
+	sharded.SetShard(shard)
+	run, err := openRun(fs, path, header.Size(), &sharded, mergeBufSize)
+	if err != nil {
+		return nil, err
+	}
+	run.rebase(header, shard.ID)
+	return &mergeInput{
+		run:            run,
+		header:         &sharded,
+		sourceSize:     sharded.SourceSize,
+		sourceChecksum: sharded.SourceChecksum,
+	}, nil
+}
+
+// findShard - The shard of the JSON file an index was created from, or nil
+func findShard(manifest *indexfile.Manifest, header *indexfile.Header) *indexfile.Shard {
+	for _, shard := range manifest.Shards {
+		if shard.Size == header.SourceSize && shard.Checksum == header.SourceChecksum {
+			return shard
+		}
+	}
+	return nil
+}
+
+// canMerge - Indexes can be merged if they have the same layout and key
+func canMerge(first *mergeInput, input *mergeInput) error {
+	a, b := first.header, input.header
+	if a.Version != b.Version || a.Type != b.Type || a.DigestSize != b.DigestSize || a.Key != b.Key {
+		return fmt.Errorf("%s and %s are different kinds of index", first.path, input.path)
+	}
+	return nil
+}
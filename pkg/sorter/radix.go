@@ -0,0 +1,110 @@
+package sorter
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+
+	LSD radix sort of fixed size records in a flat buffer, one stable
+	counting sort pass per digest byte from the least significant byte to
+	the most significant. Digests are little endian integers so the least
+	significant byte is the first byte, ordered indexes compare prefixes
+	lexicographically so the least significant byte is the last byte.
+*/
+
+import (
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+// RadixSort - Sort the entries in records into the order of the index,
+// records is a flat buffer of [digest][offset] entries and is sorted in
+// place. The sort needs a scratch buffer the same size as records.
+func RadixSort(records []byte, header *indexfile.Header) {
+	radixSort(records, nil, header, false)
+}
+
+// RadixSortEntries - RadixSort, entries with the same digest are ordered
+// by offset so identical entries are next to each other
+func RadixSortEntries(records []byte, header *indexfile.Header) {
+	radixSort(records, nil, header, true)
+}
+
+// radixSort - Sort records using scratch, which is allocated if it is
+// smaller than records
+func radixSort(records []byte, scratch []byte, header *indexfile.Header, byOffset bool) {
+	entrySize := header.EntrySize()
+	numberOfEntries := len(records) / entrySize
+	if numberOfEntries < 2 {
+		return
+	}
+	records = records[:numberOfEntries*entrySize]
+	if len(scratch) < len(records) {
+		scratch = make([]byte, len(records))
+	}
+	scratch = scratch[:len(records)]
+	src, dst := records, scratch
+	for _, keyByte := range radixKeyBytes(header, byOffset) {
+		if radixPass(src, dst, entrySize, keyByte) {
+			src, dst = dst, src
+		}
+	}
+	if &src[0] != &records[0] {
+		copy(records, src)
+	}
+}
+
+// radixKeyBytes - Positions of the digest bytes from least to most
+// significant, preceded by the offset bytes if byOffset is set
+func radixKeyBytes(header *indexfile.Header, byOffset bool) []int {
+	keyBytes := []int{}
+	if byOffset {
+		// Offsets are little endian integers
+		for index := header.DigestSize; index < header.EntrySize(); index++ {
+			keyBytes = append(keyBytes, index)
+		}
+	}
+	for index := 0; index < header.DigestSize; index++ {
+		if header.IsOrdered() {
+			keyBytes = append(keyBytes, header.DigestSize-1-index)
+		} else {
+			keyBytes = append(keyBytes, index)
+		}
+	}
+	return keyBytes
+}
+
+// radixPass - Stable counting sort of src into dst by the byte at keyByte,
+// returns false without copying if every entry has the same byte
+func radixPass(src []byte, dst []byte, entrySize int, keyByte int) bool {
+	var counts [256]int
+	for position := keyByte; position < len(src); position += entrySize {
+		counts[src[position]]++
+	}
+	numberOfEntries := len(src) / entrySize
+	if counts[src[keyByte]] == numberOfEntries {
+		return false
+	}
+	var offsets [256]int
+	total := 0
+	for value, count := range counts {
+		offsets[value] = total
+		total += count * entrySize
+	}
+	for position := 0; position < len(src); position += entrySize {
+		value := src[position+keyByte]
+		copy(dst[offsets[value]:offsets[value]+entrySize], src[position:position+entrySize])
+		offsets[value] += entrySize
+	}
+	return true
+}
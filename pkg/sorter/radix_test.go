@@ -0,0 +1,111 @@
+package sorter
+
+import (
+	"bytes"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"testing"
+
+	"github.com/moloch--/leakdb/pkg/indexfile"
+)
+
+const (
+	benchmarkEntries = 1000000
+)
+
+func randomRecords(header *indexfile.Header, numberOfEntries int) []byte {
+	random := rand.New(rand.NewSource(1))
+	records := make([]byte, numberOfEntries*header.EntrySize())
+	random.Read(records)
+	if header.IsOrdered() {
+		// Prefixes share leading bytes and are zero padded
+		for position := 0; position < len(records); position += header.EntrySize() {
+			records[position] = 'a' + records[position]%4
+			for index := header.DigestSize / 2; index < header.DigestSize; index++ {
+				records[position+index] = 0
+			}
+		}
+	}
+	return records
+}
+
+func splitRecords(records []byte, header *indexfile.Header) []*Entry {
+	entries := make([]*Entry, len(records)/header.EntrySize())
+	for index := range entries {
+		buf := make([]byte, header.EntrySize())
+		copy(buf, records[index*header.EntrySize():])
+		entries[index] = &Entry{Digest: buf[:header.DigestSize], Offset: buf[header.DigestSize:]}
+	}
+	return entries
+}
+
+func testRadixSort(t *testing.T, header *indexfile.Header, numberOfEntries int) {
+	records := randomRecords(header, numberOfEntries)
+	entries := splitRecords(records, header)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return header.Compare(entries[i].Digest, entries[j].Digest) < 0
+	})
+	RadixSort(records, header)
+	for index, entry := range entries {
+		record := records[index*header.EntrySize() : (index+1)*header.EntrySize()]
+		if !bytes.Equal(record[:header.DigestSize], entry.Digest) || !bytes.Equal(record[header.DigestSize:], entry.Offset) {
+			t.Errorf("Entry %d is %x, expected %x%x", index, record, entry.Digest, entry.Offset)
+			return
+		}
+	}
+}
+
+func TestRadixSort(t *testing.T) {
+	digest := &indexfile.Header{DigestSize: indexfile.LegacyDigestSize, OffsetSize: indexfile.OffsetSize}
+	for _, numberOfEntries := range []int{0, 1, 2, 1000} {
+		testRadixSort(t, digest, numberOfEntries)
+	}
+	sharded := &indexfile.Header{DigestSize: 8, OffsetSize: indexfile.ShardedOffsetSize}
+	testRadixSort(t, sharded, 1000)
+	ordered := &indexfile.Header{DigestSize: indexfile.MinPrefixSize, OffsetSize: indexfile.OffsetSize, Type: indexfile.TypeOrdered}
+	testRadixSort(t, ordered, 1000)
+}
+
+// peakHeap - Bytes allocated by fn with the garbage collector disabled, which
+// is the peak heap usage of fn
+func peakHeap(fn func()) uint64 {
+	runtime.GC()
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func benchmarkTapeSort(b *testing.B, sortTape func(index []byte, header *indexfile.Header)) {
+	header := &indexfile.Header{DigestSize: indexfile.LegacyDigestSize, OffsetSize: indexfile.OffsetSize}
+	index := randomRecords(header, benchmarkEntries)
+	peak := peakHeap(func() { sortTape(index, header) })
+	b.SetBytes(int64(len(index)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sortTape(index, header)
+	}
+	b.ReportMetric(float64(peak), "peak-heap-B")
+}
+
+// BenchmarkTapeQuicksort - Tapes of one entry per allocation sorted with
+// Quicksort, the implementation replaced by RadixSort
+func BenchmarkTapeQuicksort(b *testing.B) {
+	benchmarkTapeSort(b, func(index []byte, header *indexfile.Header) {
+		Quicksort(splitRecords(index, header))
+	})
+}
+
+// BenchmarkTapeRadixSort - Tapes of flat records sorted with RadixSort
+func BenchmarkTapeRadixSort(b *testing.B) {
+	benchmarkTapeSort(b, func(index []byte, header *indexfile.Header) {
+		records := make([]byte, len(index))
+		copy(records, index)
+		RadixSort(records, header)
+	})
+}
@@ -40,7 +40,7 @@ For example, for sorting 900 megabytes of data using only 100 megabytes of RAM:
 */
 
 import (
-	"encoding/binary"
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -49,15 +49,14 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/emirpasic/gods/trees/binaryheap"
+	"github.com/moloch--/leakdb/pkg/filesystem"
+	"github.com/moloch--/leakdb/pkg/indexfile"
 )
 
 const (
-	digestSize = 6
-	offsetSize = 6
-	entrySize  = digestSize + offsetSize
-
 	// Kb - Kilobyte
 	Kb = 1024
 	// Mb - Megabyte
@@ -75,130 +74,80 @@ const (
 	StatusMerging = "Merging"
 )
 
-// Entry - [48-bit digest][48-bit offset] =  96-bit (12 byte) entry
+// Entry - [digest][48-bit offset], the digest size is set by the index header
 type Entry struct {
-	Digest    []byte
-	Offset    []byte
-	TapeIndex int // Only used during merge
-}
-
-// Value - The numeric value of the digest
-func (e *Entry) Value() uint64 {
-	buf := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	copy(buf, e.Digest)
-	return binary.LittleEndian.Uint64(buf)
+	Digest []byte
+	Offset []byte
 }
 
 // Tape - A subsection of the index file that we can sort in-memory
 type Tape struct {
-	ID        int
-	Entries   []*Entry
-	Dir       string
-	FileName  string
-	Len       int // Number of entires in tape file
-	MergeSize int // Number of entires in merge buffer
-	Position  int
+	ID         int
+	Records    []byte // Flat [digest][offset] entries, only used before the tape is saved
+	Dir        string
+	FileName   string
+	DigestSize int
+	EntrySize  int
+	Len        int // Number of entires in tape file
 }
 
 // Save - Save tape to disk in dir
-func (t *Tape) Save() {
-	tapeFilePath := filepath.Join(t.Dir, t.FileName)
-	tapeFile, err := os.Create(tapeFilePath)
+func (t *Tape) Save(fs filesystem.FS) error {
+	tapeFile, err := fs.Create(t.Path())
 	if err != nil {
-		panic(err)
-	}
-	defer tapeFile.Close()
-
-	for _, entry := range t.Entries {
-		_, err := tapeFile.Write(entry.Digest)
-		if err != nil {
-			panic(err)
-		}
-		_, err = tapeFile.Write(entry.Offset)
-		if err != nil {
-			panic(err)
-		}
+		return err
 	}
-	t.Entries = nil
-}
-
-// Prefetch - Prefetch t.MergeSize elements from position in tape
-func (t *Tape) Prefetch(position int) {
-	tapeFilePath := filepath.Join(t.Dir, t.FileName)
-	tapeFile, err := os.Open(tapeFilePath)
+	_, err = tapeFile.Write(t.Records)
 	if err != nil {
-		panic(err)
-	}
-	defer tapeFile.Close()
-
-	t.Entries = nil
-	t.Entries = make([]*Entry, t.MergeSize)
-	stop := position + t.MergeSize
-	for index := 0; position < stop; index++ {
-		tapeFile.Seek(int64(position)*entrySize, 0)
-		buf := make([]byte, entrySize)
-		_, err := io.ReadAtLeast(tapeFile, buf, entrySize)
-		if err == io.EOF {
-			t.Entries = append([]*Entry(nil), t.Entries[:index]...)
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		t.Entries[index] = &Entry{
-			Digest: buf[:digestSize],
-			Offset: buf[digestSize:],
-		}
-		position++
+		tapeFile.Close()
+		return err
 	}
-	t.Position = position
+	t.Records = nil
+	return tapeFile.Close()
 }
 
-// Pop - Pop lowest value from tape
-func (t *Tape) Pop() (*Entry, bool) {
-	var entry *Entry
-	if len(t.Entries) == 0 {
-		if t.IsEndOfTape() {
-			return &Entry{}, false // End of tape
-		}
-		t.Prefetch(t.Position)
-		entry = t.Entries[0]
-	} else {
-		entry = t.Entries[0]
-		t.Entries = t.Entries[1:]
-	}
-	return entry, true
-}
-
-// IsEndOfTape - Returns true if end of tape has been reached
-//               The file is zero indexed but the Position will
-//               get incremented until EOF, so no Size-1.
-func (t *Tape) IsEndOfTape() bool {
-	return t.Position == t.Len
+// Path - Path of the tape file
+func (t *Tape) Path() string {
+	return filepath.Join(t.Dir, t.FileName)
 }
 
 // Sorter - An index file
 type Sorter struct {
 	IndexPath  string
-	Index      *os.File
+	Index      filesystem.File
 	OutputPath string
-	Output     *os.File
+	Output     filesystem.File
 	Info       os.FileInfo
+	Header     *indexfile.Header
+	Fence      *indexfile.FenceBuilder
+
+	// Dedupe - Drop identical entries (same digest and offset) while merging
+	Dedupe bool
+	// Stats - Stats of the sorted index, set once the sort completes
+	Stats *indexfile.Stats
+	// MinRunLength - Runs of identical digests of at least this many
+	// entries are recorded in the runs sidecar
+	MinRunLength int
+	// Runs - Large runs of the sorted index, set once the sort completes
+	Runs *indexfile.Runs
 
 	MaxWorkers        int
 	NumberOfEntires   int // Number of entries
-	MaxMemory         int // size of buffer in bytes
-	WorkerBufSize     int
+	MaxMemory         int // Memory budget of the tape, sort, and merge buffers in bytes
+	WorkerBufSize     int // Size of each tape buffer
 	EntriesPerTape    int
 	MaxPerTapeBufSize int
-	MergeBufLen       int
 
 	Tapes         []*Tape
 	TapeDir       string
-	NoTapeCleanup bool
-	Heap          *binaryheap.Heap
+	NoTapeCleanup bool // Keep tapes, and the partial output if the sort fails
+	FS            filesystem.FS
 	MergePercent  float64
 
+	mergeStarted time.Time
+	mergedBytes  int64
+	memory       memoryAccount
+
 	Workers []*Worker
 
 	NumberOfTapes int
@@ -206,39 +155,35 @@ type Sorter struct {
 }
 
 // Get - Get an index entry at position
-func (s *Sorter) Get(index int) *Entry {
-	position := int64(index * entrySize)
-	entry := Entry{
-		Digest: make([]byte, digestSize),
-		Offset: make([]byte, offsetSize),
-	}
-	s.Index.ReadAt(entry.Digest, position)
-	s.Index.ReadAt(entry.Offset, position+digestSize)
-	return &entry
+func (s *Sorter) Get(index int) (*Entry, error) {
+	position := s.Header.Position(index)
+	buf := make([]byte, s.Header.EntrySize())
+	n, err := s.Index.ReadAt(buf, position)
+	if n < len(buf) {
+		return nil, fmt.Errorf("Index read error at position %d (%s)", position, err)
+	}
+	return &Entry{
+		Digest: buf[:s.Header.DigestSize],
+		Offset: buf[s.Header.DigestSize:],
+	}, nil
 }
 
-// PopulateHeap - Populate the heap with lowest values from sorted tapes
-func (s *Sorter) PopulateHeap() {
-	for tapeIndex, tape := range s.Tapes {
-		entry, okay := tape.Pop()
-		if okay {
-			entry.TapeIndex = tapeIndex
-			s.Heap.Push(entry)
-		}
+// MergeThroughput - Bytes merged per second in megabytes
+func (s *Sorter) MergeThroughput() float64 {
+	elapsed := time.Now().Sub(s.mergeStarted).Seconds()
+	if s.mergeStarted.IsZero() || elapsed <= 0 {
+		return 0
 	}
+	return float64(atomic.LoadInt64(&s.mergedBytes)) / float64(Mb) / elapsed
 }
 
-// Drain - Drain buffer to file
-func (s *Sorter) Drain(outputBuf []*Entry) {
-	for _, entry := range outputBuf {
-		_, err := s.Output.Write(entry.Digest)
-		if err != nil {
-			panic(err)
-		}
-		_, err = s.Output.Write(entry.Offset)
-		if err != nil {
-			panic(err)
-		}
+// Memory - Memory used by the sort
+func (s *Sorter) Memory() Memory {
+	return Memory{
+		Budget:   int64(s.MaxMemory),
+		InUse:    atomic.LoadInt64(&s.memory.inUse),
+		Peak:     atomic.LoadInt64(&s.memory.peak),
+		PeakHeap: atomic.LoadInt64(&s.memory.peakHeap),
 	}
 }
 
@@ -247,45 +192,114 @@ func ceilDivideInt(a, b int) int {
 	return int(math.Ceil(float64(a) / float64(b)))
 }
 
-// Start - Sorts the index
-func (s *Sorter) Start() {
+// Start - Sorts the index, the tapes are removed and so is the output if
+// the sort fails, unless NoTapeCleanup is set
+func (s *Sorter) Start() error {
+	if s.FS == nil {
+		s.FS = filesystem.OS
+	}
+	err := s.sort()
+	if !s.NoTapeCleanup {
+		s.FS.RemoveAll(s.TapeDir)
+		if err != nil {
+			s.FS.Remove(s.OutputPath)
+			s.FS.Remove(indexfile.FencePath(s.OutputPath))
+			s.FS.Remove(indexfile.StatsPath(s.OutputPath))
+			s.FS.Remove(indexfile.RunsPath(s.OutputPath))
+		}
+	}
+	return err
+}
+
+func (s *Sorter) sort() error {
 	s.Status = StatusStarting
 	var err error
 
-	s.Output, err = os.Create(s.OutputPath)
+	s.Output, err = s.FS.Create(s.OutputPath)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer s.Output.Close()
 
-	s.Index, err = os.Open(s.IndexPath)
+	s.Index, err = s.FS.Open(s.IndexPath)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer s.Index.Close()
-
-	err = os.MkdirAll(s.TapeDir, 0700)
+	_, err = s.Index.Seek(s.Header.Size(), 0)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer func() {
-		if !s.NoTapeCleanup {
-			os.RemoveAll(s.TapeDir)
+	err = s.Header.Write(s.Output)
+	if err != nil {
+		return err
+	}
+	if !s.Header.IsOrdered() {
+		// Fence buckets are digest prefixes, ordered indexes have no fence
+		s.Fence = indexfile.NewFenceBuilder()
+	}
+	stats := indexfile.NewStatsBuilder()
+	digestRuns := indexfile.NewRunsBuilder(s.MinRunLength)
+	if 0 < s.NumberOfEntires {
+		err = s.sortTapes()
+		if err == nil {
+			err = s.mergeTapes(stats, digestRuns)
 		}
-	}()
+		if err != nil {
+			return err
+		}
+	}
+	id, err := s.outputID()
+	if err != nil {
+		return err
+	}
+	err = s.Output.Close()
+	if err != nil {
+		return err
+	}
+	if s.Fence != nil {
+		err = s.writeFence(id)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.writeStats(stats, id)
+	if err != nil {
+		return err
+	}
+	return s.writeRuns(digestRuns, id)
+}
+
+// sortTapes - Split the index into tapes and sort each one in memory, the
+// first error of the workers stops the sort
+func (s *Sorter) sortTapes() error {
+	err := s.FS.MkdirAll(s.TapeDir, 0700)
+	if err != nil {
+		return err
+	}
 
 	//            Size = number of bytes
 	// Len or NumberOf = number of entires in a slice or iterable
-	s.WorkerBufSize = ceilDivideInt(s.MaxMemory, s.MaxWorkers)           // Max memory
-	s.EntriesPerTape = ceilDivideInt(s.WorkerBufSize, entrySize)         // Size of each tape in bytes
+	entrySize := s.Header.EntrySize()
+	s.EntriesPerTape = entriesPerTapeOf(s.MaxMemory, s.MaxWorkers, entrySize) // See memory.go
+	if s.NumberOfEntires < s.EntriesPerTape {
+		s.EntriesPerTape = s.NumberOfEntires
+	}
+	s.WorkerBufSize = s.EntriesPerTape * entrySize                       // Size of each tape in bytes
 	s.NumberOfTapes = ceilDivideInt(s.NumberOfEntires, s.EntriesPerTape) // Total number of tapes we need
-	s.MaxPerTapeBufSize = ceilDivideInt(s.MaxMemory, s.NumberOfTapes+1)  // Merge tape buffer size
-	s.MergeBufLen = ceilDivideInt(s.MaxPerTapeBufSize, entrySize)        // Len of slice
+	s.MaxPerTapeBufSize = s.MaxMemory / (s.NumberOfTapes + 1)            // Merge tape buffer size
 
 	wg := sync.WaitGroup{}
 	s.Workers = []*Worker{}
 	queue := make(chan *Tape)
-	quit := make(chan bool)
+	errs := make(chan error, s.MaxWorkers)
+	// Tape buffers are reused once a worker has saved its tape, which caps
+	// the number of tapes in memory
+	buffers := make(chan []byte, tapesInFlight(s.MaxWorkers))
+	allocated := 0
+	defer func() {
+		s.memory.free(allocated * s.WorkerBufSize)
+	}()
 
 	s.Status = StatusSorting
 	for id := 1; id <= s.MaxWorkers; id++ {
@@ -293,99 +307,162 @@ func (s *Sorter) Start() {
 		worker := &Worker{
 			ID:             id,
 			Queue:          queue,
-			Quit:           quit,
+			Errors:         errs,
+			Buffers:        buffers,
 			Wg:             &wg,
+			Header:         s.Header,
+			Dedupe:         s.Dedupe,
+			FS:             s.FS,
 			TapesCompleted: 0,
+			memory:         &s.memory,
 		}
 		worker.start()
 		s.Workers = append(s.Workers, worker)
 	}
 
-	for tapeIndex := 0; tapeIndex < s.NumberOfTapes; tapeIndex++ {
-		tape := s.CreateTape(tapeIndex, s.EntriesPerTape)
-		tape.MergeSize = s.MergeBufLen
+	for tapeIndex := 0; tapeIndex < s.NumberOfTapes && err == nil; tapeIndex++ {
+		var records []byte
+		select {
+		case records = <-buffers:
+		default:
+			if allocated < cap(buffers) {
+				records = make([]byte, s.WorkerBufSize)
+				s.memory.alloc(len(records))
+				allocated++
+			} else {
+				select {
+				case records = <-buffers:
+				case err = <-errs:
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+		var tape *Tape
+		tape, err = s.readTape(tapeIndex, records)
+		if err != nil {
+			break
+		}
 		s.Tapes = append(s.Tapes, tape)
-		queue <- tape // Feed tapes to workers
+		select {
+		case queue <- tape: // Feed tapes to workers
+		case err = <-errs:
+		}
+		if err == nil {
+			select {
+			case err = <-errs:
+			default:
+			}
+		}
 	}
-	for _, worker := range s.Workers {
-		worker.Quit <- true
+	close(queue)
+	wg.Wait() // Wait for all sorts to complete
+	if err == nil && 0 < len(errs) {
+		err = <-errs
 	}
-	wg.Wait() // Wait for all quicksorts to complete
+	return err
+}
 
-	// K-way merge sort using binary heap
+// mergeTapes - K-way merge of the sorted tapes
+func (s *Sorter) mergeTapes(stats *indexfile.StatsBuilder, digestRuns *indexfile.RunsBuilder) error {
+	s.mergeStarted = time.Now()
 	s.Status = StatusMerging
-	for _, tape := range s.Tapes {
-		tape.Prefetch(0)
+	entrySize := s.Header.EntrySize()
+	share := s.MaxPerTapeBufSize
+	if s.WorkerBufSize < share {
+		share = s.WorkerBufSize // No larger than a tape
 	}
-	s.PopulateHeap()
-
-	outputBuf := make([]*Entry, 0)
-	count := 0
-
-	for {
-		value, okay := s.Heap.Pop()
-		count++
-		s.MergePercent = (float64(count) / float64(s.NumberOfEntires)) * 100.0
-		if !okay {
-			panic("Failed to pop value from heap")
-		}
-		entry := value.(*Entry)
-		outputBuf = append(outputBuf, entry)
-		if s.MergeBufLen < len(outputBuf) {
-			s.Drain(outputBuf)
-			outputBuf = make([]*Entry, 0)
-		}
-		nextEntry, okay := s.Tapes[entry.TapeIndex].Pop()
-		if okay {
-			nextEntry.TapeIndex = entry.TapeIndex
-			s.Heap.Push(nextEntry)
+	bufSize := mergeBufSizeOf(share)
+	runs := []*run{}
+	defer func() {
+		for _, run := range runs {
+			run.Close()
 		}
-		if s.IsMergeCompleted() {
-			break
+	}()
+	mergeBufs := (len(s.Tapes) + 1) * bufSize
+	s.memory.alloc(mergeBufs)
+	defer s.memory.free(mergeBufs)
+	for _, tape := range s.Tapes {
+		run, err := openRun(s.FS, tape.Path(), 0, s.Header, bufSize)
+		if err != nil {
+			return err
 		}
+		runs = append(runs, run)
+	}
+	writer := bufio.NewWriterSize(s.Output, bufSize)
+	s.memory.sampleHeap()
+	count := 0
+	err := mergeRuns(runs, s.Header, writer, &mergeOptions{
+		fence:  s.Fence,
+		stats:  stats,
+		runs:   digestRuns,
+		dedupe: s.Dedupe,
+		merged: func() {
+			count++
+			s.MergePercent = (float64(count) / float64(s.NumberOfEntires)) * 100.0
+			atomic.StoreInt64(&s.mergedBytes, int64(count*entrySize))
+		},
+	})
+	if err != nil {
+		return err
 	}
-	s.Drain(outputBuf)
+	return writer.Flush()
 }
 
-// IsMergeCompleted - Returns true if all tapes have ended and heap is size 0
-func (s *Sorter) IsMergeCompleted() bool {
-	for _, tape := range s.Tapes {
-		if !tape.IsEndOfTape() || 0 < len(tape.Entries) {
-			return false
-		}
-	}
-	if 0 < s.Heap.Size() {
-		return false
+// outputID - The ID of the sorted output, the sidecars are bound to it
+func (s *Sorter) outputID() (*indexfile.IndexID, error) {
+	info, err := s.Output.Stat()
+	if err != nil {
+		return nil, err
 	}
-	return true
+	return indexfile.NewIndexID(s.Output, info.Size())
+}
+
+// writeFence - Write the fence sidecar of the sorted output
+func (s *Sorter) writeFence(id *indexfile.IndexID) error {
+	fence := s.Fence.Fence()
+	fence.IndexChecksum = id.Checksum
+	return fence.WriteFile(indexfile.FencePath(s.OutputPath))
+}
+
+// writeStats - Write the stats sidecar of the sorted output
+func (s *Sorter) writeStats(stats *indexfile.StatsBuilder, id *indexfile.IndexID) error {
+	s.Stats = stats.Stats()
+	s.Stats.IndexChecksum = id.Checksum
+	return s.Stats.WriteFile(indexfile.StatsPath(s.OutputPath))
+}
+
+// writeRuns - Write the runs sidecar of the sorted output
+func (s *Sorter) writeRuns(digestRuns *indexfile.RunsBuilder, id *indexfile.IndexID) error {
+	s.Runs = digestRuns.Runs()
+	s.Runs.IndexChecksum = id.Checksum
+	return s.Runs.WriteFile(indexfile.RunsPath(s.OutputPath))
 }
 
 // CreateTape - Creates a tape and loads the entire tap into memory
-func (s *Sorter) CreateTape(id int, entriesPerTape int) *Tape {
+func (s *Sorter) CreateTape(id int, entriesPerTape int) (*Tape, error) {
+	return s.readTape(id, make([]byte, entriesPerTape*s.Header.EntrySize()))
+}
+
+// readTape - Read the next tape of the index into records, the tape is
+// shorter than records at the end of the index
+func (s *Sorter) readTape(id int, records []byte) (*Tape, error) {
 	tape := &Tape{
-		ID:       id,
-		Dir:      s.TapeDir,
-		FileName: fmt.Sprintf("%s_%d.tape", s.Info.Name(), id),
-		Position: 0,
-		Entries:  make([]*Entry, entriesPerTape),
-	}
-	for entryIndex := 0; entryIndex < entriesPerTape; entryIndex++ {
-		buf := make([]byte, entrySize)
-		_, err := io.ReadAtLeast(s.Index, buf, entrySize)
-		if err == io.EOF {
-			tape.Entries = append([]*Entry(nil), tape.Entries[:entryIndex]...)
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		tape.Entries[entryIndex] = &Entry{
-			Digest: buf[:digestSize],
-			Offset: buf[digestSize:],
-		}
+		ID:         id,
+		Dir:        s.TapeDir,
+		FileName:   fmt.Sprintf("%s_%d.tape", s.Info.Name(), id),
+		DigestSize: s.Header.DigestSize,
+		EntrySize:  s.Header.EntrySize(),
+		Records:    records,
+	}
+	n, err := io.ReadFull(s.Index, tape.Records)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
 	}
-	tape.Len = len(tape.Entries)
-	return tape
+	tape.Len = n / tape.EntrySize
+	tape.Records = tape.Records[:tape.Len*tape.EntrySize]
+	return tape, nil
 }
 
 // TapesCompleted - Number of tapes completed
@@ -397,55 +474,58 @@ func (s *Sorter) TapesCompleted() int {
 	return sum
 }
 
-// Worker - An instance of quicksort
+// Worker - Sorts tapes in memory
 type Worker struct {
 	ID             int
 	Queue          <-chan *Tape
-	Quit           chan bool
+	Errors         chan<- error  // The worker stops after its first error
+	Buffers        chan<- []byte // Tape buffers are returned once saved
 	Wg             *sync.WaitGroup
+	Header         *indexfile.Header
+	Dedupe         bool
+	FS             filesystem.FS
 	MaxGoRoutines  int
 	TapesCompleted int
+
+	memory  *memoryAccount
+	scratch []byte
 }
 
 func (w *Worker) start() {
 	go func() {
-		for {
-			select {
-			case tape := <-w.Queue:
-				Quicksort(tape.Entries)
-				tape.Save()
-				w.TapesCompleted++
-			case <-w.Quit:
-				w.Wg.Done()
+		defer func() {
+			w.memory.free(cap(w.scratch))
+			w.scratch = nil
+			w.Wg.Done()
+		}()
+		for tape := range w.Queue {
+			if cap(w.scratch) < len(tape.Records) {
+				w.memory.free(cap(w.scratch))
+				w.scratch = make([]byte, cap(tape.Records))
+				w.memory.alloc(cap(w.scratch))
+			}
+			radixSort(tape.Records, w.scratch, w.Header, w.Dedupe)
+			w.memory.sampleHeap()
+			records := tape.Records
+			err := tape.Save(w.FS)
+			if err != nil {
+				w.Errors <- err
 				return
 			}
+			w.Buffers <- records[:cap(records)]
+			w.TapesCompleted++
 		}
 	}()
 }
 
-// Quicksort - Sort the entries
+// Quicksort - Sort the entries of a digest index in ascending order, tapes
+// are sorted with RadixSort
 func Quicksort(entries []*Entry) {
 	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Value() > entries[j].Value()
+		return indexfile.Compare(entries[i].Digest, entries[j].Digest) < 0
 	})
 }
 
-// EntryComparer - Compares entries in an index
-func EntryComparer(a, b interface{}) int {
-	aAsserted := a.(*Entry)
-	aValue := aAsserted.Value()
-	bAsserted := b.(*Entry)
-	bValue := bAsserted.Value()
-	switch {
-	case aValue > bValue:
-		return 1
-	case aValue < bValue:
-		return -1
-	default:
-		return 0
-	}
-}
-
 // CheckSort - Check if an index is sorted
 func CheckSort(index string, verbose bool) (bool, error) {
 	indexStat, err := os.Stat(index)
@@ -458,19 +538,31 @@ func CheckSort(index string, verbose bool) (bool, error) {
 	}
 	defer indexFile.Close()
 
+	header, err := indexfile.Read(indexFile)
+	if err != nil {
+		return false, err
+	}
 	idx := &Sorter{
-		Index: indexFile,
-		Info:  indexStat,
+		Index:           indexFile,
+		Info:            indexStat,
+		Header:          header,
+		NumberOfEntires: header.NumberOfEntries(indexStat.Size()),
 	}
 
-	if idx.Info.Size()%entrySize != 0 {
+	if (idx.Info.Size()-header.Size())%int64(header.EntrySize()) != 0 {
 		return false, errors.New("Irregular file size")
 	}
 	for index := 0; index < idx.NumberOfEntires-1; index++ {
-		entry := idx.Get(index)
-		nextEntry := idx.Get(index + 1)
-		if nextEntry.Value() < entry.Value() {
-			msg := fmt.Sprintf("%09d - [%d : %v]\n", index, nextEntry.Value(), nextEntry.Offset)
+		entry, err := idx.Get(index)
+		if err != nil {
+			return false, err
+		}
+		nextEntry, err := idx.Get(index + 1)
+		if err != nil {
+			return false, err
+		}
+		if header.Compare(nextEntry.Digest, entry.Digest) < 0 {
+			msg := fmt.Sprintf("%09d - [%x : %v]\n", index, nextEntry.Digest, nextEntry.Offset)
 			err := fmt.Errorf("Index is not sorted correctly: %s", msg)
 			return false, err
 		}
@@ -487,17 +579,23 @@ func GetSorter(index, output string, maxWorkers, maxMemory int, tempDir string,
 	if indexStat.IsDir() || indexStat.Size() == 0 {
 		return nil, errors.New("Invalid index file: target is directory or empty file")
 	}
+	header, err := indexfile.ReadFile(index)
+	if err != nil {
+		return nil, err
+	}
 
 	sorter := &Sorter{
 		IndexPath:       index,
 		Info:            indexStat,
-		NumberOfEntires: int(indexStat.Size() / entrySize),
+		Header:          header,
+		NumberOfEntires: header.NumberOfEntries(indexStat.Size()),
 		MaxWorkers:      maxWorkers,
 		MaxMemory:       maxMemory * Mb,
 		TapeDir:         filepath.Join(tempDir, ".tapes"),
 		NoTapeCleanup:   noTapeCleanup,
-		Heap:            binaryheap.NewWith(EntryComparer),
 		OutputPath:      output,
+		MinRunLength:    indexfile.DefaultMinRunLength,
+		FS:              filesystem.OS,
 	}
 	return sorter, nil
 }
@@ -1,9 +1,17 @@
 package sorter
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/moloch--/leakdb/internal/testutil"
+	"github.com/moloch--/leakdb/pkg/filesystem"
+	"github.com/moloch--/leakdb/pkg/indexer"
+	"github.com/moloch--/leakdb/pkg/indexfile"
 )
 
 const (
@@ -17,6 +25,9 @@ func testSort(t *testing.T, input string) {
 		return
 	}
 	defer os.Remove(output.Name())
+	defer os.Remove(output.Name() + ".fence")
+	defer os.Remove(output.Name() + ".stats")
+	defer os.Remove(output.Name() + ".runs")
 
 	tempDir, err := ioutil.TempDir("", "leakdb_")
 	if err != nil {
@@ -26,7 +37,9 @@ func testSort(t *testing.T, input string) {
 	defer os.RemoveAll(tempDir)
 
 	sorter, err := GetSorter(input, output.Name(), 4, maxMemory, tempDir, false)
-	sorter.Start()
+	if err == nil {
+		err = sorter.Start()
+	}
 	if err != nil {
 		t.Errorf("Sort error: %s\n", err)
 		return
@@ -55,3 +68,485 @@ func TestSorterSmallUser(t *testing.T) {
 func TestSorterSmallDomain(t *testing.T) {
 	testSort(t, "../../test/small-domain-unsorted.idx")
 }
+
+func TestMerge(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifest := indexfile.NewManifest(filepath.Join(tempDir, "dataset.json"))
+	inputs := []string{}
+	for id, target := range []string{"../../test/small-bloomed.json", "../../test/large-bloomed.json"} {
+		shard, err := manifest.Add(target)
+		if err != nil {
+			t.Errorf("Manifest error: %s", err)
+			return
+		}
+		unsorted := filepath.Join(tempDir, fmt.Sprintf("%d.idx", id))
+		index, err := indexer.GetIndexer(target, unsorted, "domain", 8, 2, tempDir, false)
+		if err != nil {
+			t.Errorf("Index error: %s", err)
+			return
+		}
+		index.SetShard(shard)
+		if err = index.Start(); err != nil {
+			t.Errorf("Index error: %s", err)
+			return
+		}
+		sorted := filepath.Join(tempDir, fmt.Sprintf("%d-sorted.idx", id))
+		sorter, _ := GetSorter(unsorted, sorted, 2, maxMemory, tempDir, false)
+		if err = sorter.Start(); err != nil {
+			t.Errorf("Sort error: %s", err)
+			return
+		}
+		inputs = append(inputs, sorted)
+	}
+
+	output := filepath.Join(tempDir, "merged.idx")
+	if err = Merge(inputs, output); err != nil {
+		t.Errorf("Merge error: %s", err)
+		return
+	}
+	header, err := indexfile.ReadFile(output)
+	if err != nil || header.VerifyManifest(manifest) != nil {
+		t.Errorf("Merged header does not match the manifest: %v (%v)", header, err)
+		return
+	}
+	data, _ := ioutil.ReadFile(output)
+	entries := data[header.Size():]
+	entrySize := header.EntrySize()
+	if len(entries) != (50+8000)*entrySize {
+		t.Errorf("Merged index has %d bytes of entries", len(entries))
+		return
+	}
+	shards := map[uint16]int{}
+	for position := 0; position < len(entries); position += entrySize {
+		if 0 < position && header.Compare(entries[position:position+header.DigestSize], entries[position-entrySize:position-entrySize+header.DigestSize]) < 0 {
+			t.Errorf("Merged index is not sorted at %d", position/entrySize)
+			return
+		}
+		shard, _ := indexfile.SplitLocation(indexfile.Offset(entries[position+header.DigestSize : position+entrySize]))
+		shards[shard]++
+	}
+	if shards[0] != 50 || shards[1] != 8000 {
+		t.Errorf("Unexpected entries per shard %v", shards)
+		return
+	}
+	runs, err := indexfile.ReadRunsFile(indexfile.RunsPath(output), outputID(t, output))
+	if err != nil || runs.NumberOfEntries != 8050 || runs.MinLength != indexfile.DefaultMinRunLength {
+		t.Errorf("Unexpected merged runs %+v (%v)", runs, err)
+		return
+	}
+
+	if err = Merge([]string{inputs[0], "../../test/small-domain-unsorted.idx"}, output); err == nil {
+		t.Errorf("Expected an error merging an index that is not sharded")
+		return
+	}
+
+	// The output cannot be an input, however the path is written
+	input, _ := ioutil.ReadFile(inputs[1])
+	if err = Merge(inputs, filepath.Join(tempDir, ".", filepath.Base(inputs[1]))); err == nil {
+		t.Errorf("Expected an error merging into an input")
+		return
+	}
+	if unchanged, _ := ioutil.ReadFile(inputs[1]); !bytes.Equal(input, unchanged) {
+		t.Errorf("Merging into an input changed it")
+		return
+	}
+
+	// A failed merge removes the output and any sidecars at its path
+	failed := filepath.Join(tempDir, "failed.idx")
+	sidecars := []string{indexfile.FencePath(failed), indexfile.StatsPath(failed), indexfile.RunsPath(failed)}
+	for _, sidecar := range sidecars {
+		ioutil.WriteFile(sidecar, []byte("stale"), 0644)
+	}
+	fs := &testutil.Faulty{FS: filesystem.OS, Match: func(name string) bool { return name == failed }, Limit: 100}
+	if err = MergeWith(inputs, failed, &MergeOptions{FS: fs}); err != testutil.ErrNoSpace {
+		t.Errorf("Expected %v, got %v", testutil.ErrNoSpace, err)
+		return
+	}
+	for _, path := range append(sidecars, failed) {
+		if exists(path) {
+			t.Errorf("%s exists after a failed merge", path)
+			return
+		}
+	}
+}
+
+func TestSorterTapes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := "../../test/small-email-unsorted.idx"
+	output := filepath.Join(tempDir, "sorted.idx")
+	sorter, err := GetSorter(input, output, 3, maxMemory, tempDir, false)
+	if err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	sorter.MaxMemory = 64 // Many small tapes
+	if err = sorter.Start(); err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	if sorter.NumberOfTapes < 10 {
+		t.Errorf("Expected at least 10 tapes, got %d", sorter.NumberOfTapes)
+		return
+	}
+	if sorter.MergeThroughput() <= 0 {
+		t.Errorf("Expected merge throughput, got %f", sorter.MergeThroughput())
+		return
+	}
+
+	data, _ := ioutil.ReadFile(output)
+	entries := data[sorter.Header.Size():]
+	entrySize := sorter.Header.EntrySize()
+	if len(entries) != sorter.NumberOfEntires*entrySize {
+		t.Errorf("Sorted index has %d bytes of entries, expected %d", len(entries), sorter.NumberOfEntires*entrySize)
+		return
+	}
+	for position := entrySize; position < len(entries); position += entrySize {
+		if sorter.Header.Compare(entries[position:position+sorter.Header.DigestSize], entries[position-entrySize:position-entrySize+sorter.Header.DigestSize]) < 0 {
+			t.Errorf("Sorted index is not sorted at %d", position/entrySize)
+			return
+		}
+	}
+}
+
+func TestSorterMemory(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := "../../test/large-email-unsorted.idx"
+	output := filepath.Join(tempDir, "sorted.idx")
+	sorter, err := GetSorter(input, output, 3, maxMemory, tempDir, false)
+	if err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	sorter.MaxMemory = 64 * Kb
+	if err = sorter.Start(); err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	if sorter.NumberOfTapes <= sorter.MaxWorkers+1 {
+		t.Errorf("Expected more tapes than tape buffers, got %d", sorter.NumberOfTapes)
+		return
+	}
+	memory := sorter.Memory()
+	if memory.Peak <= 0 || memory.Budget < memory.Peak || memory.InUse != 0 || memory.PeakHeap <= 0 {
+		t.Errorf("Memory %+v is over budget or was not released", memory)
+		return
+	}
+	sorted, err := CheckSort(output, false)
+	if err != nil || !sorted {
+		t.Errorf("Check sort failed (%v)", err)
+	}
+}
+
+func TestSorterDedupe(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The same entries indexed twice, e.g. after re-indexing appended data
+	data, err := ioutil.ReadFile("../../test/small-email-unsorted.idx")
+	if err != nil {
+		t.Errorf("Read error: %s", err)
+		return
+	}
+	input := filepath.Join(tempDir, "twice.idx")
+	ioutil.WriteFile(input, append(append([]byte{}, data...), data...), 0644)
+
+	output := filepath.Join(tempDir, "sorted.idx")
+	sorter, err := GetSorter(input, output, 2, maxMemory, tempDir, false)
+	if err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	sorter.MaxMemory = 256
+	sorter.Dedupe = true
+	if err = sorter.Start(); err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+
+	numberOfEntries := sorter.NumberOfEntires / 2
+	stats, err := indexfile.ReadStatsFile(indexfile.StatsPath(output), outputID(t, output))
+	if err != nil {
+		t.Errorf("Stats error: %s", err)
+		return
+	}
+	if stats.Entries != int64(numberOfEntries) || stats.Duplicates != int64(numberOfEntries) || stats.DistinctDigests < 1 || stats.LargestRun < 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+		return
+	}
+	sorted, _ := ioutil.ReadFile(output)
+	entrySize := sorter.Header.EntrySize()
+	if len(sorted) != numberOfEntries*entrySize {
+		t.Errorf("Sorted index has %d bytes, expected %d", len(sorted), numberOfEntries*entrySize)
+		return
+	}
+	for position := entrySize; position < len(sorted); position += entrySize {
+		if bytes.Equal(sorted[position-entrySize:position], sorted[position:position+entrySize]) {
+			t.Errorf("Duplicate entry at %d", position/entrySize)
+			return
+		}
+	}
+}
+
+func TestSorterRuns(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	output := filepath.Join(tempDir, "sorted.idx")
+	sorter, err := GetSorter("../../test/large-domain-unsorted.idx", output, 2, maxMemory, tempDir, false)
+	if err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	sorter.MinRunLength = 16
+	if err = sorter.Start(); err != nil {
+		t.Errorf("Sort error: %s\n", err)
+		return
+	}
+	runs, err := indexfile.ReadRunsFile(indexfile.RunsPath(output), outputID(t, output))
+	if err != nil {
+		t.Errorf("Runs error: %s", err)
+		return
+	}
+
+	// Every run of at least 16 entries is recorded, and nothing else
+	data, _ := ioutil.ReadFile(output)
+	entries := data[sorter.Header.Size():]
+	entrySize, digestSize := sorter.Header.EntrySize(), sorter.Header.DigestSize
+	digest := func(index int) []byte {
+		return entries[index*entrySize : index*entrySize+digestSize]
+	}
+	expected := 0
+	for start := 0; start < sorter.NumberOfEntires; {
+		end := start + 1
+		for end < sorter.NumberOfEntires && bytes.Equal(digest(start), digest(end)) {
+			end++
+		}
+		run, ok := runs.Lookup(digest(start))
+		if ok != (16 <= end-start) || (ok && (run.Start != int64(start) || run.Length != int64(end-start))) {
+			t.Errorf("Run of %x is [%d, %d), sidecar has %+v (%v)", digest(start), start, end, run, ok)
+			return
+		}
+		if ok {
+			expected++
+		}
+		start = end
+	}
+	if expected == 0 || len(runs.Runs) != expected || len(sorter.Runs.Runs) != expected {
+		t.Errorf("Expected %d runs, got %d", expected, len(runs.Runs))
+	}
+}
+
+func TestMergeRebase(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Indexes created without a manifest
+	targets := []string{"../../test/small-bloomed.json", "../../test/large-bloomed.json"}
+	sorted := []string{}
+	for id, target := range targets {
+		unsorted := filepath.Join(tempDir, fmt.Sprintf("%d.idx", id))
+		index, err := indexer.GetIndexer(target, unsorted, "email", 8, 2, tempDir, false)
+		if err != nil {
+			t.Errorf("Index error: %s", err)
+			return
+		}
+		if err = index.Start(); err != nil {
+			t.Errorf("Index error: %s", err)
+			return
+		}
+		output := filepath.Join(tempDir, fmt.Sprintf("%d-sorted.idx", id))
+		sorter, _ := GetSorter(unsorted, output, 2, maxMemory, tempDir, false)
+		sorter.Dedupe = true
+		if err = sorter.Start(); err != nil {
+			t.Errorf("Sort error: %s", err)
+			return
+		}
+		sorted = append(sorted, output)
+	}
+	manifest := indexfile.NewManifest(filepath.Join(tempDir, "dataset.json"))
+	if _, err = manifest.Add(targets[0]); err != nil {
+		t.Errorf("Manifest error: %s", err)
+		return
+	}
+
+	if err = Merge(sorted[:1], filepath.Join(tempDir, "x.idx")); err == nil {
+		t.Errorf("Expected an error merging an index that is not sharded without a manifest")
+		return
+	}
+	first := filepath.Join(tempDir, "first.idx")
+	if err = MergeWith(sorted[:1], first, &MergeOptions{Manifest: manifest}); err != nil {
+		t.Errorf("Merge error: %s", err)
+		return
+	}
+	if err = MergeWith(sorted[1:], first+".x", &MergeOptions{Manifest: manifest}); err == nil {
+		t.Errorf("Expected an error merging an index of a file that is not in the manifest")
+		return
+	}
+
+	// Incremental ingestion of a new shard
+	if _, err = manifest.Add(targets[1]); err != nil {
+		t.Errorf("Manifest error: %s", err)
+		return
+	}
+	if err = MergeWith([]string{sorted[0], sorted[0]}, first+".x", &MergeOptions{Manifest: manifest}); err == nil {
+		t.Errorf("Expected an error rebasing two indexes onto the same shard")
+		return
+	}
+	second := filepath.Join(tempDir, "second.idx")
+	if err = MergeWith([]string{first, sorted[1]}, second, &MergeOptions{Manifest: manifest}); err != nil {
+		t.Errorf("Merge error: %s", err)
+		return
+	}
+	header, err := indexfile.ReadFile(second)
+	if err != nil || header.VerifyManifest(manifest) != nil {
+		t.Errorf("Merged header does not match the manifest: %v (%v)", header, err)
+		return
+	}
+	stats, err := indexfile.ReadStatsFile(indexfile.StatsPath(second), outputID(t, second))
+	if err != nil || stats.Entries != 8050 {
+		t.Errorf("Unexpected stats %+v (%v)", stats, err)
+		return
+	}
+	data, _ := ioutil.ReadFile(second)
+	entries := data[header.Size():]
+	shards := map[uint16]int{}
+	for position := 0; position < len(entries); position += header.EntrySize() {
+		shard, _ := indexfile.SplitLocation(indexfile.Offset(entries[position+header.DigestSize : position+header.EntrySize()]))
+		shards[shard]++
+	}
+	if shards[0] != 50 || shards[1] != 8000 {
+		t.Errorf("Unexpected entries per shard %v", shards)
+		return
+	}
+
+	// Merging an index into itself only adds duplicates
+	deduped := filepath.Join(tempDir, "deduped.idx")
+	if err = MergeWith([]string{second, second}, deduped, &MergeOptions{Dedupe: true}); err != nil {
+		t.Errorf("Merge error: %s", err)
+		return
+	}
+	dedupedStats, err := indexfile.ReadStatsFile(indexfile.StatsPath(deduped), outputID(t, deduped))
+	if err != nil || dedupedStats.Entries != 8050 || dedupedStats.Duplicates != 8050 || dedupedStats.DistinctDigests != stats.DistinctDigests {
+		t.Errorf("Unexpected stats %+v (%v)", dedupedStats, err)
+	}
+}
+
+// outputID - The ID of the index at path, its sidecars must match it
+func outputID(t *testing.T, path string) *indexfile.IndexID {
+	id, err := indexfile.ReadIndexID(path)
+	if err != nil {
+		t.Fatalf("IndexID error: %s", err)
+	}
+	return id
+}
+
+func TestCheckSort(t *testing.T) {
+	sorted, err := CheckSort("../../test/small-email-unsorted.idx", false)
+	if err == nil || sorted {
+		t.Errorf("Unsorted index passed the sort check")
+		return
+	}
+	sorted, err = CheckSort("../../test/large-email-sorted.idx", false)
+	if err != nil || !sorted {
+		t.Errorf("Sorted index failed the sort check: %v", err)
+		return
+	}
+
+	// Read errors are returned, not treated as sorted entries
+	indexFile, err := os.Open("../../test/large-email-sorted.idx")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	header, err := indexfile.Read(indexFile)
+	indexFile.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	idx := &Sorter{Index: indexFile, Header: header}
+	if _, err = idx.Get(0); err == nil {
+		t.Errorf("Expected a read error from a closed index")
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestSorterWriteFailure(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Errorf("Temp error: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := "../../test/small-email-unsorted.idx"
+	output := filepath.Join(tempDir, "sorted.idx")
+	tests := []struct {
+		name      string
+		match     func(name string) bool
+		noCleanup bool
+	}{
+		{"tape", func(name string) bool { return filepath.Ext(name) == ".tape" }, false},
+		{"output", func(name string) bool { return name == output }, false},
+		{"no cleanup", func(name string) bool { return filepath.Ext(name) == ".tape" }, true},
+	}
+	for _, test := range tests {
+		sorter, err := GetSorter(input, output, 3, maxMemory, tempDir, test.noCleanup)
+		if err != nil {
+			t.Errorf("Sort error: %s\n", err)
+			return
+		}
+		sorter.MaxMemory = 64 // Many small tapes
+		sorter.FS = &testutil.Faulty{FS: filesystem.OS, Match: test.match, Limit: 100}
+		err = sorter.Start()
+		if err != testutil.ErrNoSpace {
+			t.Errorf("%s: expected %v, got %v", test.name, testutil.ErrNoSpace, err)
+			return
+		}
+		if exists(output) != test.noCleanup || exists(sorter.TapeDir) != test.noCleanup {
+			t.Errorf("%s: expected output and tapes to exist %v, output %v tapes %v",
+				test.name, test.noCleanup, exists(output), exists(sorter.TapeDir))
+			return
+		}
+		if exists(indexfile.FencePath(output)) || exists(indexfile.StatsPath(output)) || exists(indexfile.RunsPath(output)) {
+			t.Errorf("%s: sidecars written for a failed sort", test.name)
+			return
+		}
+		os.Remove(output)
+		os.RemoveAll(sorter.TapeDir)
+	}
+}
@@ -0,0 +1,179 @@
+package targets
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SymlinkSkip - Ignore symlinks entirely
+	SymlinkSkip = "skip"
+	// SymlinkFiles - Follow symlinks to files, but not to directories
+	SymlinkFiles = "files"
+	// SymlinkFollow - Follow symlinks to files and directories
+	SymlinkFollow = "follow"
+)
+
+// Options - Selects which files under a target are used as input
+type Options struct {
+	Recursive  bool     `json:"recursive"`
+	Include    []string `json:"include"`
+	Exclude    []string `json:"exclude"`
+	SkipPrefix string   `json:"skip_prefix"`
+	SkipSuffix string   `json:"skip_suffix"`
+	MinSize    int64    `json:"min_size"`
+	MaxSize    int64    `json:"max_size"`
+	Symlinks   string   `json:"symlinks"`
+}
+
+// Find - Get the files selected by options from a target file or directory,
+// the target itself is always returned if it is a regular file
+func Find(target string, options *Options) ([]string, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	switch options.Symlinks {
+	case "", SymlinkSkip, SymlinkFiles, SymlinkFollow:
+	default:
+		return nil, fmt.Errorf("Invalid symlink policy '%s'", options.Symlinks)
+	}
+	for _, pattern := range append(options.Include, options.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s' (%s)", pattern, err)
+		}
+	}
+
+	targetStat, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !targetStat.IsDir() {
+		return []string{target}, nil
+	}
+	finder := &finder{
+		root:    target,
+		options: options,
+		visited: map[string]bool{},
+		targets: []string{},
+	}
+	err = finder.walk(target)
+	if err != nil {
+		return nil, err
+	}
+	return finder.targets, nil
+}
+
+type finder struct {
+	root    string
+	options *Options
+	visited map[string]bool // Real paths of directories, avoids symlink loops
+	targets []string
+}
+
+func (f *finder) walk(dir string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if f.visited[realDir] {
+		return nil
+	}
+	f.visited[realDir] = true
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		filePath := filepath.Join(dir, file.Name())
+		if file.Mode()&os.ModeSymlink != 0 {
+			if f.options.Symlinks == SymlinkSkip {
+				continue
+			}
+			file, err = os.Stat(filePath)
+			if err != nil {
+				continue // Dangling symlink
+			}
+			if file.IsDir() && f.options.Symlinks != SymlinkFollow {
+				continue
+			}
+		}
+		if file.IsDir() {
+			if f.options.Recursive {
+				err = f.walk(filePath)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if file.Mode().IsRegular() && f.selected(filePath, file) {
+			f.targets = append(f.targets, filePath)
+		}
+	}
+	return nil
+}
+
+// selected - Apply name and size filters to a regular file
+func (f *finder) selected(filePath string, file os.FileInfo) bool {
+	name := file.Name()
+	if f.options.SkipPrefix != "" && strings.HasPrefix(name, f.options.SkipPrefix) {
+		return false
+	}
+	if f.options.SkipSuffix != "" && strings.HasSuffix(name, f.options.SkipSuffix) {
+		return false
+	}
+	if 0 < len(f.options.Include) && !f.match(f.options.Include, filePath, name) {
+		return false
+	}
+	if f.match(f.options.Exclude, filePath, name) {
+		return false
+	}
+	if file.Size() < f.options.MinSize {
+		return false
+	}
+	if 0 < f.options.MaxSize && f.options.MaxSize < file.Size() {
+		return false
+	}
+	return true
+}
+
+// match - Patterns containing a path separator are matched against the path
+// relative to the root target, all others against the file name
+func (f *finder) match(patterns []string, filePath string, name string) bool {
+	relPath, err := filepath.Rel(f.root, filePath)
+	if err != nil {
+		relPath = filePath
+	}
+	for _, pattern := range patterns {
+		subject := name
+		if strings.ContainsRune(pattern, '/') || strings.ContainsRune(pattern, filepath.Separator) {
+			subject = filepath.ToSlash(relPath)
+			pattern = filepath.ToSlash(pattern)
+		}
+		if matched, _ := filepath.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package targets
+
+/*
+	---------------------------------------------------------------------
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+	----------------------------------------------------------------------
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	files, err := Find("../../test/a", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(files) != 1 {
+		t.Errorf("Unexpected number of targets %d", len(files))
+		return
+	}
+	if files[0] != "../../test/a/a.txt" {
+		t.Errorf("Unexpected target '%s'", files[0])
+		return
+	}
+
+	files, err = Find("../../test/a", &Options{Recursive: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(files) != 2 {
+		t.Errorf("Unexpected number of recursive targets %d: %v", len(files), files)
+		return
+	}
+
+	files, err = Find("../../test/a/a.txt", &Options{Exclude: []string{"*.txt"}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(files) != 1 {
+		t.Errorf("Explicit file target was filtered: %v", files)
+		return
+	}
+}
+
+func testTree(t *testing.T) string {
+	tempDir, err := ioutil.TempDir("", "leakdb_")
+	if err != nil {
+		t.Fatalf("Temp error: %s\n", err)
+	}
+	os.MkdirAll(filepath.Join(tempDir, "sub", "deep"), 0700)
+	files := map[string]int{
+		"a.txt":             10,
+		"b.json":            100,
+		"skip_c.txt":        10,
+		"sub/d.txt":         1000,
+		"sub/deep/e.txt":    10,
+		"sub/deep/f.txt.gz": 10,
+	}
+	for name, size := range files {
+		ioutil.WriteFile(filepath.Join(tempDir, name), []byte(strings.Repeat("x", size)), 0600)
+	}
+	return tempDir
+}
+
+func names(root string, files []string) string {
+	rel := []string{}
+	for _, file := range files {
+		relPath, _ := filepath.Rel(root, file)
+		rel = append(rel, filepath.ToSlash(relPath))
+	}
+	return strings.Join(rel, ",")
+}
+
+func TestFindFilters(t *testing.T) {
+	root := testTree(t)
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{}, "a.txt,b.json,skip_c.txt"},
+		{&Options{Recursive: true}, "a.txt,b.json,skip_c.txt,sub/d.txt,sub/deep/e.txt,sub/deep/f.txt.gz"},
+		{&Options{Recursive: true, Include: []string{"*.txt"}}, "a.txt,skip_c.txt,sub/d.txt,sub/deep/e.txt"},
+		{&Options{Recursive: true, Exclude: []string{"*.gz", "sub/*"}}, "a.txt,b.json,skip_c.txt,sub/deep/e.txt"},
+		{&Options{Recursive: true, SkipPrefix: "skip_", SkipSuffix: ".gz"}, "a.txt,b.json,sub/d.txt,sub/deep/e.txt"},
+		{&Options{Recursive: true, MinSize: 100}, "b.json,sub/d.txt"},
+		{&Options{Recursive: true, MinSize: 11, MaxSize: 100}, "b.json"},
+	}
+	for _, test := range tests {
+		files, err := Find(root, test.options)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if names(root, files) != test.expected {
+			t.Errorf("%+v: expected %s got %s", test.options, test.expected, names(root, files))
+		}
+	}
+}
+
+func TestFindSymlinks(t *testing.T) {
+	root := testTree(t)
+	defer os.RemoveAll(root)
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "link")); err != nil {
+		t.Skipf("Symlinks not supported: %s", err)
+	}
+	os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "deep", "link.txt"))
+	os.Symlink(root, filepath.Join(root, "sub", "loop")) // Must not recurse forever
+
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{SymlinkSkip, "a.txt,sub/d.txt,sub/deep/e.txt"},
+		{SymlinkFiles, "a.txt,sub/d.txt,sub/deep/e.txt,sub/deep/link.txt"},
+		{SymlinkFollow, "a.txt,link/d.txt,link/deep/e.txt,link/deep/link.txt"},
+	}
+	for _, test := range tests {
+		files, err := Find(root, &Options{Recursive: true, Include: []string{"*.txt"}, SkipPrefix: "skip_", Symlinks: test.policy})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if names(root, files) != test.expected {
+			t.Errorf("%s: expected %s got %s", test.policy, test.expected, names(root, files))
+		}
+	}
+
+	if _, err := Find(root, &Options{Symlinks: "sometimes"}); err == nil {
+		t.Error("Expected invalid symlink policy error")
+	}
+}